@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Separate listener for ops, keep it off the public internet
+func startAdminServer() {
+	addr := config.Load().AdminAddr
+	if addr == "" {
+		logInfo(SUB_ADMIN, "Admin listener disabled.")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	mux.HandleFunc("/api/players", adminAuth(http.MethodGet, apiPlayers))
+	mux.HandleFunc("/api/kick", adminAuth(http.MethodPost, apiKick))
+	mux.HandleFunc("/api/ban", adminAuth(http.MethodPost, apiBan))
+	mux.HandleFunc("/api/unban", adminAuth(http.MethodPost, apiUnban))
+	mux.HandleFunc("/api/bans", adminAuth(http.MethodGet, apiBans))
+	mux.HandleFunc("/api/names", adminAuth(http.MethodGet, apiNames))
+	mux.HandleFunc("/api/announce", adminAuth(http.MethodPost, apiAnnounce))
+	mux.HandleFunc("/api/save", adminAuth(http.MethodPost, apiSave))
+	mux.HandleFunc("/api/reload", adminAuth(http.MethodPost, apiReload))
+	mux.HandleFunc("/api/chunk", adminAuth(http.MethodGet, apiChunk))
+	mux.HandleFunc("/api/shutdown", adminAuth(http.MethodPost, apiShutdown))
+	mux.HandleFunc("/api/loglevel", adminAuth(http.MethodPost, apiLogLevel))
+
+	go func() {
+		defer reportPanic("startAdminServer")
+
+		logInfo(SUB_ADMIN, "Admin listener on %v", addr)
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			logError(SUB_ADMIN, "Admin ListenAndServe: %v", err)
+		}
+	}()
+}
+
+// Require the admin token as a bearer token, API is disabled without one
+func adminAuth(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer reportPanic("adminAuth")
+
+		token := config.Load().AdminToken
+		if token == "" {
+			writeJSON(w, http.StatusForbidden, apiError("admin API disabled, no AdminToken set"))
+			return
+		}
+
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			logWarn(SUB_ADMIN, "Admin API auth failed: %v", r.RemoteAddr)
+			writeJSON(w, http.StatusUnauthorized, apiError("unauthorized"))
+			return
+		}
+
+		if r.Method != method {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError("use "+method))
+			return
+		}
+
+		logInfo(SUB_ADMIN, "Admin API: %v %v from %v", r.Method, r.URL.Path, r.RemoteAddr)
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+func apiError(msg string) map[string]string {
+	return map[string]string{"error": msg}
+}
+
+func apiOK() map[string]string {
+	return map[string]string{"status": "ok"}
+}
+
+// Request body for POST commands, each uses the fields it needs
+type apiRequest struct {
+	ID      uint32
+	Name    string
+	Reason  string
+	Message string
+	Seconds int
+
+	Subsystem string
+	Level     string
+}
+
+func readAPIRequest(w http.ResponseWriter, r *http.Request) (*apiRequest, bool) {
+	req := &apiRequest{}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*64)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError(fmt.Sprintf("invalid json: %v", err)))
+		return nil, false
+	}
+	return req, true
+}
+
+// Find the player a request is about, by ID or name
+func (req *apiRequest) findPlayer() *playerData {
+	if req.ID != 0 {
+		return findPlayerByID(req.ID)
+	}
+	if req.Name != "" {
+		return findPlayerByName(req.Name)
+	}
+	return nil
+}
+
+type apiPlayer struct {
+	ID        uint32
+	Name      string
+	Account   string //"" until they pick one
+	Area      uint16
+	X, Y      float32
+	Health    int16
+	MaxHealth int16
+	Level     uint8
+	Mode      PMode
+	Addr      string
+	Flagged   bool //By anti-cheat
+	PeakScore int
+	RTTMS     int64 //0 until measured
+	Connected bool  //False while waiting to resume
+}
+
+func makeAPIPlayer(player *playerData) apiPlayer {
+	return apiPlayer{ID: player.id, Name: player.name, Account: player.account, Area: player.area.ID,
+		X: player.pos.X, Y: player.pos.Y, Health: player.health, MaxHealth: player.maxHealth,
+		Level: player.level, Mode: player.mode, Addr: player.addr,
+		Flagged: player.cheat.flagged, PeakScore: player.cheat.peakScore, RTTMS: player.rtt.Milliseconds(),
+		Connected: player.conn != nil}
+}
+
+func apiPlayers(w http.ResponseWriter, r *http.Request) {
+	processLock.RLock()
+	players := []apiPlayer{}
+	for _, player := range playerList {
+		players = append(players, makeAPIPlayer(player))
+	}
+	processLock.RUnlock()
+
+	writeJSON(w, http.StatusOK, players)
+}
+
+func apiKick(w http.ResponseWriter, r *http.Request) {
+	req, ok := readAPIRequest(w, r)
+	if !ok {
+		return
+	}
+
+	processLock.Lock()
+	defer processLock.Unlock()
+
+	player := req.findPlayer()
+	if player == nil {
+		writeJSON(w, http.StatusNotFound, apiError("no such player"))
+		return
+	}
+
+	reason := "kicked"
+	if req.Reason != "" {
+		reason = "kicked: " + req.Reason
+	}
+	removePlayer(player, reason)
+	writeJSON(w, http.StatusOK, apiOK())
+}
+
+// Ban an online player's name and IP, or just a name if they are offline
+func apiBan(w http.ResponseWriter, r *http.Request) {
+	req, ok := readAPIRequest(w, r)
+	if !ok {
+		return
+	}
+
+	processLock.Lock()
+	defer processLock.Unlock()
+
+	player := req.findPlayer()
+	if player == nil {
+		if req.Name == "" {
+			writeJSON(w, http.StatusNotFound, apiError("no such player"))
+			return
+		}
+		addBan(req.Name, "", req.Reason)
+		writeJSON(w, http.StatusOK, apiOK())
+		return
+	}
+
+	addBan(player.name, player.addr, req.Reason)
+	removePlayer(player, "banned")
+	writeJSON(w, http.StatusOK, apiOK())
+}
+
+// Name can be a banned name or IP
+func apiUnban(w http.ResponseWriter, r *http.Request) {
+	req, ok := readAPIRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if removeBan(req.Name) == 0 {
+		writeJSON(w, http.StatusNotFound, apiError("no matching ban"))
+		return
+	}
+	writeJSON(w, http.StatusOK, apiOK())
+}
+
+func apiBans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, getBans())
+}
+
+type apiNameHistory struct {
+	Online  *apiPlayer `json:",omitempty"`
+	Account string     //Whoever has the name now, "" if nobody
+	Display string
+	Changes []nameLogEntry
+}
+
+// Who has a name and its logged changes, ?name=
+func apiNames(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		writeJSON(w, http.StatusBadRequest, apiError("need name"))
+		return
+	}
+
+	out := apiNameHistory{Changes: searchNameLog(name, 100)}
+	processLock.RLock()
+	if player := findPlayerByName(name); player != nil {
+		online := makeAPIPlayer(player)
+		out.Online = &online
+		out.Account, out.Display = player.account, player.name
+	}
+	processLock.RUnlock()
+
+	if account := savedNameFor(name); out.Online == nil && account != "" {
+		if sdat, ok := readPlayerSave(account); ok {
+			out.Account, out.Display = sdat.Name, sdat.Display
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func apiAnnounce(w http.ResponseWriter, r *http.Request) {
+	req, ok := readAPIRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Message == "" || len(req.Message) > maxChat {
+		writeJSON(w, http.StatusBadRequest, apiError("message empty or too long"))
+		return
+	}
+
+	processLock.Lock()
+	send_chat("[Server] " + req.Message)
+	processLock.Unlock()
+
+	writeJSON(w, http.StatusOK, apiOK())
+}
+
+// Save every area, even if nothing changed
+func apiSave(w http.ResponseWriter, r *http.Request) {
+	processLock.Lock()
+	for _, area := range areaList {
+		if area != nil {
+			area.dirty = true
+		}
+	}
+	processLock.Unlock()
+
+	saveWorld()
+	writeJSON(w, http.StatusOK, apiOK())
+}
+
+func apiReload(w http.ResponseWriter, r *http.Request) {
+	err := reloadConfig()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError(err.Error()))
+		return
+	}
+	writeJSON(w, http.StatusOK, apiOK())
+}
+
+// Start a shutdown countdown, negative seconds cancels
+func apiShutdown(w http.ResponseWriter, r *http.Request) {
+	req, ok := readAPIRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if req.Seconds < 0 {
+		processLock.Lock()
+		cancelled := cancelShutdown()
+		processLock.Unlock()
+		if !cancelled {
+			writeJSON(w, http.StatusConflict, apiError("no shutdown pending"))
+			return
+		}
+		writeJSON(w, http.StatusOK, apiOK())
+		return
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "server shutdown"
+	}
+	if !startShutdown(time.Duration(req.Seconds)*time.Second, reason) {
+		writeJSON(w, http.StatusConflict, apiError("shutdown already pending"))
+		return
+	}
+	writeJSON(w, http.StatusOK, apiOK())
+}
+
+// Set a subsystem's level (or "all"), returns the current filters.
+// Subsystem "reset" goes back to the levels in config.
+func apiLogLevel(w http.ResponseWriter, r *http.Request) {
+	req, ok := readAPIRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if strings.EqualFold(req.Subsystem, "reset") {
+		resetLogLevels()
+	} else if req.Subsystem != "" {
+		level, err := parseLogLevel(req.Level)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError(err.Error()))
+			return
+		}
+		setLogLevel(strings.ToLower(req.Subsystem), level)
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"levels": getLogLevels()})
+}
+
+type apiChunkData struct {
+	Area      uint16
+	Chunk     XY
+	Objects   []*worldObject
+	Players   []apiPlayer
+	Creatures []apiCreature
+}
+
+type apiCreature struct {
+	UID     uint32
+	Section uint8
+	Num     uint8
+	X, Y    float32
+	Health  int16
+}
+
+// Contents of the chunk at world coordinates x,y
+func apiChunk(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	areaID, erra := strconv.ParseUint(query.Get("area"), 10, 16)
+	posX, errx := strconv.ParseUint(query.Get("x"), 10, 32)
+	posY, erry := strconv.ParseUint(query.Get("y"), 10, 32)
+	if erra != nil || errx != nil || erry != nil {
+		writeJSON(w, http.StatusBadRequest, apiError("need area, x and y"))
+		return
+	}
+
+	processLock.RLock()
+	defer processLock.RUnlock()
+
+	area := getArea(uint16(areaID))
+	if area == nil {
+		writeJSON(w, http.StatusNotFound, apiError("no such area"))
+		return
+	}
+
+	pos := XY{X: uint32(posX), Y: uint32(posY)}
+	out := apiChunkData{Area: area.ID, Chunk: XY{X: pos.X / chunkDiv, Y: pos.Y / chunkDiv},
+		Objects: []*worldObject{}, Players: []apiPlayer{}, Creatures: []apiCreature{}}
+
+	chunk := getChunk(area, pos)
+	if chunk != nil {
+		out.Objects = append(out.Objects, chunk.WorldObjects...)
+		for _, player := range chunk.players {
+			out.Players = append(out.Players, makeAPIPlayer(player))
+		}
+		for _, cre := range chunk.creatrues {
+			out.Creatures = append(out.Creatures, apiCreature{UID: cre.creatureData.id.UID,
+				Section: cre.creatureData.id.Section, Num: cre.creatureData.id.Num,
+				X: cre.pos.X, Y: cre.pos.Y, Health: cre.health})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+// IP without the port
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	auditFile       = "audit.log"
+	cheatDecayTicks = 8 //Score drops by one about every second
+
+	//Suspicion added per event
+	scoreInputFlood  = 1  //Move over the per tick limit
+	scoreBadInput    = 5  //Malformed or impossible message
+	scoreEditRange   = 10 //Edit far from the editor
+	scoreBadPassword = 5  //Wrong password for an account
+)
+
+// Per player anti-cheat accounting, reset on login
+type cheatData struct {
+	inputTick  uint64 //Tick tickInputs was counted on
+	tickInputs int    //Moves received this tick
+
+	score     int
+	peakScore int
+	decayTick uint64
+	flagged   bool           //Audited from here on
+	events    map[string]int //Count by reason
+}
+
+type auditEntry struct {
+	Time   time.Time
+	Tick   uint64
+	ID     uint32
+	Name   string
+	Addr   string
+	Event  string
+	Detail string `json:",omitempty"`
+	Score  int
+}
+
+var auditLock sync.Mutex
+
+// Append a line to the audit log, kept apart from the main log so it survives rotation
+func writeAudit(player *playerData, event, detail string) {
+	defer reportPanic("writeAudit")
+
+	entry := auditEntry{Time: time.Now().UTC(), Tick: gameTick, ID: player.id, Name: player.name,
+		Addr: player.addr, Event: event, Detail: detail, Score: player.cheat.score}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logError(SUB_CHEAT, "writeAudit: %v", err)
+		return
+	}
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	os.MkdirAll(logDir, 0755)
+	file, err := os.OpenFile(filepath.Join(logDir, auditFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logError(SUB_CHEAT, "writeAudit: %v", err)
+		return
+	}
+	defer file.Close()
+
+	file.Write(append(data, '\n'))
+}
+
+func decayCheatScore(player *playerData) {
+	cheat := &player.cheat
+	if cheat.score == 0 {
+		cheat.decayTick = gameTick
+		return
+	}
+
+	steps := int((gameTick - cheat.decayTick) / cheatDecayTicks)
+	if steps == 0 {
+		return
+	}
+	cheat.decayTick += uint64(steps) * cheatDecayTicks
+	cheat.score = max(cheat.score-steps, 0)
+}
+
+// Add suspicion for a player, flag and audit them past AntiCheatFlagScore
+// and kick them past AntiCheatKickScore. Returns false if they were kicked.
+// processLock must be held, and this can't be called while iterating playerList.
+func addCheatScore(player *playerData, amount int, reason, format string, args ...interface{}) bool {
+	cheat := &player.cheat
+	detail := fmt.Sprintf(format, args...)
+
+	decayCheatScore(player)
+	cheat.score += amount
+	cheat.peakScore = max(cheat.peakScore, cheat.score)
+	if cheat.events == nil {
+		cheat.events = map[string]int{}
+	}
+	cheat.events[reason]++
+
+	logDebug(SUB_CHEAT, "%v (%v): %v, %v, score %v", player.name, player.id, reason, detail, cheat.score)
+
+	cfg := config.Load()
+	if !cheat.flagged && cheat.score >= cfg.AntiCheatFlagScore {
+		cheat.flagged = true
+		logWarn(SUB_CHEAT, "Flagged %v (%v) from %v: %v, score %v", player.name, player.id, player.addr, reason, cheat.score)
+		writeAudit(player, "flagged", reason)
+	}
+	if cheat.flagged {
+		writeAudit(player, reason, detail)
+	}
+
+	if cfg.AntiCheatKickScore > 0 && cheat.score >= cfg.AntiCheatKickScore {
+		logWarn(SUB_CHEAT, "Kicked %v (%v) from %v, score %v", player.name, player.id, player.addr, cheat.score)
+		writeAudit(player, "kicked", reason)
+		removePlayer(player, "kicked: anti-cheat")
+		return false
+	}
+	return true
+}
+
+// Count a move against MaxInputsPerTick, false if it should be dropped
+func checkInputRate(player *playerData) bool {
+	cheat := &player.cheat
+	if cheat.inputTick != gameTick {
+		cheat.inputTick = gameTick
+		cheat.tickInputs = 0
+	}
+
+	cheat.tickInputs++
+	if cheat.tickInputs <= config.Load().MaxInputsPerTick {
+		return true
+	}
+	addCheatScore(player, scoreInputFlood, "input flood", "%v moves in one tick", cheat.tickInputs)
+	return false
+}
+
+// Message that a real client would never send
+func badInput(player *playerData, cmd CMD, err error) {
+	logWarn(SUB_NET, "%v from %v: %v", cmdNames[cmd], player.id, err)
+	addCheatScore(player, scoreBadInput, "bad input", "%v: %v", cmdNames[cmd], err)
+}
+
+// Edits must be near the editor, false if out of range
+func checkEditPos(player *playerData, cmd CMD, pos XY) bool {
+	playerPos := floorXY(&player.pos)
+	dx := float64(int64(pos.X) - int64(playerPos.X))
+	dy := float64(int64(pos.Y) - int64(playerPos.Y))
+	dist := math.Hypot(dx, dy)
+
+	if dist <= float64(config.Load().EditRange) {
+		return true
+	}
+	addCheatScore(player, scoreEditRange, "edit range", "%v at %v,%v is %.0f away", cmdNames[cmd], pos.X, pos.Y, dist)
+	return false
+}
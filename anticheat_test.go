@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Fresh config, with the audit log written to a temp dir
+func newCheatTest(t *testing.T) *testWorld {
+	t.Helper()
+	w := newTestWorld(t)
+
+	oldConfig := config.Load()
+	config.Store(defaultConfig())
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	t.Cleanup(func() {
+		config.Store(oldConfig)
+		os.Chdir(wd)
+	})
+	return w
+}
+
+func TestInputRateLimit(t *testing.T) {
+	w := newCheatTest(t)
+	player := w.addPlayer(XYf32{X: 0, Y: 0})
+
+	for i := 0; i < config.Load().MaxInputsPerTick; i++ {
+		if !checkInputRate(player) {
+			t.Fatalf("input %v dropped, limit is %v", i+1, config.Load().MaxInputsPerTick)
+		}
+	}
+	if checkInputRate(player) {
+		t.Errorf("input over the limit accepted")
+	}
+	if player.cheat.score != scoreInputFlood {
+		t.Errorf("score %v, want %v", player.cheat.score, scoreInputFlood)
+	}
+
+	w.step(1)
+	if !checkInputRate(player) {
+		t.Errorf("input dropped on the next tick")
+	}
+}
+
+func TestEditRange(t *testing.T) {
+	w := newCheatTest(t)
+	player := w.addPlayer(XYf32{X: 0, Y: 0})
+	center := floorXY(&player.pos)
+	edge := uint32(config.Load().EditRange)
+
+	tests := []struct {
+		name string
+		pos  XY
+		want bool
+	}{
+		{"on player", center, true},
+		{"at range", XY{X: center.X + edge, Y: center.Y}, true},
+		{"behind at range", XY{X: center.X, Y: center.Y - edge}, true},
+		{"past range", XY{X: center.X + edge, Y: center.Y + 1}, false},
+		{"far behind", XY{X: center.X - edge*10, Y: center.Y}, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := checkEditPos(player, CMD_EditPlaceItem, tc.pos); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+	if player.cheat.events["edit range"] != 2 {
+		t.Errorf("counted %v out of range edits, want 2", player.cheat.events["edit range"])
+	}
+}
+
+func TestCheatScoreDecay(t *testing.T) {
+	w := newCheatTest(t)
+	player := w.addPlayer(XYf32{X: 0, Y: 0})
+
+	addCheatScore(player, 3, "test", "")
+	w.step(cheatDecayTicks*2 + 1)
+	decayCheatScore(player)
+	if player.cheat.score != 1 || player.cheat.peakScore != 3 {
+		t.Errorf("score %v peak %v, want 1 and 3", player.cheat.score, player.cheat.peakScore)
+	}
+
+	w.step(cheatDecayTicks * 10)
+	decayCheatScore(player)
+	if player.cheat.score != 0 {
+		t.Errorf("score %v, want 0", player.cheat.score)
+	}
+}
+
+func TestCheatFlagAndKick(t *testing.T) {
+	w := newCheatTest(t)
+	player := w.addPlayer(XYf32{X: 0, Y: 0})
+	config.Load().AntiCheatFlagScore = 10
+	config.Load().AntiCheatKickScore = 20
+
+	addCheatScore(player, 5, "test", "")
+	if player.cheat.flagged {
+		t.Fatalf("flagged below the threshold")
+	}
+	if _, err := os.Stat(filepath.Join(logDir, auditFile)); err == nil {
+		t.Errorf("audit written before being flagged")
+	}
+
+	addCheatScore(player, 5, "test", "")
+	if !player.cheat.flagged || !player.VALID {
+		t.Fatalf("flagged %v valid %v, want flagged and still online", player.cheat.flagged, player.VALID)
+	}
+
+	if addCheatScore(player, 10, "test", "") || player.VALID {
+		t.Errorf("not kicked at the kick score")
+	}
+
+	data, err := os.ReadFile(filepath.Join(logDir, auditFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//flagged, the event that flagged them, the next event, kicked
+	if lines := bytes.Count(data, []byte("\n")); lines != 4 {
+		t.Errorf("audit has %v lines, want 4:\n%s", lines, data)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const banFile = "bans.json"
+
+type banEntry struct {
+	Name   string `json:",omitempty"`
+	IP     string `json:",omitempty"`
+	Reason string
+	Time   time.Time
+}
+
+var (
+	banList     []*banEntry
+	banListLock sync.Mutex
+)
+
+func isBannedIP(ip string) bool {
+	banListLock.Lock()
+	defer banListLock.Unlock()
+
+	for _, ban := range banList {
+		if ban.IP != "" && ban.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func isBannedName(name string) bool {
+	banListLock.Lock()
+	defer banListLock.Unlock()
+
+	for _, ban := range banList {
+		if ban.Name != "" && nameKey(ban.Name) == nameKey(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ban a name and/or IP, blank values are ignored
+func addBan(name, ip, reason string) {
+	banListLock.Lock()
+	banList = append(banList, &banEntry{Name: name, IP: ip, Reason: reason, Time: time.Now().UTC()})
+	banListLock.Unlock()
+
+	saveBans()
+}
+
+// Remove bans matching a name or IP, returns number removed
+func removeBan(match string) int {
+	banListLock.Lock()
+
+	var bans []*banEntry
+	removed := 0
+	for _, ban := range banList {
+		if (ban.Name != "" && strings.EqualFold(ban.Name, match)) || (ban.IP != "" && ban.IP == match) {
+			removed++
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	banList = bans
+	banListLock.Unlock()
+
+	if removed > 0 {
+		saveBans()
+	}
+	return removed
+}
+
+func getBans() []*banEntry {
+	banListLock.Lock()
+	defer banListLock.Unlock()
+
+	return append([]*banEntry{}, banList...)
+}
+
+func saveBans() {
+	banListLock.Lock()
+	defer banListLock.Unlock()
+
+	outbuf := new(bytes.Buffer)
+	enc := json.NewEncoder(outbuf)
+	enc.SetIndent("", "\t")
+
+	err := enc.Encode(banList)
+	if err != nil {
+		logError(SUB_ADMIN, "saveBans: enc.Encode %v", err.Error())
+		return
+	}
+
+	os.MkdirAll(dataDir, 0755)
+	err = os.WriteFile(fmt.Sprintf("%v/%v", dataDir, banFile), outbuf.Bytes(), 0644)
+	if err != nil {
+		logError(SUB_ADMIN, "saveBans: WriteFile %v", err.Error())
+	}
+}
+
+func loadBans() {
+	filePath := fmt.Sprintf("%v/%v", dataDir, banFile)
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return
+	}
+
+	var bans []*banEntry
+	decoder := json.NewDecoder(bytes.NewBuffer(data))
+	err = decoder.Decode(&bans)
+	if err != nil {
+		logError(SUB_ADMIN, "Unable to decode json: %v", filePath)
+		return
+	}
+
+	banListLock.Lock()
+	banList = bans
+	banListLock.Unlock()
+
+	logInfo(SUB_ADMIN, "Loaded %v bans.", len(bans))
+}
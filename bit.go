@@ -1,7 +1,5 @@
 package main
 
-import "io"
-
 func setEffect(player *playerData, flag EFF) {
 	player.effects = (player.effects | flag)
 }
@@ -17,58 +15,3 @@ func hasEffects(player *playerData, flag EFF) bool {
 func hasAnyEffects(player *playerData, flag EFF) bool {
 	return player.effects&flag != 0
 }
-
-type BitReader struct {
-	reader io.ByteReader
-	byte   byte
-	offset byte
-}
-
-func New(r io.ByteReader) *BitReader {
-	return &BitReader{r, 0, 0}
-}
-
-func (r *BitReader) ReadBit() (bool, error) {
-	if r.offset == 8 {
-		r.offset = 0
-	}
-	if r.offset == 0 {
-		var err error
-		if r.byte, err = r.reader.ReadByte(); err != nil {
-			return false, err
-		}
-	}
-	bit := (r.byte & (0x80 >> r.offset)) != 0
-	r.offset++
-	return bit, nil
-}
-
-func (r *BitReader) ReadInt(nbits int) (int, error) {
-	var result int
-	for i := nbits - 1; i >= 0; i-- {
-		bit, err := r.ReadBit()
-		if err != nil {
-			return 0, err
-		}
-		if bit {
-			result |= 1 << uint(i)
-		}
-	}
-	tmp := int(result)
-	return tmp, nil
-}
-
-func (r *BitReader) ReadBits(nbits int) (byte, error) {
-	var result int
-	for i := nbits - 1; i >= 0; i-- {
-		bit, err := r.ReadBit()
-		if err != nil {
-			return 0, err
-		}
-		if bit {
-			result |= 1 << uint(i)
-		}
-	}
-	tmp := byte(result)
-	return tmp, nil
-}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const certPollSeconds = 5
+
+// Serves the current certificate, swapping in renewals without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	cert     *tls.Certificate
+	certStat string //Size and mod time of the files last loaded, a failed pair is tried again
+	lock     sync.RWMutex
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	err := reloader.reload()
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (c *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.cert, nil
+}
+
+// Size and mod time of both files, changes if either is rewritten
+func (c *certReloader) statFiles() (string, error) {
+	certStat, err := os.Stat(c.certFile)
+	if err != nil {
+		return "", err
+	}
+	keyStat, err := os.Stat(c.keyFile)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v:%v:%v:%v", certStat.Size(), certStat.ModTime().UnixNano(),
+		keyStat.Size(), keyStat.ModTime().UnixNano()), nil
+}
+
+// Load and validate the files, the old certificate is kept on failure
+func (c *certReloader) reload() error {
+	stat, err := c.statFiles()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate not valid until %v", leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired %v", leaf.NotAfter)
+	}
+	cert.Leaf = leaf
+
+	c.lock.Lock()
+	c.cert = &cert
+	c.lock.Unlock()
+	c.certStat = stat
+
+	logInfo(SUB_NET, "Loaded certificate for %v, expires %v", leaf.DNSNames, leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// Poll the files and reload them when they change
+func (c *certReloader) watch() {
+	go func() {
+		defer reportPanic("certReloader")
+
+		for {
+			time.Sleep(time.Second * certPollSeconds)
+
+			stat, err := c.statFiles()
+			if err != nil || stat == c.certStat {
+				continue
+			}
+
+			//Renewals write both files, give them a moment to finish
+			time.Sleep(time.Second)
+
+			err = c.reload()
+			if err != nil {
+				logError(SUB_NET, "Certificate reload failed, keeping the old one: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write a self-signed pair valid from notBefore for a day
+func writeTestCert(t *testing.T, certFile, keyFile string, notBefore time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test"},
+		DNSNames: []string{"test"}, NotBefore: notBefore, NotAfter: notBefore.Add(24 * time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+// A pair that fails to load is tried again, the old certificate stays meanwhile
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, time.Now().Add(-time.Hour))
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := reloader.cert
+
+	//Not valid yet, so the failed files are still seen as changed
+	writeTestCert(t, certFile, keyFile, time.Now().Add(time.Hour))
+	if err := reloader.reload(); err == nil {
+		t.Fatalf("certificate from the future loaded")
+	}
+	if stat, _ := reloader.statFiles(); stat == reloader.certStat || reloader.cert != first {
+		t.Errorf("failed reload recorded or swapped")
+	}
+
+	writeTestCert(t, certFile, keyFile, time.Now().Add(-time.Hour))
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := reloader.statFiles(); stat != reloader.certStat || reloader.cert == first {
+		t.Errorf("reload not recorded or not swapped")
+	}
+}
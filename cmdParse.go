@@ -1,17 +1,15 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
+	"image"
 	"math/rand"
-	"strings"
 
-	"github.com/gorilla/websocket"
+	"goMMOServ/protocol"
 )
 
 func newParser(input []byte, player *playerData) {
-	defer reportPanic("newParser")
+	defer recoverEntity(player, "newParser")
 
 	processLock.Lock()
 	defer processLock.Unlock()
@@ -24,16 +22,22 @@ func newParser(input []byte, player *playerData) {
 
 	d := CMD(input[0])
 	data := input[1:]
+	countIn(d, inputLen)
 
-	if d != CMD_Move {
+	if d != CMD_Move && logEnabled(LOG_DEBUG, SUB_NET) {
 		cmdName := cmdNames[d]
-		doLog(true, "ID: %v, Received: %v, Data: %v", player.id, cmdName, string(data))
+		str := string(data)
+		if d == CMD_Command {
+			str = commandLogLine(str)
+		}
+		logDebug(SUB_NET, "ID: %v, Received: %v, Data: %v", player.id, cmdName, str)
 	}
 
 	switch d {
 	case CMD_Init:
 		cmd_init(player, data)
-		sendPlayernames(player, false)
+	case CMD_Resume:
+		cmd_resume(player, data)
 	case CMD_Move:
 		cmd_move(player, data)
 	case CMD_Chat:
@@ -46,8 +50,14 @@ func newParser(input []byte, player *playerData) {
 		cmd_editPlaceItem(player, data)
 	case CMD_EditDeleteItem:
 		cmd_editDeleteItem(player, data)
+	case CMD_EditSetZone:
+		cmd_editSetZone(player, data)
+	case CMD_EditDeleteZone:
+		cmd_editDeleteZone(player, data)
+	case CMD_Pong:
+		cmd_pong(player, data)
 	default:
-		doLog(true, "Received invalid command: 0x%02X, %vb", d, len(data))
+		logWarn(SUB_NET, "Received invalid command: 0x%02X, %vb", d, len(data))
 		removePlayer(player, "INVALID COMMAND")
 
 		return
@@ -57,34 +67,44 @@ func newParser(input []byte, player *playerData) {
 func cmd_playermode(player *playerData, data []byte) {
 	defer reportPanic("cmd_playermode")
 
-	inbuf := bytes.NewBuffer(data)
-	for _, t := range player.targets {
-		removeTarget(player, t.target)
+	msg, err := protocol.DecodePlayerMode(data)
+	if err != nil {
+		badInput(player, CMD_PlayerMode, err)
+		return
+	}
+	if PMode(msg.Mode) > PMODE_HEAL {
+		badInput(player, CMD_PlayerMode, fmt.Errorf("invalid mode %v", msg.Mode))
+		return
 	}
 
-	binary.Read(inbuf, binary.LittleEndian, &player.mode)
+	for player.numTargets > 0 {
+		removeTarget(player, player.targets[0].target)
+	}
+	player.mode = PMode(msg.Mode)
 }
 
 func cmd_editDeleteItem(player *playerData, data []byte) {
-	defer reportPanic("cmd_editPlaceItem")
-
-	inbuf := bytes.NewBuffer(data)
+	defer reportPanic("cmd_editDeleteItem")
 
-	var sectionID, itemID, spriteID uint8
-	var editPosX, editPosY uint32
+	if player == nil || player.area == nil {
+		return
+	}
 
-	binary.Read(inbuf, binary.LittleEndian, &sectionID)
-	binary.Read(inbuf, binary.LittleEndian, &itemID)
-	binary.Read(inbuf, binary.LittleEndian, &spriteID)
-	binary.Read(inbuf, binary.LittleEndian, &editPosX)
-	binary.Read(inbuf, binary.LittleEndian, &editPosY)
+	msg, err := protocol.DecodeEditItem(data)
+	if err != nil {
+		badInput(player, CMD_EditDeleteItem, err)
+		return
+	}
 
-	pos := XY{X: editPosX, Y: editPosY}
+	pos := XY{X: msg.X, Y: msg.Y}
+	if !checkEditPos(player, CMD_EditDeleteItem, pos) {
+		return
+	}
 
-	doLog(true, "%v:%v:%v %v,%v", sectionID, itemID, spriteID, editPosX, editPosY)
+	logDebug(SUB_WORLD, "%v:%v:%v %v,%v", msg.Section, msg.Num, msg.Sprite, msg.X, msg.Y)
 
-	removeWorldObject(areaList[0], pos, IID{Section: sectionID, Num: itemID, Sprite: spriteID})
-	areaList[0].dirty = true
+	removeWorldObject(player.area, pos, IID{Section: msg.Section, Num: msg.Num, Sprite: msg.Sprite})
+	player.area.dirty = true
 }
 
 func cmd_editPlaceItem(player *playerData, data []byte) {
@@ -94,163 +114,180 @@ func cmd_editPlaceItem(player *playerData, data []byte) {
 		return
 	}
 
-	inbuf := bytes.NewBuffer(data)
-
-	var editSectionID, editItemID, editSpriteID uint8
-	var editPosX, editPosY uint32
+	msg, err := protocol.DecodeEditItem(data)
+	if err != nil {
+		badInput(player, CMD_EditPlaceItem, err)
+		return
+	}
 
-	binary.Read(inbuf, binary.LittleEndian, &editSectionID)
-	binary.Read(inbuf, binary.LittleEndian, &editItemID)
-	binary.Read(inbuf, binary.LittleEndian, &editSpriteID)
-	binary.Read(inbuf, binary.LittleEndian, &editPosX)
-	binary.Read(inbuf, binary.LittleEndian, &editPosY)
+	pos := XY{X: msg.X, Y: msg.Y}
+	if !checkEditPos(player, CMD_EditPlaceItem, pos) {
+		return
+	}
 
-	pos := XY{X: editPosX, Y: editPosY}
-	newObj := &worldObject{ID: IID{Section: editSectionID, Num: editItemID, Sprite: editSpriteID}, Pos: pos}
-	doLog(true, "%v:%v:%v %v,%v", editSectionID, editItemID, editSectionID, editPosX, editPosY)
+	newObj := &worldObject{ID: IID{Section: msg.Section, Num: msg.Num, Sprite: msg.Sprite}, Pos: pos}
+	logDebug(SUB_WORLD, "%v:%v:%v %v,%v", msg.Section, msg.Num, msg.Sprite, msg.X, msg.Y)
 	addWorldObject(player.area, pos, newObj)
 	player.area.dirty = true
 }
 
-func sendPlayernames(player *playerData, setName bool) {
-	defer reportPanic("sendPlayernames")
+func cmd_editSetZone(player *playerData, data []byte) {
+	defer reportPanic("cmd_editSetZone")
+
+	if player == nil || player.area == nil {
+		return
+	}
+
+	msg, err := protocol.DecodeEditSetZone(data)
+	if err != nil {
+		badInput(player, CMD_EditSetZone, err)
+		return
+	}
 
-	var buf []byte
-	outbuf := bytes.NewBuffer(buf)
+	mode := ZONE(msg.Mode)
+	if zoneNames[mode] == "" {
+		badInput(player, CMD_EditSetZone, fmt.Errorf("invalid zone mode %v", mode))
+		return
+	}
 
-	var numNames uint32
+	//Both corners near the editor, so large zones are drawn in pieces
+	rect := image.Rect(int(msg.MinX), int(msg.MinY), int(msg.MaxX), int(msg.MaxY))
+	if !checkEditPos(player, CMD_EditSetZone, XY{X: uint32(rect.Min.X), Y: uint32(rect.Min.Y)}) ||
+		!checkEditPos(player, CMD_EditSetZone, XY{X: uint32(rect.Max.X), Y: uint32(rect.Max.Y)}) {
+		return
+	}
+
+	logDebug(SUB_WORLD, "%v: %v,%v - %v,%v", zoneNames[mode], msg.MinX, msg.MinY, msg.MaxX, msg.MaxY)
+	addZone(player.area, mode, rect)
+}
+
+func cmd_editDeleteZone(player *playerData, data []byte) {
+	defer reportPanic("cmd_editDeleteZone")
+
+	if player == nil || player.area == nil {
+		return
+	}
+
+	msg, err := protocol.DecodeEditDeleteZone(data)
+	if err != nil {
+		badInput(player, CMD_EditDeleteZone, err)
+		return
+	}
+
+	pos := XY{X: msg.X, Y: msg.Y}
+	if !checkEditPos(player, CMD_EditDeleteZone, pos) {
+		return
+	}
+
+	logDebug(SUB_WORLD, "%v,%v", msg.X, msg.Y)
+	removeZones(player.area, pos)
+}
+
+func sendPlayernames(player *playerData, setName bool) {
+	defer reportPanic("sendPlayernames")
 
 	//Send to all if a player changed their name,
 	//otherwise send whole list to specific player
 	if setName {
-		numNames = 1
-		binary.Write(outbuf, binary.LittleEndian, &numNames)
-		binary.Write(outbuf, binary.LittleEndian, &player.id)
-
-		var nameLen uint16 = uint16(len(player.name))
-		binary.Write(outbuf, binary.LittleEndian, &nameLen)
+		msg := &protocol.PlayerNames{Names: []protocol.PlayerName{
+			{ID: player.id, Name: player.name, Level: player.level}}}
 
-		for x := 0; x < int(nameLen); x++ {
-			var playerRune = rune(player.name[x])
-			binary.Write(outbuf, binary.LittleEndian, &playerRune)
-		}
-
-		compBuf := CompressZip(outbuf.Bytes())
+		//Encoded once for each layout in use
+		compBufs := map[uint16][]byte{}
 		for _, target := range playerList {
-			writeToPlayer(target, CMD_PlayerNamesComp, compBuf)
+			version := namesVersion(target)
+			if compBufs[version] == nil {
+				compBufs[version] = msg.EncodeComp(version)
+			}
+			writeToPlayer(target, CMD_PlayerNamesComp, compBufs[version])
 		}
 	} else {
-		//Count number of players that have names
-		for _, player := range playerList {
-			if player.name == "" {
+		msg := &protocol.PlayerNames{}
+		for _, target := range playerList {
+			if target.name == "" {
 				continue
 			}
-			numNames++
+			msg.Names = append(msg.Names, protocol.PlayerName{ID: target.id, Name: target.name, Level: target.level})
 		}
 
 		//Nothing to send, exit
-		if numNames == 0 {
+		if len(msg.Names) == 0 {
 			return
 		}
 
-		//Write out header
-		binary.Write(outbuf, binary.LittleEndian, &numNames)
-
-		//Serialize player names
-		for _, target := range playerList {
-			if target.name == "" {
-				continue
-			}
-			binary.Write(outbuf, binary.LittleEndian, &target.id)
-
-			var nameLen uint16 = uint16(len(target.name))
-			binary.Write(outbuf, binary.LittleEndian, &nameLen)
-
-			for x := 0; x < int(nameLen); x++ {
-				var playerRune = rune(target.name[x])
-				binary.Write(outbuf, binary.LittleEndian, &playerRune)
-			}
-		}
-
-		writeToPlayer(player, CMD_PlayerNamesComp, CompressZip(outbuf.Bytes()))
+		writeToPlayer(player, CMD_PlayerNamesComp, msg.EncodeComp(namesVersion(player)))
 	}
 }
 
+// Only the name layout changes, older clients get a rune per int32
+func namesVersion(player *playerData) uint16 {
+	return min(player.protoVersion, protocol.VersionNames)
+}
+
 func cmd_command(player *playerData, data []byte) {
 	defer reportPanic("CMD_Command")
 
-	//Make a string out of the data
-	str := string(data)
+	ctx := &cmdContext{player: player, reply: func(str string) {
+		writeToPlayer(player, CMD_Command, []byte(str))
+	}}
+	runCommand(ctx, string(data))
+}
+
+func cmd_init(player *playerData, data []byte) {
+	defer reportPanic("cmd_init")
 
-	//Check if command has prefix
-	if !strings.HasPrefix(str, "/") {
-		writeToPlayer(player, CMD_Command, []byte("Commmands must begin with: /  (try /help)"))
+	//Already in the game
+	if player.protoVersion != 0 {
 		return
 	}
 
-	//Split into args
-	words := strings.Split(str, " ")
-	numWords := len(words)
-
-	//Check if enough args
-	if numWords < 2 {
-		writeToPlayer(player, CMD_Command, []byte("Commands:"))
-		writeToPlayer(player, CMD_Command, []byte("/name NewName"))
+	msg, err := protocol.DecodeInit(data)
+	if err != nil {
+		logInfo(SUB_NET, "Invalid handshake: %v", err)
+		refuseClient(player, msg.Legacy, &protocol.InitReply{Result: protocol.INIT_REFUSED, Reason: "Invalid handshake."})
 		return
 	}
 
-	//Join args, for some command types
-	allParams := strings.Join(words[1:], " ")
-	allParamLen := len(allParams)
-
-	//Remove command prefix
-	command := strings.TrimPrefix(words[0], "/")
-
-	//Commands
-	if strings.EqualFold(command, "name") {
-		if allParamLen < 3 {
-			writeToPlayer(player, CMD_Command, []byte("Name not long enough."))
-			return
-		} else if allParamLen > 32 {
-			writeToPlayer(player, CMD_Command, []byte("Name too long."))
-			return
-		}
-		player.name = allParams
-		writeToPlayer(player, CMD_Command, []byte("Name set."))
-		sendPlayernames(player, true)
+	if handshake(player, msg) {
+		joinWorld(player)
+		sendPlayernames(player, false)
 	}
 }
 
-func cmd_init(player *playerData, data []byte) {
-	defer reportPanic("cmd_init")
-
-	inbuf := bytes.NewBuffer(data)
-	var version uint16
-
+// Agree on a version and features, false if the client was refused
+func handshake(player *playerData, msg protocol.Init) bool {
 	//Check proto version
-	binary.Read(inbuf, binary.LittleEndian, &version)
-	if version != protoVersion {
-		doLog(true, "Invalid proto version: %v", version)
-		writeToPlayer(player, CMD_Init, []byte{})
-		removePlayer(player, "invalid version")
-		return
+	reply := protocol.Negotiate(msg, minClientVersion(), protocol.Version, serverCaps)
+	if reply.Result != protocol.INIT_OK {
+		logInfo(SUB_NET, "Refused client version %v-%v: %v", msg.MinVersion, msg.Version, reply.Reason)
+		refuseClient(player, msg.Legacy, &reply)
+		return false
+	}
+	player.protoVersion = reply.Version
+	player.caps = reply.Caps
+	if !msg.Legacy {
+		writeToPlayer(player, CMD_Init, reply.Encode())
 	}
+	setupCompression(player)
+	logDebug(SUB_NET, "ID: %v, protocol v%v, caps: %v", player.id, reply.Version, reply.Caps)
+	return true
+}
+
+// Spawn a new character once the handshake is done
+func joinWorld(player *playerData) {
 	addPlayerToWorld(player.area, player.pos, player)
 
 	for !movePlayer(player, false) {
 		tryPos := XYf32{X: float32(halfArea - rand.Intn(spawnArea)),
 			Y: float32(halfArea - rand.Intn(spawnArea))}
 		movePlayerChunk(player.area, tryPos, player)
-		fmt.Println("Spawn blocked... Trying again.")
+		logDebug(SUB_WORLD, "Spawn blocked... Trying again.")
 	}
 
-	var buf []byte
-	outbuf := bytes.NewBuffer(buf)
-
 	//Send player id
-	binary.Write(outbuf, binary.LittleEndian, &player.id)
-	binary.Write(outbuf, binary.LittleEndian, &player.area.ID)
-	writeToPlayer(player, CMD_Login, outbuf.Bytes())
+	login := &protocol.Login{ID: player.id, Area: player.area.ID}
+	writeToPlayer(player, CMD_Login, login.Encode())
+	issueSession(player)
 
 	//Notify players we joined
 	welcomeStr := fmt.Sprintf("%v joined the game.", player.name)
@@ -258,6 +295,25 @@ func cmd_init(player *playerData, data []byte) {
 
 }
 
+// Tell a client why it can't play, then disconnect it
+func refuseClient(player *playerData, legacy bool, reply *protocol.InitReply) {
+	if legacy {
+		writeToPlayer(player, CMD_Init, []byte{})
+	} else {
+		writeToPlayer(player, CMD_Init, reply.Encode())
+	}
+	sendClose(player, closePolicyViolation, reply.Reason)
+	removePlayer(player, "invalid version")
+}
+
+// Oldest client version we accept, config can raise it
+func minClientVersion() uint16 {
+	if oldest := config.Load().MinClientVersion; oldest > protocol.MinVersion {
+		return oldest
+	}
+	return protocol.MinVersion
+}
+
 const maxChat = 256
 
 func cmd_chat(player *playerData, data []byte) {
@@ -266,13 +322,22 @@ func cmd_chat(player *playerData, data []byte) {
 		return
 	}
 
-	pName := fmt.Sprintf("%v says: %v", player.name, string(data))
+	sendChatFrom(playerList, player, protocol.CHAT_SAY, string(data), fmt.Sprintf("%v says: %v", player.name, string(data)))
+}
 
-	for _, target := range playerList {
+// Player chat, tagged with who said it. Older clients get plain text.
+func sendChatFrom(targets []*playerData, player *playerData, channel protocol.CHAT, text, plain string) {
+	tagged := (&protocol.ChatFrom{ID: player.id, Channel: channel, Text: text}).Encode()
+
+	for _, target := range targets {
 		if target.conn == nil {
 			continue
 		}
-		writeToPlayer(target, CMD_Chat, []byte(pName))
+		if target.protoVersion >= protocol.VersionChatFrom {
+			writeToPlayer(target, CMD_ChatFrom, tagged)
+		} else {
+			writeToPlayer(target, CMD_Chat, []byte(plain))
+		}
 	}
 }
 
@@ -294,16 +359,29 @@ func cmd_move(player *playerData, data []byte) {
 		return
 	}
 
-	inbuf := bytes.NewBuffer(data)
+	//Not in the game yet
+	if player.protoVersion == 0 {
+		return
+	}
 
 	//Read direction
-	binary.Read(inbuf, binary.LittleEndian, &player.moveDir)
-	if player.moveDir != DIR_NONE {
-		player.dir = player.moveDir
+	msg, err := protocol.DecodeMove(data, player.protoVersion)
+	if err != nil {
+		badInput(player, CMD_Move, err)
+		return
 	}
-	player.lastDirUpdate = gameTick
+	if DIR(msg.Dir) > DIR_NONE {
+		badInput(player, CMD_Move, fmt.Errorf("invalid direction %v", msg.Dir))
+		return
+	}
+	if !checkInputRate(player) {
+		return
+	}
+	queueInput(player, msg.Seq, DIR(msg.Dir))
 }
 
+// Send a message, a player that can't be written to is disconnected.
+// processLock must be held, the serialize goroutines use sendToPlayer.
 func writeToPlayer(player *playerData, header CMD, input []byte) bool {
 	//defer reportPanic("writeToPlayer") (EOF causes panic)
 
@@ -312,24 +390,29 @@ func writeToPlayer(player *playerData, header CMD, input []byte) bool {
 		return false
 	}
 
-	//Log event if not update
-	if header != CMD_WorldUpdate {
-		cmdName := cmdNames[header]
-		doLog(true, "ID: %v, Sent: %v, Data: %vb", player.id, cmdName, len(input))
+	if err := sendToPlayer(player, header, input); err != nil {
+		logInfo(SUB_NET, "Error writing response: %v", err)
+		disconnectPlayer(player, "connection lost")
+
+		return false
 	}
+	return true
+}
 
-	var err error
-	if input == nil {
-		err = player.conn.WriteMessage(websocket.BinaryMessage, []byte{byte(header)})
-	} else {
-		err = player.conn.WriteMessage(websocket.BinaryMessage, append([]byte{byte(header)}, input...))
+// Send a message and leave errors to the caller. Touches nothing but this
+// player's connection, so it is safe from the serialize goroutines.
+func sendToPlayer(player *playerData, header CMD, input []byte) error {
+	//Log event if not update
+	if header != CMD_WorldUpdate && logEnabled(LOG_DEBUG, SUB_NET) {
+		cmdName := cmdNames[header]
+		logDebug(SUB_NET, "ID: %v, Sent: %v, Data: %vb", player.id, cmdName, len(input))
 	}
 
-	if err != nil {
-		doLog(true, "Error writing response: %v", err)
-		removePlayer(player, "connection lost")
+	header, input, deflate := compressMessage(player, header, input)
+	countOut(header, len(input)+1)
 
-		return false
+	if deflate {
+		return player.conn.(deflater).SendDeflate(append([]byte{byte(header)}, input...))
 	}
-	return true
+	return player.conn.Send(append([]byte{byte(header)}, input...))
 }
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"goMMOServ/protocol"
+)
+
+// Who ran a command and where replies go
+type cmdContext struct {
+	player *playerData //nil for the console
+	admin  bool
+	reply  func(string)
+}
+
+func (ctx *cmdContext) replyf(format string, args ...interface{}) {
+	ctx.reply(fmt.Sprintf(format, args...))
+}
+
+type commandData struct {
+	name       string
+	args       string
+	help       string
+	admin      bool //Console and admin API only
+	needPlayer bool //Only makes sense in game
+	secret     bool //Has a password, arguments are kept out of logs
+
+	//params is everything after the command, args is params split on spaces
+	handler func(ctx *cmdContext, params string, args []string)
+}
+
+var (
+	commandList []*commandData
+	commandMap  map[string]*commandData
+)
+
+func init() {
+	commandList = []*commandData{
+		{name: "help", help: "list commands", handler: cmdHelp},
+		{name: "name", args: "NewName", help: "set your display name", needPlayer: true, handler: cmdName},
+		{name: "account", args: "AccountName Password", help: "play a saved character, or start one", needPlayer: true, secret: true, handler: cmdAccount},
+		{name: "password", args: "OldPassword NewPassword", help: "change your password", needPlayer: true, secret: true, handler: cmdPassword},
+		{name: "bind", help: "set respawn point (near one)", needPlayer: true, handler: cmdBind},
+		{name: "respawn", help: "give up while injured", needPlayer: true, handler: cmdRespawn},
+		{name: "pvp", args: "on|off", help: "PvP flag", needPlayer: true, handler: cmdPvP},
+		{name: "duel", args: "PlayerName|accept|decline", help: "duel a player", needPlayer: true, handler: cmdDuel},
+		{name: "party", args: "invite|kick PlayerName, accept|decline|leave", help: "party", needPlayer: true, handler: cmdParty},
+		{name: "p", args: "message", help: "party chat", needPlayer: true, handler: cmdPartyChat},
+		{name: "who", help: "list online players", handler: cmdWho},
+
+		{name: "save", help: "save the world now", admin: true, handler: cmdSave},
+		{name: "kick", args: "PlayerName [reason]", help: "kick a player", admin: true, handler: cmdKick},
+		{name: "say", args: "message", help: "server announcement", admin: true, handler: cmdSay},
+		{name: "stats", help: "server stats", admin: true, handler: cmdStats},
+		{name: "names", args: "PlayerName", help: "account and name history", admin: true, handler: cmdNameHistory},
+		{name: "setpassword", args: "AccountName Password", help: "set the password of an offline save", admin: true, secret: true, handler: cmdSetPassword},
+		{name: "suspects", help: "players with an anti-cheat score", admin: true, handler: cmdSuspects},
+		{name: "reload", help: "reload config", admin: true, handler: cmdReload},
+		{name: "compression", args: "[train]", help: "compression savings, or train a new dictionary", admin: true, handler: cmdCompression},
+		{name: "loglevel", args: "[subsystem|all] [level], reset", help: "show or set log filters, kept across reloads until reset", admin: true, handler: cmdLogLevel},
+		{name: "shutdown", args: "[seconds|cancel] [reason]", help: "save and stop the server", admin: true, handler: cmdShutdown},
+	}
+
+	commandMap = make(map[string]*commandData)
+	for _, cmd := range commandList {
+		commandMap[cmd.name] = cmd
+	}
+}
+
+// Parse and run a slash command, processLock must be held
+func runCommand(ctx *cmdContext, str string) {
+	defer reportPanic("runCommand")
+
+	str = strings.TrimSpace(str)
+
+	//Check if command has prefix
+	if !strings.HasPrefix(str, "/") {
+		ctx.reply("Commmands must begin with: /  (try /help)")
+		return
+	}
+
+	//Split into args
+	words := strings.Split(str, " ")
+	params := strings.Join(words[1:], " ")
+	command := strings.ToLower(strings.TrimPrefix(words[0], "/"))
+	if command == "" {
+		command = "help"
+	}
+
+	cmd := commandMap[command]
+	if cmd == nil || (cmd.admin && !ctx.admin) {
+		ctx.reply("Unknown command (try /help)")
+		return
+	}
+	if cmd.needPlayer && ctx.player == nil {
+		ctx.reply("That command only works in game.")
+		return
+	}
+
+	cmd.handler(ctx, params, words[1:])
+}
+
+// A command line as it can be logged, without the arguments of secret commands
+func commandLogLine(str string) string {
+	words := strings.Fields(str)
+	if len(words) == 0 {
+		return str
+	}
+	if cmd := commandMap[strings.ToLower(strings.TrimPrefix(words[0], "/"))]; cmd != nil && cmd.secret {
+		return words[0] + " ..."
+	}
+	return str
+}
+
+func cmdHelp(ctx *cmdContext, params string, args []string) {
+	ctx.reply("Commands:")
+	for _, cmd := range commandList {
+		if (cmd.admin && !ctx.admin) || (cmd.needPlayer && ctx.player == nil) {
+			continue
+		}
+		if cmd.args != "" {
+			ctx.replyf("/%v %v (%v)", cmd.name, cmd.args, cmd.help)
+		} else {
+			ctx.replyf("/%v (%v)", cmd.name, cmd.help)
+		}
+	}
+}
+
+// Change display name, guests too. The cooldown and name checks are the same
+// with or without an account.
+func cmdName(ctx *cmdContext, params string, args []string) {
+	player := ctx.player
+	name := strings.TrimSpace(params)
+
+	if name == player.name {
+		ctx.reply("That is already your name.")
+		return
+	}
+	if wait := renameWait(player); wait > 0 {
+		ctx.replyf("You can change your name again in %v.", wait.Round(time.Second))
+		return
+	}
+	if err := checkNameAvailable(player, name); err != nil {
+		ctx.reply(err.Error())
+		return
+	}
+
+	renamePlayer(player, name)
+	if player.account != "" {
+		ctx.replyf("Name changed, your account is still %v.", player.account)
+	} else {
+		ctx.reply("Name changed.")
+	}
+}
+
+func cmdAccount(ctx *cmdContext, params string, args []string) {
+	if ctx.player.account != "" {
+		ctx.replyf("You are playing as %v, accounts can't be changed.", ctx.player.account)
+		return
+	}
+	account, password := splitPassword(params)
+	if account == "" || password == "" {
+		ctx.reply("Usage: /account AccountName Password")
+		return
+	}
+	claimAccount(ctx, account, password)
+}
+
+// The password is the last word, account names can have spaces
+func splitPassword(params string) (string, string) {
+	params = strings.TrimSpace(params)
+	i := strings.LastIndex(params, " ")
+	if i < 0 {
+		return params, ""
+	}
+	return strings.TrimSpace(params[:i]), params[i+1:]
+}
+
+// Pick up a save with its password, or start a new one with the current progress
+func claimAccount(ctx *cmdContext, account, password string) {
+	player := ctx.player
+	addr := player.addr
+
+	if wait := loginWait(addr, account); wait > 0 {
+		ctx.replyf("Too many wrong passwords, try again in %v.", wait.Round(time.Second))
+		return
+	}
+
+	//Names of saved players are only theirs, with the password
+	if owner := savedNameFor(account); owner != "" {
+		if accountOnline(owner) {
+			ctx.reply("That account is in use.")
+			return
+		}
+		var sdat *playerSave
+		started := passwordWork(player, func() (err error) {
+			sdat, err = openPlayerSave(owner, password)
+			return err
+		}, func(err error) {
+			if err != nil {
+				if err == errWrongPassword && !badPassword(player, addr, owner) {
+					return
+				}
+				ctx.reply(err.Error())
+				return
+			}
+			//Someone else could have logged in while we checked
+			if accountOnline(owner) {
+				ctx.reply("That account is in use.")
+				return
+			}
+			clearLoginFails(owner)
+			applyPlayerSave(player, sdat)
+			ctx.replyf("Welcome back %v, level %v.", player.name, player.level)
+			savePlayer(player)
+			sendPlayernames(player, true)
+		})
+		if !started {
+			ctx.reply("Still checking your last password.")
+		}
+		return
+	}
+
+	if err := checkNameAvailable(player, account); err != nil {
+		ctx.reply(err.Error())
+		return
+	}
+	if err := validPassword(password); err != nil {
+		ctx.reply(err.Error())
+		return
+	}
+	//A save that lost its name to a lookalike at startup is still kept
+	if _, ok := readPlayerSave(account); ok {
+		ctx.reply("That name is taken.")
+		return
+	}
+	var hash []byte
+	started := passwordWork(player, func() (err error) {
+		hash, err = hashPassword(password)
+		return err
+	}, func(err error) {
+		if err != nil {
+			ctx.reply(err.Error())
+			return
+		}
+		//The name could have gone while we hashed
+		if savedNameFor(account) != "" || checkNameAvailable(player, account) != nil {
+			ctx.reply("That name is taken.")
+			return
+		}
+		player.account = account
+		player.name = account
+		player.passHash = hash
+		ctx.reply("Account made, use the same password to play it again.")
+		savePlayer(player)
+		sendPlayernames(player, true)
+	})
+	if !started {
+		ctx.reply("Still checking your last password.")
+	}
+}
+
+// Is anyone playing on this account
+func accountOnline(account string) bool {
+	for _, player := range playerList {
+		if player.account != "" && nameKey(player.account) == nameKey(account) {
+			return true
+		}
+	}
+	return false
+}
+
+// Count a wrong password, false if the player was kicked for it
+func badPassword(player *playerData, addr, account string) bool {
+	addLoginFail(addr, account)
+	logWarn(SUB_SAVE, "Failed login to %v from %v", account, addr)
+	return addCheatScore(player, scoreBadPassword, "bad password", "account %v", account)
+}
+
+func cmdPassword(ctx *cmdContext, params string, args []string) {
+	player := ctx.player
+	if player.account == "" {
+		ctx.reply("Pick an account first: /account AccountName Password")
+		return
+	}
+	if len(args) != 2 {
+		ctx.reply("Usage: /password OldPassword NewPassword")
+		return
+	}
+	if err := validPassword(args[1]); err != nil {
+		ctx.reply(err.Error())
+		return
+	}
+	addr, account, oldHash := player.addr, player.account, player.passHash
+	if wait := loginWait(addr, account); wait > 0 {
+		ctx.replyf("Too many wrong passwords, try again in %v.", wait.Round(time.Second))
+		return
+	}
+
+	var hash []byte
+	started := passwordWork(player, func() (err error) {
+		if err := checkPassword(oldHash, args[0]); err != nil {
+			return err
+		}
+		hash, err = hashPassword(args[1])
+		return err
+	}, func(err error) {
+		if err != nil {
+			if err == errWrongPassword && !badPassword(player, addr, account) {
+				return
+			}
+			ctx.reply(err.Error())
+			return
+		}
+		player.passHash = hash
+		savePlayer(player)
+		ctx.reply("Password changed.")
+	})
+	if !started {
+		ctx.reply("Still checking your last password.")
+	}
+}
+
+// For saves from before passwords, or a forgotten one
+func cmdSetPassword(ctx *cmdContext, params string, args []string) {
+	account, password := splitPassword(params)
+	if account == "" || password == "" {
+		ctx.reply("Usage: /setpassword AccountName Password")
+		return
+	}
+	if accountOnline(account) {
+		ctx.replyf("%v is online, they can use /password.", account)
+		return
+	}
+	if err := resetPassword(account, password); err != nil {
+		ctx.reply(err.Error())
+		return
+	}
+	logInfo(SUB_ADMIN, "Password set for %v", account)
+	ctx.reply("Password set.")
+}
+
+// Who has a name now and who had it, for impersonation reports
+func cmdNameHistory(ctx *cmdContext, params string, args []string) {
+	name := strings.TrimSpace(params)
+	if name == "" {
+		ctx.reply("Usage: /names PlayerName")
+		return
+	}
+
+	if player := findPlayerByName(name); player != nil {
+		ctx.replyf("Online: %v (id %v), account %v", player.name, player.id, player.account)
+	} else if account := savedNameFor(name); account != "" {
+		if sdat, ok := readPlayerSave(account); ok {
+			ctx.replyf("Offline: %v, account %v", sdat.Display, sdat.Name)
+		}
+	} else {
+		ctx.reply("Nobody has that name now.")
+	}
+
+	changes := searchNameLog(name, 10)
+	if len(changes) == 0 {
+		ctx.reply("No name changes logged.")
+		return
+	}
+	ctx.replyf("Last %v name changes:", len(changes))
+	for _, change := range changes {
+		ctx.replyf("%v: %v -> %v (id %v, account %v)", change.Time.Format(time.DateTime),
+			change.Old, change.New, change.ID, change.Account)
+	}
+}
+
+func cmdBind(ctx *cmdContext, params string, args []string) {
+	if hasEffects(ctx.player, EFFECT_INJURED) {
+		ctx.reply("You can't do that while injured.")
+		return
+	}
+	if !bindRespawn(ctx.player) {
+		ctx.reply("No respawn point nearby.")
+		return
+	}
+	ctx.reply("Respawn point set.")
+}
+
+func cmdRespawn(ctx *cmdContext, params string, args []string) {
+	if !hasEffects(ctx.player, EFFECT_INJURED) {
+		ctx.reply("You are not injured.")
+		return
+	}
+	respawnPlayer(ctx.player)
+}
+
+func cmdPvP(ctx *cmdContext, params string, args []string) {
+	player := ctx.player
+
+	if strings.EqualFold(params, "on") {
+		player.pvpFlag = true
+	} else if strings.EqualFold(params, "off") {
+		player.pvpFlag = false
+	}
+	zone := zoneNames[getZone(player.area, player.pos)]
+	if player.pvpFlag {
+		ctx.replyf("PvP is on. (zone: %v)", zone)
+	} else {
+		ctx.replyf("PvP is off. (zone: %v)", zone)
+	}
+}
+
+func cmdDuel(ctx *cmdContext, params string, args []string) {
+	player := ctx.player
+
+	if strings.EqualFold(params, "accept") {
+		acceptDuel(player)
+	} else if strings.EqualFold(params, "decline") {
+		if player.duelRequest != nil {
+			writeToPlayer(player.duelRequest, CMD_Command, []byte(fmt.Sprintf("%v declined your duel.", player.name)))
+			player.duelRequest = nil
+		}
+	} else if target := findPlayerByName(params); target != nil {
+		requestDuel(player, target)
+	} else {
+		ctx.reply("No player by that name.")
+	}
+}
+
+func cmdParty(ctx *cmdContext, params string, args []string) {
+	player := ctx.player
+
+	if len(args) < 1 {
+		if player.party == nil {
+			ctx.reply("You are not in a party.")
+			return
+		}
+		var names []string
+		for _, member := range player.party.members {
+			names = append(names, member.name)
+		}
+		ctx.reply("Party: " + strings.Join(names, ", "))
+		return
+	}
+
+	subCommand := args[0]
+	targetName := strings.Join(args[1:], " ")
+
+	if strings.EqualFold(subCommand, "accept") {
+		acceptParty(player)
+	} else if strings.EqualFold(subCommand, "decline") {
+		player.partyInvite = nil
+	} else if strings.EqualFold(subCommand, "leave") {
+		leaveParty(player)
+	} else if strings.EqualFold(subCommand, "invite") || strings.EqualFold(subCommand, "kick") {
+		target := findPlayerByName(targetName)
+		if target == nil {
+			ctx.reply("No player by that name.")
+			return
+		}
+		if strings.EqualFold(subCommand, "invite") {
+			inviteParty(player, target)
+		} else {
+			kickParty(player, target)
+		}
+	} else {
+		ctx.reply("Unknown party command.")
+	}
+}
+
+func cmdPartyChat(ctx *cmdContext, params string, args []string) {
+	player := ctx.player
+
+	if player.party == nil {
+		ctx.reply("You are not in a party.")
+		return
+	}
+	if len(params) == 0 || len(params) > maxChat {
+		return
+	}
+	sendChatFrom(player.party.members, player, protocol.CHAT_PARTY, params, fmt.Sprintf("%v (party): %v", player.name, params))
+}
+
+func cmdWho(ctx *cmdContext, params string, args []string) {
+	names := []string{}
+	for _, player := range playerList {
+		if ctx.admin {
+			names = append(names, fmt.Sprintf("%v (id %v, lvl %v, %v, %v)", player.name, player.id, player.level, player.addr, rttString(player)))
+		} else {
+			names = append(names, fmt.Sprintf("%v (lvl %v, %v)", player.name, player.level, rttString(player)))
+		}
+	}
+	sort.Strings(names)
+
+	ctx.replyf("%v players online:", len(names))
+	for _, name := range names {
+		ctx.reply(name)
+	}
+}
+
+func cmdSave(ctx *cmdContext, params string, args []string) {
+	for _, area := range areaList {
+		if area != nil {
+			area.dirty = true
+		}
+	}
+
+	//saveWorld needs processLock, which we are holding
+	go saveWorld()
+	ctx.reply("Saving.")
+}
+
+func cmdKick(ctx *cmdContext, params string, args []string) {
+	if len(args) < 1 {
+		ctx.reply("Kick who?")
+		return
+	}
+
+	//Names can have spaces, the reason is whatever follows the name
+	target, rest := findPlayerInArgs(args)
+	if target == nil {
+		ctx.reply("No player by that name.")
+		return
+	}
+
+	reason := "kicked"
+	if len(rest) > 0 {
+		reason = "kicked: " + strings.Join(rest, " ")
+	}
+	removePlayer(target, reason)
+	ctx.replyf("Kicked %v.", target.name)
+}
+
+func cmdSay(ctx *cmdContext, params string, args []string) {
+	if len(params) == 0 || len(params) > maxChat {
+		ctx.reply("Message empty or too long.")
+		return
+	}
+	send_chat("[Server] " + params)
+}
+
+func cmdStats(ctx *cmdContext, params string, args []string) {
+	var numChunks, numCreatures int
+	for _, area := range areaList {
+		if area == nil {
+			continue
+		}
+		numChunks += len(area.Chunks)
+		for _, chunk := range area.Chunks {
+			numCreatures += int(chunk.numCreatures)
+		}
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	ctx.replyf("Tick: %v, behind: %v", gameTick, ticksBehind.Load())
+	ctx.replyf("Players: %v, connections: %v", numPlayers, numConnections.Load())
+	ctx.replyf("Areas: %v, chunks: %v, creatures: %v, drops: %v", len(areaList), numChunks, numCreatures, numDroppedItems)
+	ctx.replyf("Goroutines: %v, heap: %vmb", runtime.NumGoroutine(), mem.HeapAlloc/1024/1024)
+}
+
+func cmdSuspects(ctx *cmdContext, params string, args []string) {
+	suspects := []*playerData{}
+	for _, player := range playerList {
+		decayCheatScore(player)
+		if player.cheat.peakScore > 0 {
+			suspects = append(suspects, player)
+		}
+	}
+	sort.Slice(suspects, func(i, j int) bool { return suspects[i].cheat.peakScore > suspects[j].cheat.peakScore })
+
+	ctx.replyf("%v suspects:", len(suspects))
+	for _, player := range suspects {
+		reasons := []string{}
+		for reason, count := range player.cheat.events {
+			reasons = append(reasons, fmt.Sprintf("%v x%v", reason, count))
+		}
+		sort.Strings(reasons)
+
+		flag := ""
+		if player.cheat.flagged {
+			flag = " FLAGGED"
+		}
+		ctx.replyf("%v (id %v, %v) score %v, peak %v%v: %v", player.name, player.id, player.addr,
+			player.cheat.score, player.cheat.peakScore, flag, strings.Join(reasons, ", "))
+	}
+}
+
+func cmdCompression(ctx *cmdContext, params string, args []string) {
+	if len(args) > 0 && args[0] == "train" {
+		if !startTraining() {
+			ctx.reply("Already training.")
+			return
+		}
+		ctx.replyf("Collecting %v world updates, new players get the dictionary when done.", trainSamples)
+		return
+	}
+
+	if dictCompressor == nil {
+		ctx.reply("Dictionary: none")
+	} else {
+		dict := dictCompressor.Dict()
+		ctx.replyf("Dictionary: %vb, ID %08x", len(dict), protocol.DictID(dict))
+	}
+	if progress := trainingProgress(); progress >= 0 {
+		ctx.replyf("Training: %v/%v world updates", progress, trainSamples)
+	}
+
+	for c := range compressIn {
+		in, out := compressIn[c].Load(), compressOut[c].Load()
+		if in > 0 {
+			ctx.replyf("%v: %vkb to %vkb, %.1f%% saved", cmdNames[CMD(c)], in/1024, out/1024, 100-float64(out)*100/float64(in))
+		}
+		if deflated := deflateBytes[c].Load(); deflated > 0 {
+			ctx.replyf("%v: %vkb deflated", cmdNames[CMD(c)], deflated/1024)
+		}
+	}
+}
+
+func cmdReload(ctx *cmdContext, params string, args []string) {
+	if err := reloadConfigLocked(); err != nil {
+		ctx.replyf("Reload failed: %v", err)
+		return
+	}
+	ctx.reply("Config reloaded.")
+}
+
+func cmdLogLevel(ctx *cmdContext, params string, args []string) {
+	if len(args) == 1 && strings.EqualFold(args[0], "reset") {
+		resetLogLevels()
+		ctx.reply("Log levels: " + getLogLevels())
+		return
+	}
+	if len(args) < 2 {
+		ctx.reply("Log levels: " + getLogLevels())
+		return
+	}
+
+	level, err := parseLogLevel(args[1])
+	if err != nil {
+		ctx.reply(err.Error())
+		return
+	}
+	setLogLevel(strings.ToLower(args[0]), level)
+	ctx.reply("Log levels: " + getLogLevels())
+}
+
+func cmdShutdown(ctx *cmdContext, params string, args []string) {
+	delay := time.Duration(config.Load().ShutdownSeconds) * time.Second
+	reason := "server shutdown"
+
+	if len(args) > 0 {
+		if strings.EqualFold(args[0], "cancel") {
+			if !cancelShutdown() {
+				ctx.reply("No shutdown pending.")
+			}
+			return
+		}
+
+		secs, err := strconv.Atoi(args[0])
+		if err != nil || secs < 0 {
+			ctx.reply("Seconds must be a number.")
+			return
+		}
+		delay = time.Duration(secs) * time.Second
+	}
+	if len(args) > 1 {
+		reason = strings.Join(args[1:], " ")
+	}
+
+	if !startShutdown(delay, reason) {
+		ctx.reply("Shutdown already pending.")
+		return
+	}
+	ctx.replyf("Shutting down in %v.", delay)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Names can have spaces, anything after the name is the reason
+func TestKick(t *testing.T) {
+	w := newNameTest(t)
+	mal := w.addPlayer(XYf32{X: 0, Y: 0})
+	mal.name = "Mal"
+	great := w.addPlayer(XYf32{X: 0, Y: 0})
+	great.name = "Mal the Great"
+
+	tests := []struct {
+		line   string
+		reply  string
+		kicked *playerData
+	}{
+		{"/kick", "Kick who?", nil},
+		{"/kick Nobody here", "No player by that name.", nil},
+		{"/kick mal the great spamming chat", "Kicked Mal the Great.", great},
+		{"/kick Mal", "Kicked Mal.", mal},
+	}
+
+	for _, tc := range tests {
+		replies := runAs(nil, true, tc.line)
+		if len(replies) != 1 || replies[0] != tc.reply {
+			t.Errorf("%q: got %q, want %q", tc.line, replies, tc.reply)
+		}
+		if tc.kicked != nil && tc.kicked.VALID {
+			t.Errorf("%q: %v still online", tc.line, tc.kicked.name)
+		}
+	}
+}
+
+// Replies come before the command returns, while processLock is still held
+func TestReloadReply(t *testing.T) {
+	oldConfig, oldFile := config.Load(), configFile
+	t.Cleanup(func() {
+		config.Store(oldConfig)
+		configFile = oldFile
+	})
+	config.Store(defaultConfig())
+	configFile = filepath.Join(t.TempDir(), "missing.json")
+
+	replies := runAs(nil, true, "/reload")
+	if len(replies) != 1 || !strings.HasPrefix(replies[0], "Reload failed") {
+		t.Errorf("/reload: got %q", replies)
+	}
+	if replies := runAs(nil, true, "/shutdown cancel"); len(replies) != 1 || replies[0] != "No shutdown pending." {
+		t.Errorf("/shutdown cancel: got %q", replies)
+	}
+}
+
+func TestCommandLogLine(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"/kick Mal spamming", "/kick Mal spamming"},
+		{"/setpassword Mal hunter22", "/setpassword ..."},
+		{"/ACCOUNT Mal hunter22", "/ACCOUNT ..."},
+		{"", ""},
+	}
+
+	for _, tc := range tests {
+		if got := commandLogLine(tc.line); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
+
+// Secret commands from clients are cut short in the net debug log too
+func TestCommandNotLogged(t *testing.T) {
+	w := newTestWorld(t)
+	player := w.addPlayer(XYf32{X: 0, Y: 0})
+
+	setLogLevel(SUB_NET, LOG_DEBUG)
+	logReady = true
+	t.Cleanup(func() {
+		logReady = false
+		resetLogLevels()
+	})
+
+	newParser(append([]byte{byte(CMD_Command)}, "/password oldsecret newsecret"...), player)
+
+	found := false
+	for len(logChan) > 0 {
+		entry := <-logChan
+		if strings.Contains(entry.Message, "secret") {
+			t.Errorf("password logged: %v", entry.Message)
+		}
+		if strings.Contains(entry.Message, "Received: ") && strings.HasSuffix(entry.Message, "/password ...") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("command not logged")
+	}
+}
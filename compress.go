@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"goMMOServ/protocol"
+)
+
+const (
+	dictFile      = "worldupdate.dict"
+	dictGram      = 8    //Length of the byte strings counted when training
+	trainSamples  = 2000 //World updates collected to train a dictionary
+	maxSampleSize = 4096 //Only the start of larger updates is kept
+)
+
+// How a message type is compressed
+type COMP uint8
+
+const (
+	COMP_NONE    COMP = iota
+	COMP_DEFLATE      //websocket permessage-deflate, any message
+	COMP_ZLIB         //The compressed variant of the message
+	COMP_DICT         //The compressed variant, with the shared dictionary
+)
+
+var compNames = map[COMP]string{
+	COMP_NONE:    "none",
+	COMP_DEFLATE: "deflate",
+	COMP_ZLIB:    "zlib",
+	COMP_DICT:    "dict",
+}
+
+// Messages with a compressed variant, the client decompresses them back
+var compressedCmds = map[CMD]CMD{
+	CMD_WorldUpdate: CMD_WorldUpdateComp,
+}
+
+var (
+	compressRules   [256]COMP //From config, processLock must be held
+	plainCompressor = protocol.NewCompressor(nil)
+	dictCompressor  *protocol.Compressor //nil without a dictionary, processLock must be held
+
+	compressIn      [256]atomic.Uint64 //Bytes before zlib, by original CMD
+	compressOut     [256]atomic.Uint64 //Bytes after, including messages sent raw because it didn't help
+	compressSkipped [256]atomic.Uint64 //Messages under CompressMinBytes
+	deflateBytes    [256]atomic.Uint64 //Bytes handed to permessage-deflate, what it saves isn't visible to us
+
+	training    atomic.Bool
+	trainLock   sync.Mutex
+	dictSamples [][]byte
+)
+
+func parseComp(name string) (COMP, error) {
+	for comp, compName := range compNames {
+		if compName == name {
+			return comp, nil
+		}
+	}
+	return COMP_NONE, fmt.Errorf("unknown compression: %v", name)
+}
+
+func findCmd(name string) (CMD, bool) {
+	for cmd, cmdName := range cmdNames {
+		if cmdName == name {
+			return cmd, true
+		}
+	}
+	return 0, false
+}
+
+func validateCompression(cfg *serverConfig) error {
+	for name, method := range cfg.Compression {
+		cmd, ok := findCmd(name)
+		if !ok {
+			return fmt.Errorf("Compression: unknown message %v", name)
+		}
+		comp, err := parseComp(method)
+		if err != nil {
+			return fmt.Errorf("Compression %v: %v", name, err)
+		}
+		if _, ok := compressedCmds[cmd]; (comp == COMP_ZLIB || comp == COMP_DICT) && !ok {
+			return fmt.Errorf("Compression %v: no compressed variant, use deflate", name)
+		}
+	}
+	return nil
+}
+
+// Build the per message table, config is already validated
+func setCompressRules(cfg *serverConfig) {
+	compressRules = [256]COMP{}
+	for name, method := range cfg.Compression {
+		cmd, _ := findCmd(name)
+		compressRules[cmd], _ = parseComp(method)
+	}
+}
+
+// Pick what the client can decompress, right after the handshake.
+// Players keep the dictionary they were sent, even if a new one is trained.
+func setupCompression(player *playerData) {
+	player.compressor = nil
+	if player.protoVersion < protocol.VersionCompress || player.caps&protocol.CAP_COMPRESS_ZLIB == 0 {
+		return
+	}
+
+	if dictCompressor == nil {
+		player.compressor = plainCompressor
+		return
+	}
+	dict := dictCompressor.Dict()
+	writeToPlayer(player, CMD_Dictionary, (&protocol.Dictionary{ID: protocol.DictID(dict), Data: dict}).Encode())
+	player.compressor = dictCompressor
+}
+
+// Apply the rule for this message type. Returns the header and data to send,
+// and whether the transport should deflate it.
+func compressMessage(player *playerData, header CMD, data []byte) (CMD, []byte, bool) {
+	rule := compressRules[header]
+	if rule == COMP_NONE {
+		return header, data, false
+	}
+	if len(data) < config.Load().CompressMinBytes {
+		compressSkipped[header].Add(1)
+		return header, data, false
+	}
+
+	if rule == COMP_DEFLATE {
+		if !canDeflate(player) {
+			return header, data, false
+		}
+		deflateBytes[header].Add(uint64(len(data)))
+		return header, data, true
+	}
+
+	sampleMessage(header, data)
+	comp := player.compressor
+	if comp == nil {
+		return header, data, false
+	}
+	if rule == COMP_ZLIB {
+		comp = plainCompressor
+	}
+
+	out := comp.Compress(data)
+	compressIn[header].Add(uint64(len(data)))
+	if len(out) >= len(data) {
+		compressOut[header].Add(uint64(len(data)))
+		return header, data, false
+	}
+	compressOut[header].Add(uint64(len(out)))
+	return compressedCmds[header], out, false
+}
+
+func canDeflate(player *playerData) bool {
+	conn, ok := player.conn.(deflater)
+	return ok && conn.CanDeflate()
+}
+
+// Keep world updates while training, called from the serialize goroutines
+func sampleMessage(header CMD, data []byte) {
+	if header != CMD_WorldUpdate || !training.Load() {
+		return
+	}
+
+	trainLock.Lock()
+	defer trainLock.Unlock()
+
+	if !training.Load() {
+		return
+	}
+	dictSamples = append(dictSamples, append([]byte{}, data[:min(len(data), maxSampleSize)]...))
+	if len(dictSamples) >= trainSamples {
+		training.Store(false)
+		go finishTraining(dictSamples)
+		dictSamples = nil
+	}
+}
+
+// Collect world updates for a new dictionary, false if already training
+func startTraining() bool {
+	trainLock.Lock()
+	defer trainLock.Unlock()
+
+	if training.Load() {
+		return false
+	}
+	dictSamples = nil
+	training.Store(true)
+	return true
+}
+
+// Samples collected so far, -1 if not training
+func trainingProgress() int {
+	trainLock.Lock()
+	defer trainLock.Unlock()
+
+	if !training.Load() {
+		return -1
+	}
+	return len(dictSamples)
+}
+
+func finishTraining(samples [][]byte) {
+	defer reportPanic("finishTraining")
+
+	dict := trainDictionary(samples, protocol.MaxDictSize)
+	if len(dict) == 0 {
+		logWarn(SUB_NET, "Dictionary training found nothing in common")
+		return
+	}
+
+	os.MkdirAll(dataDir, 0755)
+	err := os.WriteFile(fmt.Sprintf("%v/%v", dataDir, dictFile), dict, 0644)
+	if err != nil {
+		logError(SUB_NET, "finishTraining: WriteFile %v", err.Error())
+	}
+
+	processLock.Lock()
+	dictCompressor = protocol.NewCompressor(dict)
+	processLock.Unlock()
+
+	logInfo(SUB_NET, "Trained a %vb dictionary from %v world updates, ID %08x", len(dict), len(samples), protocol.DictID(dict))
+}
+
+// Byte strings found in the most samples, most common last since zlib
+// references the end of the dictionary most cheaply
+func trainDictionary(samples [][]byte, size int) []byte {
+	counts := map[string]int{}
+	for _, sample := range samples {
+		seen := map[string]bool{}
+		for i := 0; i+dictGram <= len(sample); i++ {
+			gram := string(sample[i : i+dictGram])
+			if !seen[gram] {
+				seen[gram] = true
+				counts[gram]++
+			}
+		}
+	}
+
+	type gramCount struct {
+		gram  string
+		count int
+	}
+	common := []gramCount{}
+	for gram, count := range counts {
+		//Only in one update, nothing to share
+		if count > 1 {
+			common = append(common, gramCount{gram, count})
+		}
+	}
+	sort.Slice(common, func(i, j int) bool {
+		if common[i].count != common[j].count {
+			return common[i].count > common[j].count
+		}
+		return common[i].gram < common[j].gram
+	})
+
+	if len(common)*dictGram > size {
+		common = common[:size/dictGram]
+	}
+	dict := make([]byte, 0, len(common)*dictGram)
+	for i := len(common) - 1; i >= 0; i-- {
+		dict = append(dict, common[i].gram...)
+	}
+	return dict
+}
+
+// Load the trained dictionary at startup, there is none until one is trained
+func loadDictionary() {
+	data, err := os.ReadFile(fmt.Sprintf("%v/%v", dataDir, dictFile))
+	if err != nil {
+		return
+	}
+	if len(data) > protocol.MaxDictSize {
+		logError(SUB_NET, "Dictionary too large: %vb", len(data))
+		return
+	}
+
+	dictCompressor = protocol.NewCompressor(data)
+	logInfo(SUB_NET, "Loaded a %vb dictionary, ID %08x", len(data), protocol.DictID(data))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"goMMOServ/protocol"
+)
+
+// Connection that keeps what was sent
+type fakeConn struct {
+	deflate  bool
+	sent     [][]byte
+	deflated int
+}
+
+func (c *fakeConn) Send(data []byte) error {
+	c.sent = append(c.sent, data)
+	return nil
+}
+
+func (c *fakeConn) SendDeflate(data []byte) error {
+	c.deflated++
+	return c.Send(data)
+}
+
+func (c *fakeConn) CanDeflate() bool                  { return c.deflate }
+func (c *fakeConn) Receive() ([]byte, error)          { return nil, nil }
+func (c *fakeConn) SendClose(code int, reason string) {}
+func (c *fakeConn) Close() error                      { return nil }
+func (c *fakeConn) RemoteAddr() string                { return "127.0.0.1:1" }
+
+func TestCompressMessage(t *testing.T) {
+	oldConfig := config.Load()
+	t.Cleanup(func() {
+		config.Store(oldConfig)
+		setCompressRules(config.Load())
+	})
+	config.Store(defaultConfig())
+	setCompressRules(config.Load())
+
+	update := bytes.Repeat([]byte{0, 0, 0, 128, 1, 2}, 50)
+	dict := bytes.Repeat([]byte{0, 0, 0, 128}, 64)
+
+	tests := []struct {
+		name        string
+		header      CMD
+		data        []byte
+		compressor  *protocol.Compressor
+		deflate     bool
+		wantHeader  CMD
+		wantDeflate bool
+	}{
+		{"world update", CMD_WorldUpdate, update, protocol.NewCompressor(dict), false, CMD_WorldUpdateComp, false},
+		{"old client", CMD_WorldUpdate, update, nil, false, CMD_WorldUpdate, false},
+		{"too small", CMD_WorldUpdate, update[:10], plainCompressor, false, CMD_WorldUpdate, false},
+		{"chat deflated", CMD_Chat, update, nil, true, CMD_Chat, true},
+		{"chat without deflate", CMD_Chat, update, nil, false, CMD_Chat, false},
+		{"no rule", CMD_Login, update, plainCompressor, true, CMD_Login, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			player := &playerData{conn: &fakeConn{deflate: tc.deflate}, compressor: tc.compressor}
+
+			header, out, deflate := compressMessage(player, tc.header, tc.data)
+			if header != tc.wantHeader || deflate != tc.wantDeflate {
+				t.Fatalf("got %v deflate %v, want %v deflate %v", cmdNames[header], deflate, cmdNames[tc.wantHeader], tc.wantDeflate)
+			}
+			if header != CMD_WorldUpdateComp {
+				if !bytes.Equal(out, tc.data) {
+					t.Errorf("data changed without compressing")
+				}
+				return
+			}
+
+			raw, err := protocol.DecompressDict(out, tc.compressor.Dict())
+			if err != nil || !bytes.Equal(raw, tc.data) {
+				t.Errorf("round trip failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestTrainDictionary(t *testing.T) {
+	//Every sample shares a header, and has a counter that never repeats
+	shared := []byte("player record header ")
+	samples := [][]byte{}
+	for i := 0; i < 50; i++ {
+		sample := append([]byte{}, shared...)
+		samples = append(samples, append(sample, byte(i), byte(i*7), byte(i*13)))
+	}
+
+	dict := trainDictionary(samples, 64)
+	if len(dict) == 0 || len(dict) > 64 || len(dict)%dictGram != 0 {
+		t.Fatalf("dictionary is %vb", len(dict))
+	}
+	if !bytes.Contains(shared, dict[len(dict)-dictGram:]) {
+		t.Errorf("most common string %q isn't from the shared header", dict[len(dict)-dictGram:])
+	}
+
+	test := append(append([]byte{}, shared...), 1, 2, 3)
+	if len(protocol.CompressDict(test, dict)) >= len(protocol.CompressDict(test, nil)) {
+		t.Errorf("trained dictionary didn't help")
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   map[string]string
+		wantErr bool
+	}{
+		{"defaults", defaultConfig().Compression, false},
+		{"unknown message", map[string]string{"CMD_Nope": "deflate"}, true},
+		{"unknown method", map[string]string{"CMD_Chat": "lz4"}, true},
+		{"zlib without variant", map[string]string{"CMD_Chat": "zlib"}, true},
+		{"off", map[string]string{"CMD_WorldUpdate": "none"}, false},
+	}
+
+	for _, tc := range tests {
+		cfg := defaultConfig()
+		cfg.Compression = tc.rules
+		if err := validateCompression(cfg); (err != nil) != tc.wantErr {
+			t.Errorf("%v: err = %v, want error %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
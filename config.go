@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"goMMOServ/protocol"
+)
+
+const defaultConfigFile = "server.json"
+
+type serverConfig struct {
+	//Only read at startup
+	BindIP        string
+	HTTPSPort     int
+	HTTPPort      int
+	DevMode       bool
+	FrameSpeedNS  int64
+	AdminAddr     string
+	ConsoleSocket string
+	TCPAddr       string //Length-prefixed TCP for native clients and bots, blank to disable
+	CertFile      string
+	KeyFile       string
+
+	//Reloaded on SIGHUP
+	MaxConnections   int32
+	MaxNetRead       int
+	SpawnArea        int
+	WorldSaveSeconds int
+	SearchChunks     int
+	RespawnHealth    int16
+	AllowedOrigin    string
+	RedirectHost     string
+	AdminToken       string
+	ShutdownSeconds  int
+	MinClientVersion uint16 //Refuse clients older than this, 0 for the oldest supported
+
+	MaxInputsPerTick    int //Moves past this in one tick are dropped and scored
+	EditRange           int //How far from the editor edits can be made
+	AntiCheatFlagScore  int //Suspicion score before a player is flagged and audited
+	AntiCheatKickScore  int //Suspicion score before a player is kicked, 0 to never kick
+	LagCompMaxMS        int //Most latency hits are compensated for, 0 to turn it off
+	ResumeGraceSeconds  int //How long a disconnected character waits to be resumed, 0 to remove at once
+	NameCooldownMinutes int //Between display name changes, 0 for none
+
+	Compression      map[string]string //By message name: none, deflate, or zlib and dict for world updates
+	CompressMinBytes int               //Smaller messages are sent as they are
+
+	CrashKeep          int //Number of crash reports kept
+	CrashLimit         int //Panics within CrashWindowSeconds before shutting down
+	CrashWindowSeconds int
+	CrashHeapDump      bool //Write a heap dump with each report, these are large
+
+	LogLevel     string            //debug, info, warn or error
+	LogLevels    map[string]string //Per subsystem overrides
+	LogFormat    string            //text or json
+	LogMaxSizeMB int               //0 only rotates daily
+}
+
+var (
+	configFile = defaultConfigFile
+
+	//Swapped whole on reload, load it once and read the snapshot
+	config atomic.Pointer[serverConfig]
+)
+
+func init() {
+	config.Store(defaultConfig())
+}
+
+func defaultConfig() *serverConfig {
+	return &serverConfig{
+		HTTPSPort:    443,
+		HTTPPort:     80,
+		FrameSpeedNS: 133333333,
+		AdminAddr:    "127.0.0.1:8081",
+		CertFile:     "fullchain.pem",
+		KeyFile:      "privkey.pem",
+
+		MaxConnections:   50000,
+		MaxNetRead:       1024 * 500, //500kb
+		SpawnArea:        256,
+		WorldSaveSeconds: 5,
+		SearchChunks:     6,
+		RespawnHealth:    50,
+		AllowedOrigin:    "https://gommo.go-game.net",
+		RedirectHost:     "gommo.go-game.net",
+		ShutdownSeconds:  30,
+
+		MaxInputsPerTick:    4,
+		EditRange:           768,
+		AntiCheatFlagScore:  50,
+		AntiCheatKickScore:  200,
+		LagCompMaxMS:        300,
+		ResumeGraceSeconds:  60,
+		NameCooldownMinutes: 60,
+
+		Compression: map[string]string{
+			"CMD_WorldUpdate": "dict",
+			"CMD_Chat":        "deflate",
+			"CMD_ChatFrom":    "deflate",
+			"CMD_Command":     "deflate",
+			"CMD_PartyUpdate": "deflate",
+		},
+		CompressMinBytes: 64,
+
+		CrashKeep:          20,
+		CrashLimit:         10,
+		CrashWindowSeconds: 60,
+
+		LogLevel:     "info",
+		LogFormat:    "text",
+		LogMaxSizeMB: 100,
+	}
+}
+
+// Read and validate a config file, missing settings keep their defaults
+func readConfig(filePath string) (*serverConfig, error) {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewBuffer(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode json: %v", err)
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func validateConfig(cfg *serverConfig) error {
+	if cfg.HTTPSPort < 1 || cfg.HTTPSPort > 65535 {
+		return fmt.Errorf("HTTPSPort out of range: %v", cfg.HTTPSPort)
+	}
+	if cfg.HTTPPort < 0 || cfg.HTTPPort > 65535 {
+		return fmt.Errorf("HTTPPort out of range: %v", cfg.HTTPPort)
+	}
+	if cfg.FrameSpeedNS < 1000000 {
+		return fmt.Errorf("FrameSpeedNS too small: %v", cfg.FrameSpeedNS)
+	}
+	if cfg.MaxConnections < 1 {
+		return fmt.Errorf("MaxConnections must be at least 1")
+	}
+	if cfg.MaxNetRead < 1024 {
+		return fmt.Errorf("MaxNetRead too small: %v", cfg.MaxNetRead)
+	}
+	if cfg.SpawnArea < 2 {
+		return fmt.Errorf("SpawnArea too small: %v", cfg.SpawnArea)
+	}
+	if cfg.WorldSaveSeconds < 1 {
+		return fmt.Errorf("WorldSaveSeconds must be at least 1")
+	}
+	if cfg.SearchChunks < 1 || cfg.SearchChunks > 32 {
+		return fmt.Errorf("SearchChunks out of range: %v", cfg.SearchChunks)
+	}
+	if cfg.RespawnHealth < 1 {
+		return fmt.Errorf("RespawnHealth must be at least 1")
+	}
+	if cfg.ShutdownSeconds < 0 {
+		return fmt.Errorf("ShutdownSeconds can't be negative")
+	}
+	if cfg.MinClientVersion > protocol.Version {
+		return fmt.Errorf("MinClientVersion is newer than the server: %v", cfg.MinClientVersion)
+	}
+	if cfg.MaxInputsPerTick < 1 {
+		return fmt.Errorf("MaxInputsPerTick must be at least 1")
+	}
+	if cfg.EditRange < 1 {
+		return fmt.Errorf("EditRange must be at least 1")
+	}
+	if cfg.AntiCheatFlagScore < 1 {
+		return fmt.Errorf("AntiCheatFlagScore must be at least 1")
+	}
+	if cfg.AntiCheatKickScore < 0 {
+		return fmt.Errorf("AntiCheatKickScore can't be negative")
+	}
+	if cfg.LagCompMaxMS < 0 || cfg.LagCompMaxMS > 1000 {
+		return fmt.Errorf("LagCompMaxMS out of range: %v", cfg.LagCompMaxMS)
+	}
+	if cfg.ResumeGraceSeconds < 0 || cfg.ResumeGraceSeconds > 3600 {
+		return fmt.Errorf("ResumeGraceSeconds out of range: %v", cfg.ResumeGraceSeconds)
+	}
+	if cfg.NameCooldownMinutes < 0 || cfg.NameCooldownMinutes > 7*24*60 {
+		return fmt.Errorf("NameCooldownMinutes out of range: %v", cfg.NameCooldownMinutes)
+	}
+	if err := validateCompression(cfg); err != nil {
+		return err
+	}
+	if cfg.CompressMinBytes < 0 {
+		return fmt.Errorf("CompressMinBytes can't be negative")
+	}
+	if cfg.CrashKeep < 1 {
+		return fmt.Errorf("CrashKeep must be at least 1")
+	}
+	if cfg.CrashLimit < 1 {
+		return fmt.Errorf("CrashLimit must be at least 1")
+	}
+	if cfg.CrashWindowSeconds < 1 {
+		return fmt.Errorf("CrashWindowSeconds must be at least 1")
+	}
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	for sub, level := range cfg.LogLevels {
+		if _, err := parseLogLevel(level); err != nil {
+			return fmt.Errorf("LogLevels %v: %v", sub, err)
+		}
+	}
+	if !strings.EqualFold(cfg.LogFormat, "text") && !strings.EqualFold(cfg.LogFormat, "json") {
+		return fmt.Errorf("LogFormat must be text or json")
+	}
+	if cfg.LogMaxSizeMB < 0 {
+		return fmt.Errorf("LogMaxSizeMB can't be negative")
+	}
+	if cfg.RedirectHost == "" {
+		return fmt.Errorf("RedirectHost is empty")
+	}
+	return nil
+}
+
+// Load config at startup, uses defaults only if there is no file.
+// A file with mistakes is an error, not a server on default settings.
+func loadConfig() error {
+	cfg, err := readConfig(configFile)
+	if os.IsNotExist(err) {
+		logInfo(SUB_GENERAL, "No %v, using default config.", configFile)
+		cfg = defaultConfig()
+	} else if err != nil {
+		return fmt.Errorf("%v: %v", configFile, err)
+	}
+
+	FrameSpeedNS = cfg.FrameSpeedNS
+	config.Store(cfg)
+	applyConfig(cfg)
+	return nil
+}
+
+// Re-read the config file, only settings that are safe to change at runtime are applied
+func reloadConfig() error {
+	processLock.Lock()
+	defer processLock.Unlock()
+	return reloadConfigLocked()
+}
+
+// reloadConfig for callers already holding processLock, like commands
+func reloadConfigLocked() error {
+	cfg, err := readConfig(configFile)
+	if err != nil {
+		logError(SUB_GENERAL, "Config reload failed: %v", err)
+		return err
+	}
+
+	//Keep startup only settings, including command line overrides
+	old := config.Load()
+	cfg.BindIP = old.BindIP
+	cfg.HTTPSPort = old.HTTPSPort
+	cfg.HTTPPort = old.HTTPPort
+	cfg.DevMode = old.DevMode
+	cfg.FrameSpeedNS = old.FrameSpeedNS
+	cfg.AdminAddr = old.AdminAddr
+	cfg.ConsoleSocket = old.ConsoleSocket
+	cfg.TCPAddr = old.TCPAddr
+	cfg.CertFile = old.CertFile
+	cfg.KeyFile = old.KeyFile
+
+	config.Store(cfg)
+	applyConfig(cfg)
+
+	logInfo(SUB_GENERAL, "Config reloaded.")
+	return nil
+}
+
+// Copy config into the settings used by the game, these are only read with
+// processLock held. Anything else loads config.
+func applyConfig(cfg *serverConfig) {
+	spawnArea = cfg.SpawnArea
+	halfArea = spawnArea / 2
+	searchChunks = cfg.SearchChunks
+	respawnHealth = cfg.RespawnHealth
+	setCompressRules(cfg)
+	setLogConfig(cfg)
+}
+
+// Reload config on SIGHUP
+func configReloadDaemon() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	go func() {
+		defer reportPanic("configReloadDaemon")
+
+		for range sigs {
+			reloadConfig()
+		}
+	}()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Only a missing file falls back to defaults
+func TestLoadConfig(t *testing.T) {
+	oldConfig, oldFile := config.Load(), configFile
+	t.Cleanup(func() {
+		config.Store(oldConfig)
+		configFile = oldFile
+		applyConfig(oldConfig)
+	})
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		data    string //"" for no file
+		wantErr bool
+		port    int
+	}{
+		{"missing", "", false, defaultConfig().HTTPSPort},
+		{"valid", `{"HTTPSPort": 8443}`, false, 8443},
+		{"bad json", `{"HTTPSPort": 8443,}`, true, 0},
+		{"unknown field", `{"HTTPSPrt": 8443}`, true, 0},
+		{"out of range", `{"HTTPSPort": 70000}`, true, 0},
+	}
+
+	for _, tc := range tests {
+		configFile = filepath.Join(dir, tc.name+".json")
+		if tc.data != "" {
+			os.WriteFile(configFile, []byte(tc.data), 0644)
+		}
+		config.Store(nil)
+
+		err := loadConfig()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%v: got error %v, want error %v", tc.name, err, tc.wantErr)
+		}
+		if tc.wantErr {
+			if config.Load() != nil {
+				t.Errorf("%v: config set from a bad file", tc.name)
+			}
+		} else if cfg := config.Load(); cfg == nil || cfg.HTTPSPort != tc.port {
+			t.Errorf("%v: config %+v, want port %v", tc.name, cfg, tc.port)
+		}
+	}
+}
+
+// Levels changed at runtime stay until reset, a reload doesn't undo them
+func TestLogLevelsAcrossReload(t *testing.T) {
+	t.Cleanup(func() {
+		resetLogLevels()
+		setLogConfig(config.Load())
+	})
+	cfg := defaultConfig()
+	cfg.LogLevel = "warn"
+	cfg.LogLevels = map[string]string{SUB_SAVE: "error"}
+	cfg.LogFormat = "JSON"
+	if err := validateConfig(cfg); err != nil {
+		t.Fatalf("LogFormat JSON: %v", err)
+	}
+
+	setLogConfig(cfg)
+	setLogLevel(SUB_NET, LOG_DEBUG)
+	setLogConfig(cfg)
+	if logMinLevel != LOG_WARN || logSubLevels[SUB_NET] != LOG_DEBUG || logSubLevels[SUB_SAVE] != LOG_ERROR || !logJSON {
+		t.Errorf("after reload: min %v, subs %v, json %v", logMinLevel, logSubLevels, logJSON)
+	}
+
+	setLogLevel("all", LOG_DEBUG)
+	setLogConfig(cfg)
+	if logMinLevel != LOG_DEBUG || len(logSubLevels) != 0 {
+		t.Errorf("all after reload: min %v, subs %v", logMinLevel, logSubLevels)
+	}
+
+	resetLogLevels()
+	if logMinLevel != LOG_WARN || len(logSubLevels) != 1 {
+		t.Errorf("after reset: min %v, subs %v", logMinLevel, logSubLevels)
+	}
+}
+
+// Handlers read config without processLock while a reload swaps it, run with -race
+func TestReloadWhileReading(t *testing.T) {
+	oldConfig, oldFile := config.Load(), configFile
+	t.Cleanup(func() {
+		config.Store(oldConfig)
+		configFile = oldFile
+		applyConfig(oldConfig)
+	})
+	configFile = filepath.Join(t.TempDir(), "server.json")
+	os.WriteFile(configFile, []byte(`{"RedirectHost": "example.com"}`), 0644)
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			reloadConfig()
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		w := httptest.NewRecorder()
+		redirectToTls(w, httptest.NewRequest("GET", "/play", nil))
+		if loc := w.Header().Get("Location"); !strings.HasSuffix(loc, "/play") {
+			t.Errorf("redirect to %q", loc)
+		}
+	}
+	<-done
+	if host := config.Load().RedirectHost; host != "example.com" {
+		t.Errorf("RedirectHost %q after reload", host)
+	}
+}
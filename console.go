@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// Operator console on stdin, commands run with admin rights
+func startConsole() {
+	go func() {
+		defer reportPanic("startConsole")
+
+		runConsole(os.Stdin, func(str string) { fmt.Println(str) })
+		logInfo(SUB_ADMIN, "Console: stdin closed.")
+	}()
+
+	if path := config.Load().ConsoleSocket; path != "" {
+		startConsoleSocket(path)
+	}
+}
+
+// Read commands a line at a time until EOF
+func runConsole(input io.Reader, reply func(string)) {
+	ctx := &cmdContext{admin: true, reply: reply}
+
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		logInfo(SUB_ADMIN, "Console: %v", commandLogLine(line))
+		processLock.Lock()
+		runCommand(ctx, line)
+		processLock.Unlock()
+	}
+}
+
+// Local unix socket for the console, for when stdin isn't available.
+// It is made in a private directory and only moved to path once it is 0600,
+// so nobody else can connect in between.
+func startConsoleSocket(path string) {
+	os.Remove(path)
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".console-")
+	if err != nil {
+		logError(SUB_ADMIN, "Console socket: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "console.sock")
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		logError(SUB_ADMIN, "Console socket: %v", err)
+		return
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		listener.Close()
+		logError(SUB_ADMIN, "Console socket: %v", err)
+		return
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		listener.Close()
+		logError(SUB_ADMIN, "Console socket: %v", err)
+		return
+	}
+	logInfo(SUB_ADMIN, "Console socket on %v", path)
+
+	go func() {
+		defer reportPanic("startConsoleSocket")
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				logError(SUB_ADMIN, "Console socket accept: %v", err)
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer reportPanic("consoleSocket")
+				defer conn.Close()
+
+				runConsole(conn, func(str string) { fmt.Fprintln(conn, str) })
+			}(conn)
+		}
+	}()
+}
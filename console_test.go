@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The socket is only reachable once it is private, nothing is left behind
+func TestConsoleSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "console.sock")
+	startConsoleSocket(path)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, want a 0600 socket", info.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%v files next to the socket, want only the socket", len(entries))
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("/shutdown cancel\n"))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || reply != "No shutdown pending.\n" {
+		t.Errorf("reply %q, %v", reply, err)
+	}
+}
@@ -1,127 +1,308 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+type LOGLEVEL uint8
+
+const (
+	LOG_DEBUG LOGLEVEL = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var logLevelNames = map[LOGLEVEL]string{
+	LOG_DEBUG: "debug",
+	LOG_INFO:  "info",
+	LOG_WARN:  "warn",
+	LOG_ERROR: "error",
+}
+
+// Subsystems, used to filter
+const (
+	SUB_GENERAL = "general"
+	SUB_NET     = "net"
+	SUB_WORLD   = "world"
+	SUB_COMBAT  = "combat"
+	SUB_SAVE    = "save"
+	SUB_ADMIN   = "admin"
+	SUB_CHEAT   = "cheat"
+)
+
+const (
+	logDir     = "log"
+	logBufSize = 10000
+)
+
+type logEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Sub     string    `json:"sub"`
+	Src     string    `json:"src"`
+	Message string    `json:"msg"`
+}
+
 var (
-	logDesc  *os.File
-	logName  string
-	logReady bool
+	logDesc    *os.File
+	logDay     string
+	logPart    int
+	logSize    int64
+	logReady   bool
+	logChan    = make(chan *logEntry, logBufSize)
+	logDropped atomic.Uint64
+
+	//Runtime adjustable filters
+	logMinLevel  = LOG_INFO
+	logSubLevels = map[string]LOGLEVEL{}
+	logJSON      bool
+	logMaxSize   int64
+	logFiltLock  sync.RWMutex
 
-	logBuf      []string
-	logBufLines int
-	logBufLock  sync.Mutex
+	//Filters from config, and changes made with /loglevel or the admin API.
+	//Changes are kept across config reloads, until reset.
+	logCfgMin  = LOG_INFO
+	logCfgSubs = map[string]LOGLEVEL{}
+	logSetAll  *LOGLEVEL
+	logSetSubs = map[string]LOGLEVEL{}
 )
 
+func logDebug(sub, format string, args ...interface{}) { logMsg(LOG_DEBUG, sub, format, args...) }
+func logInfo(sub, format string, args ...interface{})  { logMsg(LOG_INFO, sub, format, args...) }
+func logWarn(sub, format string, args ...interface{})  { logMsg(LOG_WARN, sub, format, args...) }
+func logError(sub, format string, args ...interface{}) { logMsg(LOG_ERROR, sub, format, args...) }
+
+// Check filters for a subsystem, cheap enough to call before building a message
+func logEnabled(level LOGLEVEL, sub string) bool {
+	logFiltLock.RLock()
+	defer logFiltLock.RUnlock()
+
+	if subLevel, found := logSubLevels[sub]; found {
+		return level >= subLevel
+	}
+	return level >= logMinLevel
+}
+
 /*
  * Log this, can use printf arguments
- * Write to buffer, async write
+ * Queued for the writer, never blocks the caller
  */
-func doLog(withTrace bool, format string, args ...interface{}) {
-	defer reportPanic("doLog")
-
-	var buf string
-
-	if withTrace {
-		/* Get current time */
-		ctime := time.Now()
-		/* Get calling function and line */
-		_, filename, line, _ := runtime.Caller(1)
-		/* printf conversion */
-		text := fmt.Sprintf(format, args...)
-		/* Add current date */
-		date := fmt.Sprintf("%2v:%2v.%2v", ctime.Hour(), ctime.Minute(), ctime.Second())
-		/* Date, go file, go file line, text */
-		buf = fmt.Sprintf("%v: %15v:%5v: %v\n", date, filepath.Base(filename), line, text)
-	} else {
-		/* Get current time */
-		ctime := time.Now()
-		/* printf conversion */
-		text := fmt.Sprintf(format, args...)
-		/* Add current date */
-		date := fmt.Sprintf("%2v:%2v.%2v", ctime.Hour(), ctime.Minute(), ctime.Second())
-		/* Date, go file, go file line, text */
-		buf = fmt.Sprintf("%v: %v\n", date, text)
-	}
-
-	if !logReady || logDesc == nil {
-		fmt.Print(buf)
+func logMsg(level LOGLEVEL, sub string, format string, args ...interface{}) {
+	if !logEnabled(level, sub) {
+		return
+	}
+
+	/* Get calling function and line, skip the logDebug/logInfo wrapper */
+	_, filename, line, _ := runtime.Caller(2)
+
+	entry := &logEntry{Time: time.Now(), Level: logLevelNames[level], Sub: sub,
+		Src: fmt.Sprintf("%v:%v", filepath.Base(filename), line), Message: fmt.Sprintf(format, args...)}
+
+	if !logReady {
+		fmt.Print(formatText(entry))
 		return
 	}
 
-	/* Add to buffer */
-	logBufLock.Lock()
-	logBuf = append(logBuf, buf)
-	logBufLines++
-	logBufLock.Unlock()
+	select {
+	case logChan <- entry:
+	default:
+		logDropped.Add(1)
+	}
+}
+
+func formatText(entry *logEntry) string {
+	return fmt.Sprintf("%v %-5v %-7v %18v: %v\n",
+		entry.Time.Format("15:04:05.000"), entry.Level, entry.Sub, entry.Src, entry.Message)
 }
 
+func formatJSON(entry *logEntry) string {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return formatText(entry)
+	}
+	return string(data) + "\n"
+}
+
+// Writes queued lines, rotates daily and when the file gets too big
 func logDaemon() {
 
 	go func() {
 		defer reportPanic("logDaemon")
 
-		for {
-			logBufLock.Lock()
+		for entry := range logChan {
+			if dropped := logDropped.Swap(0); dropped > 0 {
+				fmt.Printf("Log buffer full, dropped %v lines.\n", dropped)
+			}
+
+			text := formatText(entry)
+			fmt.Print(text)
+
+			logFiltLock.RLock()
+			useJSON := logJSON
+			maxSize := logMaxSize
+			logFiltLock.RUnlock()
 
-			/* Are there lines to write? */
-			if logBufLines == 0 {
-				logBufLock.Unlock()
-				time.Sleep(time.Millisecond * 100)
+			if entry.Time.Format("2006-01-02") != logDay || (maxSize > 0 && logSize >= maxSize) {
+				rotateLog(entry.Time)
+			}
+			if logDesc == nil {
 				continue
 			}
 
-			/* Write line */
-			_, err := logDesc.WriteString(logBuf[0])
+			if useJSON {
+				text = formatJSON(entry)
+			}
+			written, err := logDesc.WriteString(text)
+			logSize += int64(written)
 			if err != nil {
-				fmt.Println("DoLog: WriteString failure")
+				fmt.Println("logDaemon: WriteString failure")
 				logDesc.Close()
 				logDesc = nil
 			}
-			fmt.Print(logBuf[0])
-
-			/* Remove line from buffer */
-			logBuf = logBuf[1:]
-			logBufLines--
-
-			logBufLock.Unlock()
 		}
 	}()
 }
 
-/* Prep logger */
-func startLog() {
-	defer reportPanic("startLog")
+// Open the next log file, a new day starts over at part 0
+func rotateLog(now time.Time) {
+	day := now.Format("2006-01-02")
+	if day != logDay {
+		logDay = day
+		logPart = 0
+	} else {
+		logPart++
+	}
 
-	t := time.Now()
+	if logDesc != nil {
+		logDesc.Close()
+		logDesc = nil
+	}
 
-	/* Create our log file names */
-	logName = fmt.Sprintf("log/auth-%v-%v-%v.log", t.Day(), t.Month(), t.Year())
+	name := fmt.Sprintf("%v/gommo-%v.log", logDir, day)
+	if logPart > 0 {
+		name = fmt.Sprintf("%v/gommo-%v-%v.log", logDir, day, logPart)
+	}
 
-	/* Make log directory */
-	errr := os.MkdirAll("log", os.ModePerm)
-	if errr != nil {
-		fmt.Print(errr.Error())
+	desc, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		fmt.Printf("An error occurred when attempting to create the log. Details: %s\n", err)
 		return
 	}
 
-	/* Open log files */
-	bdesc, errb := os.OpenFile(logName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	logSize = 0
+	if stat, err := desc.Stat(); err == nil {
+		logSize = stat.Size()
+	}
+	logDesc = desc
+}
+
+/* Prep logger */
+func startLog() {
+	defer reportPanic("startLog")
 
-	/* Handle file errors */
-	if errb != nil {
-		fmt.Printf("An error occurred when attempting to create the log. Details: %s", errb)
+	/* Make log directory */
+	err := os.MkdirAll(logDir, os.ModePerm)
+	if err != nil {
+		fmt.Print(err.Error())
 		return
 	}
 
-	/* Save descriptors, open/closed elsewhere */
-	logDesc = bdesc
 	logReady = true
+}
+
+// Apply log settings from config
+func setLogConfig(cfg *serverConfig) error {
+	minLevel, err := parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	subLevels := map[string]LOGLEVEL{}
+	for sub, levelName := range cfg.LogLevels {
+		level, err := parseLogLevel(levelName)
+		if err != nil {
+			return fmt.Errorf("%v: %v", sub, err)
+		}
+		subLevels[sub] = level
+	}
+
+	logFiltLock.Lock()
+	defer logFiltLock.Unlock()
+
+	logCfgMin = minLevel
+	logCfgSubs = subLevels
+	updateLogFilters()
+	logJSON = strings.EqualFold(cfg.LogFormat, "json")
+	logMaxSize = int64(cfg.LogMaxSizeMB) * 1024 * 1024
+	return nil
+}
 
+// Config filters with runtime changes on top, logFiltLock must be held
+func updateLogFilters() {
+	logMinLevel = logCfgMin
+	logSubLevels = map[string]LOGLEVEL{}
+	if logSetAll != nil {
+		logMinLevel = *logSetAll
+	} else {
+		for sub, level := range logCfgSubs {
+			logSubLevels[sub] = level
+		}
+	}
+	for sub, level := range logSetSubs {
+		logSubLevels[sub] = level
+	}
+}
+
+// Change a filter at runtime, sub "all" sets the default and clears overrides
+func setLogLevel(sub string, level LOGLEVEL) {
+	logFiltLock.Lock()
+	defer logFiltLock.Unlock()
+
+	if sub == "all" {
+		logSetAll = &level
+		logSetSubs = map[string]LOGLEVEL{}
+	} else {
+		logSetSubs[sub] = level
+	}
+	updateLogFilters()
+}
+
+// Drop runtime changes, back to the filters in config
+func resetLogLevels() {
+	logFiltLock.Lock()
+	defer logFiltLock.Unlock()
+
+	logSetAll = nil
+	logSetSubs = map[string]LOGLEVEL{}
+	updateLogFilters()
+}
+
+// Current filters, for display
+func getLogLevels() string {
+	logFiltLock.RLock()
+	defer logFiltLock.RUnlock()
+
+	out := []string{"all=" + logLevelNames[logMinLevel]}
+	for sub, level := range logSubLevels {
+		out = append(out, sub+"="+logLevelNames[level])
+	}
+	return strings.Join(out, ", ")
+}
+
+func parseLogLevel(name string) (LOGLEVEL, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return LOG_INFO, fmt.Errorf("unknown log level: %v", name)
 }
@@ -0,0 +1,143 @@
+package main
+
+import "fmt"
+
+// Knock a player or creature down, they stay there until healed or they bleed out
+func downPlayer(player *playerData) {
+	defer reportPanic("downPlayer")
+
+	//Set as injured and stop current movement
+	setEffect(player, EFFECT_INJURED)
+	player.dir = DIR_NONE
+	player.moveDir = DIR_NONE
+	player.downedTick = gameTick
+
+	if player.creatureData == nil {
+		logInfo(SUB_COMBAT, "%v (%v) is injured", player.name, player.id)
+		send_chat(fmt.Sprintf("%v is injured!", player.name))
+		endDuel(player, true)
+	}
+
+	//Make health negative, so they can't be revived instantly
+	player.health -= 50
+}
+
+// Called every tick for players, respawns them if nobody revived them in time
+func processDowned(player *playerData) {
+	if player.creatureData != nil || !hasEffects(player, EFFECT_INJURED) {
+		return
+	}
+
+	if gameTick-player.downedTick > bleedOutTicks {
+		logInfo(SUB_COMBAT, "%v (%v) bled out", player.name, player.id)
+		writeToPlayer(player, CMD_Chat, []byte("You bled out."))
+		respawnPlayer(player)
+	}
+}
+
+// Move a downed player to their respawn point, with a health penalty
+func respawnPlayer(player *playerData) {
+	defer reportPanic("respawnPlayer")
+
+	if player == nil || player.area == nil {
+		return
+	}
+
+	//Drop everything we were doing
+	for player.numTargets > 0 {
+		removeTarget(player, player.targets[0].target)
+	}
+	removeEffect(player, EFFECT_INJURED|EFFECT_HEAL|EFFECT_HEALER|EFFECT_ATTACK)
+	player.moveDir = DIR_NONE
+	player.dir = DIR_S
+	player.health = respawnHealth
+
+	area, pos := getRespawnPoint(player)
+
+	if area != player.area {
+		removePlayerWorld(player.area, player.pos, player)
+		player.area = area
+		player.pos = pos
+		addPlayerToWorld(area, pos, player)
+		player.visCache = make(map[XY]*visCacheData)
+		player.numVis = 0
+	} else {
+		movePlayerChunk(area, pos, player)
+	}
+	clearPosHistory(player)
+
+	for !movePlayer(player, true) {
+		tryPos := XYf32{X: pos.X + float32(halfArea-simRand.Intn(spawnArea)),
+			Y: pos.Y + float32(halfArea-simRand.Intn(spawnArea))}
+		movePlayerChunk(player.area, tryPos, player)
+		logDebug(SUB_WORLD, "Respawn blocked... Trying again.")
+	}
+
+	writeToPlayer(player, CMD_Chat, []byte("You have respawned."))
+}
+
+// Bound respawn point if it still exists, otherwise the area default
+func getRespawnPoint(player *playerData) (*areaData, XYf32) {
+	if player.bindArea != nil {
+		if findWorldObject(player.bindArea, player.bindPos, respawnSection) != nil {
+			return player.bindArea, floatXY(&player.bindPos)
+		}
+		writeToPlayer(player, CMD_Chat, []byte("Your respawn point is gone."))
+		player.bindArea = nil
+	}
+
+	return player.area, XYf32{X: float32(halfArea - simRand.Intn(spawnArea)),
+		Y: float32(halfArea - simRand.Intn(spawnArea))}
+}
+
+// Find the closest respawn point in range and bind the player to it
+func bindRespawn(player *playerData) bool {
+	var closest *worldObject
+	var closestDist float64 = bindDistance + 1
+
+	intPos := floorXY(&player.pos)
+	for x := -1; x <= 1; x++ {
+		for y := -1; y <= 1; y++ {
+			chunkPos := XY{X: uint32(int(intPos.X/chunkDiv) + x),
+				Y: uint32(int(intPos.Y/chunkDiv) + y)}
+			chunk := player.area.Chunks[chunkPos]
+			if chunk == nil {
+				continue
+			}
+
+			for _, obj := range chunk.WorldObjects {
+				if obj.ID.Section != respawnSection {
+					continue
+				}
+				dist := distanceInt(obj.Pos, intPos)
+				if dist < closestDist {
+					closestDist = dist
+					closest = obj
+				}
+			}
+		}
+	}
+
+	if closest == nil {
+		return false
+	}
+
+	player.bindArea = player.area
+	player.bindPos = closest.Pos
+	return true
+}
+
+// Find a world object of a section at an exact position
+func findWorldObject(area *areaData, pos XY, section uint8) *worldObject {
+	chunk := getChunk(area, pos)
+	if chunk == nil {
+		return nil
+	}
+
+	for _, obj := range chunk.WorldObjects {
+		if obj.ID.Section == section && samePos(obj.Pos, pos) {
+			return obj
+		}
+	}
+	return nil
+}
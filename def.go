@@ -1,7 +1,9 @@
 package main
 
+import "goMMOServ/protocol"
+
 var (
-	protoVersion uint16 = 19
+	protoVersion uint16 = protocol.Version
 	worldCenter  XY     = XY{X: xyCenter, Y: xyCenter}
 )
 
@@ -12,10 +14,21 @@ const (
 	xyCenter = 2147483648
 	xyMax    = xyCenter * 2
 
-	FrameSpeedNS = 133333333
-	chunkDiv     = 128
-	searchChunks = 6
-	lagThresh    = 8
+	chunkDiv  = protocol.ChunkSize
+	lagThresh = 8
+
+	bleedOutTicks  = 450 //~60 seconds
+	respawnSection = 5   //World objects players can bind to
+	bindDistance   = 64
+)
+
+// Set from config
+var (
+	FrameSpeedNS int64 = 133333333
+	searchChunks       = 6
+
+	//Health a player comes back with after bleeding out
+	respawnHealth int16 = 50
 )
 
 type PMode uint8
@@ -53,6 +66,16 @@ const (
 	EFFECT_INJURED
 )
 
+// PvP rules for an area or a zone within it
+type ZONE uint8
+
+const (
+	ZONE_FLAGGED ZONE = iota //Only players who both have /pvp on
+	ZONE_SAFE                //No PvP at all, not even duels
+	ZONE_PVP                 //Everyone can attack everyone
+	ZONE_DUEL                //Only accepted duels
+)
+
 type CRE uint8
 
 const (
@@ -62,41 +85,36 @@ const (
 	CRE_SLEEP
 )
 
-// Network commands
-type CMD uint8
+// Network commands, the wire format lives in the protocol package
+type CMD = protocol.CMD
 
 const (
-	CMD_Init CMD = iota
-	CMD_Login
-	CMD_Play
-	CMD_Move
-	CMD_WorldUpdate
-	CMD_Chat
-	CMD_Command
-	CMD_PlayerMode
-
-	CMD_WorldData
-	CMD_PlayerNamesComp
-	CMD_EditPlaceItem
-	CMD_EditDeleteItem
+	CMD_Init            = protocol.CMD_Init
+	CMD_Login           = protocol.CMD_Login
+	CMD_Play            = protocol.CMD_Play
+	CMD_Move            = protocol.CMD_Move
+	CMD_WorldUpdate     = protocol.CMD_WorldUpdate
+	CMD_Chat            = protocol.CMD_Chat
+	CMD_Command         = protocol.CMD_Command
+	CMD_PlayerMode      = protocol.CMD_PlayerMode
+	CMD_WorldData       = protocol.CMD_WorldData
+	CMD_PlayerNamesComp = protocol.CMD_PlayerNamesComp
+	CMD_EditPlaceItem   = protocol.CMD_EditPlaceItem
+	CMD_EditDeleteItem  = protocol.CMD_EditDeleteItem
+	CMD_EditSetZone     = protocol.CMD_EditSetZone
+	CMD_EditDeleteZone  = protocol.CMD_EditDeleteZone
+	CMD_PartyUpdate     = protocol.CMD_PartyUpdate
+	CMD_Ping            = protocol.CMD_Ping
+	CMD_Pong            = protocol.CMD_Pong
+	CMD_Session         = protocol.CMD_Session
+	CMD_Resume          = protocol.CMD_Resume
+	CMD_WorldUpdateComp = protocol.CMD_WorldUpdateComp
+	CMD_Dictionary      = protocol.CMD_Dictionary
+	CMD_ChatFrom        = protocol.CMD_ChatFrom
 )
 
 // Used for debug messages, this could be better
-var cmdNames map[CMD]string
-
-func init() {
-	cmdNames = make(map[CMD]string)
-	cmdNames[CMD_Init] = "CMD_Init"
-	cmdNames[CMD_Login] = "CMD_Login"
-	cmdNames[CMD_Play] = "CMD_Play"
-	cmdNames[CMD_Move] = "CMD_Move"
-	cmdNames[CMD_WorldUpdate] = "CMD_WorldUpdate"
-	cmdNames[CMD_Chat] = "CMD_Chat"
-	cmdNames[CMD_Command] = "CMD_Command"
-	cmdNames[CMD_PlayerMode] = "CMD_PlayerMode"
-
-	cmdNames[CMD_WorldData] = "CMD_WorldData"
-	cmdNames[CMD_PlayerNamesComp] = "CMD_PlayerNamesComp"
-	cmdNames[CMD_EditPlaceItem] = "CMD_EditPlaceItem"
-	cmdNames[CMD_EditDeleteItem] = "CMD_EditDeleteItem"
-}
+var cmdNames = protocol.CmdNames
+
+// Optional protocol features this server implements
+var serverCaps = protocol.CAP_COMPRESS_ZLIB | protocol.CAP_COMPRESS_DEFLATE | protocol.CAP_PACKED_RECORDS
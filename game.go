@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"math"
 	"math/rand"
@@ -11,6 +10,8 @@ import (
 	"sync/atomic"
 	"time"
 
+	"goMMOServ/protocol"
+
 	"github.com/remeh/sizedwaitgroup"
 	"github.com/twpayne/go-geom"
 	"github.com/twpayne/go-geom/xy"
@@ -18,6 +19,9 @@ import (
 
 var processLock sync.RWMutex
 
+// Randomness used by the simulation, processLock must be held. Tests seed it.
+var simRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
 const playerSize = 24
 const grace = 10
 const searchSize = 2
@@ -74,13 +78,13 @@ func radiansToDirection(in float64) DIR {
 	defer reportPanic("radiansToDirection")
 
 	rads := math.Mod(in+offset, twoPi)
+	if rads < 0 {
+		rads += twoPi
+	}
 	normal := (rads / twoPi) * 100.0
 
-	//Lame hack, TODO FIXME
-	if normal < 0 {
-		normal = 87.5
-	}
-	amount := int(math.Round(normal / 12.5))
+	//Wrap the top of the circle back around to south
+	amount := int(math.Round(normal/12.5)) % 8
 	return DIR(amount)
 }
 
@@ -165,38 +169,49 @@ func affect(player *playerData) {
 		removeEffect(player, EFFECT_ATTACK)
 	}
 
+	//Party members get healed first
+	if player.mode == PMODE_HEAL && player.numTargets > 1 {
+		sortHealTargets(player)
+	}
+
 	//Check all our targets
 	for p, t := range player.targets {
 		//If either player has left the game...
 		//Or we are injured, or the target is too far away... remove effects
 		if !player.VALID || !t.target.VALID ||
+			(t.target.creatureData != nil && t.target.creatureData.defeated) ||
 			hasEffects(player, EFFECT_INJURED) ||
-			distanceFloat(player.pos, t.target.pos) > playerSize+grace {
+			!inReach(player, t.target) {
 			removeTarget(player, t.target)
 			continue
 		}
 
 		if player.mode == PMODE_ATTACK { //ATTACKING
 
+			//Check PvP rules, zones can change as we move
+			if !canAttack(player, t.target) {
+				removeTarget(player, t.target)
+				continue
+			}
+
 			//If the player is not injured, damage them... if correct interval
 			if !hasEffects(t.target, EFFECT_INJURED) {
 				if gameTick%6 == 0 {
 					if t.target.creatureData != nil {
+						addAttacker(t.target, player)
 						t.target.health -= 24
 					} else {
 						t.target.health -= 6
 					}
 				}
 
-				//If their health goes to 0, set as injured and stop current movement
-				//Make health negative, so they can't be revived instantly
+				//If their health goes to 0, knock them down
 				if t.target.health < 1 {
-					setEffect(t.target, EFFECT_INJURED)
-					t.target.dir = DIR_NONE
-					if t.target.creatureData == nil {
-						send_chat(fmt.Sprintf("%v is injured!", t.target.name))
+					if t.target.creatureData != nil {
+						defeatCreature(t.target, player)
+					} else {
+						downPlayer(t.target)
 					}
-					t.target.health -= 50
 
 				} else {
 					//Otherwise, start our attack animation
@@ -216,7 +231,7 @@ func affect(player *playerData) {
 				removeEffect(t.target, EFFECT_INJURED)
 			}
 			//If their health isn't full yet
-			if t.target.health < 100 {
+			if t.target.health < t.target.maxHealth {
 				//Increase health every other tick
 				if gameTick%2 == 0 {
 					t.target.health++
@@ -241,20 +256,22 @@ func affect(player *playerData) {
 // Adds to list, applies effects
 // Does not add to list (or apply effects) if already in list.
 func addTarget(player, newTarget *playerData, selfEffects, targetEffects EFF) {
-	found := false
+	//Don't target players we aren't allowed to attack
+	if player.mode == PMODE_ATTACK && !canAttack(player, newTarget) {
+		return
+	}
+
 	for _, t := range player.targets {
-		if t.target.id == newTarget.id {
+		if t.target == newTarget {
 			return
 		}
-		found = true
-	}
-	if !found {
-		setEffect(player, selfEffects)
-		setEffect(newTarget, targetEffects)
-		player.targets = append(player.targets,
-			&targetingData{target: newTarget, selfEffects: selfEffects, targetEffects: targetEffects})
-		player.numTargets++
 	}
+
+	setEffect(player, selfEffects)
+	setEffect(newTarget, targetEffects)
+	player.targets = append(player.targets,
+		&targetingData{target: newTarget, selfEffects: selfEffects, targetEffects: targetEffects})
+	player.numTargets++
 }
 
 // Removes target and removes effects
@@ -300,7 +317,7 @@ var gameTick uint64 = 1
 func processGame() {
 
 	go func() {
-		//defer reportPanic("processGame goroutine")
+		defer reportPanic("processGame goroutine")
 		time.Sleep(time.Second)
 
 		//sized wait group, number of available threads
@@ -311,207 +328,12 @@ func processGame() {
 			gameTick++
 			loopStart := time.Now()
 
-			var outsize atomic.Uint32
-			processLock.Lock()
-			if numPlayers > 0 {
-
-				//Move player
-				for _, player := range playerList {
-					if player.health < 100 && player.health > 0 {
-						if gameTick%30 == 0 {
-							player.health++
-						}
-					}
-					if player.moveDir != DIR_NONE {
-						if int(gameTick)-int(player.lastDirUpdate) > lagThresh {
-							player.moveDir = DIR_NONE
-						}
-						movePlayer(player, false)
-					}
-					affect(player)
-				}
-
-				//Move creature
-				for _, area := range areaList {
-					for _, chunk := range area.Chunks {
-						for _, creature := range chunk.creatrues {
-							if creature.creatureData.id.Section == 7 && //Creatures
-								creature.creatureData.id.Num == 0 { //Zombie
-
-								if creature.health < 100 { //Passive heal
-									if gameTick%15 == 0 {
-										creature.health++
-
-										//If the creature is injured, but their health is now above zero... Remove injured effect
-										if hasEffects(creature, EFFECT_INJURED) && creature.health > 0 {
-											removeEffect(creature, EFFECT_INJURED)
-										}
-									}
-								}
-							}
-							creature.moveDir = moveCreature(creature)
-							if creature.moveDir != DIR_NONE {
-								creature.dir = creature.moveDir
-							}
-
-							if creature.dir != DIR_NONE {
-								movePlayer(creature, false)
-							}
-							affect(creature)
-						}
-					}
-				}
-
-				//Serialize data for transfer / cache
-				//THREADED
-				for _, player := range playerList {
-
-					wg.Add()
-					go func(player *playerData) {
-						var playerBytes, objectBytes, creatureBytes []byte
-						var playerRecords, objectRecords, creatureRecords uint8
-
-						playerBuf := bytes.NewBuffer(playerBytes)
-						objectBuf := bytes.NewBuffer(objectBytes)
-						creatureBuf := bytes.NewBuffer(creatureBytes)
-
-						//Search surrounding chunks
-						for x := -searchChunks; x < searchChunks; x++ {
-							for y := -searchChunks; y < searchChunks; y++ {
-
-								//Calc chunk pos
-								intPos := floorXY(&player.pos)
-								chunkPos := XY{X: uint32(int(intPos.X/chunkDiv) + x), Y: uint32(int(intPos.Y/chunkDiv) + y)}
-								chunk := player.area.Chunks[chunkPos]
-
-								if chunk == nil {
-									continue
-								}
-
-								var pBytes, oBytes, cBytes []byte
-								pBuf := bytes.NewBuffer(pBytes)
-								oBuf := bytes.NewBuffer(oBytes)
-								cBuf := bytes.NewBuffer(cBytes)
-
-								//PLAYERS
-								//Use cache if found (chunk that two players can see)
-								if chunk.pCacheTick == gameTick {
-									pBuf.Write(chunk.playerCache)
-									playerRecords += chunk.numPlayers
-								} else {
-									//Write players
-									for _, target := range chunk.players {
-
-										//17 bytes with header
-										nx := uint32(xyCenter - int(target.pos.X))
-										ny := uint32(xyCenter - int(target.pos.Y))
-										binary.Write(pBuf, binary.LittleEndian, &target.id)
-										binary.Write(pBuf, binary.LittleEndian, &nx)
-										binary.Write(pBuf, binary.LittleEndian, &ny)
-										binary.Write(pBuf, binary.LittleEndian, &target.dir)
-										binary.Write(pBuf, binary.LittleEndian, &target.health)
-										binary.Write(pBuf, binary.LittleEndian, &target.effects)
-										playerRecords++
-									}
-									chunk.playerCache = pBuf.Bytes()
-									chunk.pCacheTick = gameTick
-								}
-								playerBuf.Write(pBuf.Bytes())
-
-								/* WORLD OBJECTS */
-								/* Check if player needs this data or not, static objects */
-								if player.visCache[chunkPos] == nil {
-									addVis(player, chunkPos)
-
-									//Use cache if found
-									if chunk.hasOcache {
-										oBuf.Write(chunk.objectCache)
-										objectRecords += chunk.numWorldObjects
-									} else {
-										for _, obj := range chunk.WorldObjects {
-
-											//12 bytes with header
-											binary.Write(oBuf, binary.LittleEndian, obj.ID.Section)
-											binary.Write(oBuf, binary.LittleEndian, obj.ID.Num)
-											binary.Write(oBuf, binary.LittleEndian, obj.ID.Sprite)
-											binary.Write(oBuf, binary.LittleEndian, obj.Pos.X)
-											binary.Write(oBuf, binary.LittleEndian, obj.Pos.Y)
-											objectRecords++
-										}
-										chunk.objectCache = oBuf.Bytes()
-										chunk.hasOcache = true
-									}
-									objectBuf.Write(oBuf.Bytes())
-								}
-
-								/* CREATURES */
-								//Use cache if found
-								if uint64(chunk.cCacheTick) == gameTick {
-									cBuf.Write(chunk.creatureCache)
-								} else {
-									for _, cre := range chunk.creatrues {
-										//19 bytes with header
-										nx := uint32(xyCenter - int(cre.pos.X))
-										ny := uint32(xyCenter - int(cre.pos.Y))
-										binary.Write(cBuf, binary.LittleEndian, &cre.creatureData.id.UID)
-										binary.Write(cBuf, binary.LittleEndian, &cre.creatureData.id.Section)
-										binary.Write(cBuf, binary.LittleEndian, &cre.creatureData.id.Num)
-										binary.Write(cBuf, binary.LittleEndian, &nx)
-										binary.Write(cBuf, binary.LittleEndian, &ny)
-										binary.Write(cBuf, binary.LittleEndian, &cre.dir)
-										binary.Write(cBuf, binary.LittleEndian, &cre.health)
-										binary.Write(cBuf, binary.LittleEndian, &cre.effects)
-									}
-									chunk.creatureCache = cBuf.Bytes()
-									chunk.cCacheTick = gameTick
-								}
-								creatureRecords += chunk.numCreatures
-								creatureBuf.Write(cBuf.Bytes())
-
-							}
-						}
-
-						// Write size headers
-						var pcountBytes, ocountBytes, cCountBuf []byte
-						pcountBuf := bytes.NewBuffer(pcountBytes)
-						ocountBuf := bytes.NewBuffer(ocountBytes)
-						ccountBuf := bytes.NewBuffer(cCountBuf)
-						binary.Write(pcountBuf, binary.LittleEndian, &playerRecords)
-						binary.Write(ocountBuf, binary.LittleEndian, &objectRecords)
-						binary.Write(ccountBuf, binary.LittleEndian, &creatureRecords)
-
-						//Combine everything.
-						var outbytes []byte
-						outbuf := bytes.NewBuffer(outbytes)
-						outbuf.Write(pcountBuf.Bytes())
-						outbuf.Write(playerBuf.Bytes())
-						outbuf.Write(ocountBuf.Bytes())
-						outbuf.Write(objectBuf.Bytes())
-						outbuf.Write(ccountBuf.Bytes())
-						outbuf.Write(creatureBuf.Bytes())
-
-						outsize.Add(uint32(outbuf.Len()))
-						writeToPlayer(player, CMD_WorldUpdate, outbuf.Bytes())
-
-						wg.Done()
-					}(player)
-
-				}
-				wg.Wait()
-
-				//Bandwidth use
-				if gameTick%150 == 0 {
-					//Show bandwidth use
-					if gTestMode && numConnections.Load() > 0 {
-						fmt.Printf("Out: %0.2f mbit\n", float32(outsize.Load())*15.0/1024.0/1024.0)
-					}
-				}
-			}
-			processLock.Unlock()
+			runTick(&wg)
 
 			//Calculate remaining frame time
 			took := time.Since(loopStart)
-			remaining := (time.Nanosecond * FrameSpeedNS) - took
+			tickHistogram[PHASE_TOTAL].observe(took)
+			remaining := (time.Nanosecond * time.Duration(FrameSpeedNS)) - took
 
 			//Sleep if there is remaining frame time
 			if remaining > 0 {
@@ -526,7 +348,8 @@ func processGame() {
 
 			} else {
 				//Log we are slower than real-time
-				doLog(true, "Tick: %v: Unable to keep up: took: %v", gameTick, took.Round(time.Millisecond))
+				ticksBehind.Add(1)
+				logWarn(SUB_WORLD, "Tick: %v: Unable to keep up: took: %v", gameTick, took.Round(time.Millisecond))
 			}
 
 		}
@@ -546,13 +369,15 @@ func processGame() {
 			pid := makePlayerID()
 			player := &playerData{
 				id: pid, name: fmt.Sprintf("Player-%v", pid), pos: startLoc, area: areaList[0],
-				health: 100, dir: DIR_N, moveDir: DIR_NONE, lastDirUpdate: gameTick + 9000, VALID: true, visCache: make(map[XY]*visCacheData)}
+				dir: DIR_N, moveDir: DIR_NONE, lastDirUpdate: gameTick + 9000, VALID: true, visCache: make(map[XY]*visCacheData)}
+			setLevel(player, 1)
+			player.health = player.maxHealth
 
 			for !movePlayer(player, true) {
 				tryPos := XYf32{X: float32(halfArea - rand.Intn(spawnArea)),
 					Y: float32(halfArea - rand.Intn(spawnArea))}
 				movePlayerChunk(player.area, tryPos, player)
-				fmt.Println("Spawn blocked... Trying again.")
+				logDebug(SUB_WORLD, "Spawn blocked... Trying again.")
 			}
 
 			playerListLock.Lock()
@@ -571,6 +396,12 @@ func processGame() {
 					if chunk.pCacheTick < gameTick {
 						area.Chunks[c].playerCache = []byte{}
 					}
+					if chunk.ppCacheTick < gameTick {
+						area.Chunks[c].packedPlayers = nil
+					}
+					if chunk.pcCacheTick < gameTick {
+						area.Chunks[c].packedCreatures = nil
+					}
 				}
 			}
 			processLock.Unlock()
@@ -704,12 +535,19 @@ func addWorldObject(area *areaData, pos XY, wObject *worldObject) {
 	chunk.numWorldObjects++
 
 	//Remove byte caches
-	chunk.objectCache = []byte{}
-	chunk.hasOcache = false
+	clearObjectCache(chunk)
 
 	removeVisCache(area, pos)
 }
 
+// Objects changed, both the plain and packed records need rebuilding
+func clearObjectCache(chunk *chunkData) {
+	chunk.objectCache = []byte{}
+	chunk.hasOcache = false
+	chunk.packedObjects = nil
+	chunk.hasPackedOcache = false
+}
+
 func removeVisCache(area *areaData, pos XY) {
 	chunkPos := XY{X: uint32(int(pos.X / chunkDiv)),
 		Y: uint32(int(pos.Y / chunkDiv))}
@@ -722,7 +560,7 @@ func removeVisCache(area *areaData, pos XY) {
 
 		if player.visCache[chunkPos] != nil {
 			delete(player.visCache, chunkPos)
-			doLog(true, "addWorldObject: Removed from visCache for player %v", player.name)
+			logDebug(SUB_WORLD, "addWorldObject: Removed from visCache for player %v", player.name)
 		}
 	}
 }
@@ -749,16 +587,14 @@ func removeWorldObject(area *areaData, pos XY, id IID) {
 			if chunk.numWorldObjects == 1 {
 				chunk.WorldObjects = []*worldObject{}
 				chunk.numWorldObjects = 0
-				chunk.objectCache = []byte{}
-				chunk.hasOcache = false
+				clearObjectCache(chunk)
 				return
 			}
 
 			chunk.WorldObjects[i] = chunk.WorldObjects[chunk.numWorldObjects-1]
 			chunk.WorldObjects = chunk.WorldObjects[:chunk.numWorldObjects-1]
 			chunk.numWorldObjects--
-			chunk.objectCache = []byte{}
-			chunk.hasOcache = false
+			clearObjectCache(chunk)
 			break
 		}
 	}
@@ -816,3 +652,286 @@ func assignChunk(area *areaData, pos XY, chunk *chunkData) *chunkData {
 
 	return chunk
 }
+
+// One game tick, a panic is reported and the next tick runs as normal
+func runTick(wg *sizedwaitgroup.SizedWaitGroup) {
+	processLock.Lock()
+	defer processLock.Unlock()
+	defer reportPanic("tick %v", gameTick)
+
+	//Remove anything that panicked last tick
+	processIsolated()
+
+	if numPlayers > 0 {
+		simulateTick()
+
+		phaseStart := time.Now()
+		outsize := serializeTick(wg)
+		tickHistogram[PHASE_SERIALIZE].observe(time.Since(phaseStart))
+
+		//Party frames
+		if gameTick%partyUpdateTicks == 0 {
+			sendAllPartyUpdates()
+		}
+
+		if gameTick%pingTicks == 0 {
+			sendPings()
+		}
+		if gameTick%sessionCheckTicks == 0 {
+			expireSessions()
+		}
+
+		//Bandwidth use
+		if gameTick%150 == 0 {
+			//Show bandwidth use
+			if gTestMode && numConnections.Load() > 0 {
+				fmt.Printf("Out: %0.2f mbit\n", float32(outsize)*15.0/1024.0/1024.0)
+			}
+		}
+	}
+}
+
+// Move, fight and heal everything in the world for one tick. No timers or sockets,
+// so tests can step the world directly. processLock must be held.
+func simulateTick() {
+	phaseStart := time.Now()
+
+	//Move player
+	for _, player := range playerList {
+		func() {
+			defer recoverEntity(player, "tickPlayer")
+
+			applyInput(player)
+			if player.health < player.maxHealth && player.health > 0 {
+				if gameTick%30 == 0 {
+					player.health++
+				}
+			}
+			if player.moveDir != DIR_NONE {
+				//Give laggy players longer before we stop them
+				if int(gameTick)-int(player.lastDirUpdate) > lagThresh+lagTicks(player) {
+					player.moveDir = DIR_NONE
+				}
+				movePlayer(player, false)
+			}
+			recordPos(player)
+			affect(player)
+			processDowned(player)
+			pickupLoot(player)
+		}()
+	}
+
+	tickHistogram[PHASE_PLAYERS].observe(time.Since(phaseStart))
+	phaseStart = time.Now()
+
+	//Move creature
+	for _, area := range areaList {
+		for _, chunk := range area.Chunks {
+			for _, creature := range chunk.creatrues {
+				func() {
+					defer recoverEntity(creature, "tickCreature")
+
+					if creature.creatureData.id.Section == 7 && //Creatures
+						creature.creatureData.id.Num == 0 { //Zombie
+
+						//Passive heal, defeated creatures are removed instead
+						if creature.health < creature.maxHealth && creature.health > 0 {
+							if gameTick%15 == 0 {
+								creature.health++
+							}
+						}
+					}
+					creature.moveDir = moveCreature(creature)
+					if creature.moveDir != DIR_NONE {
+						creature.dir = creature.moveDir
+					}
+
+					if creature.dir != DIR_NONE {
+						movePlayer(creature, false)
+					}
+					recordPos(creature)
+					affect(creature)
+				}()
+			}
+		}
+	}
+
+	//Remove defeated creatures and old loot
+	processDefeats()
+	respawnCreatures()
+	despawnLoot()
+
+	tickHistogram[PHASE_CREATURES].observe(time.Since(phaseStart))
+}
+
+// Build this tick's records for every chunk someone will be sent. Players
+// near each other share chunks, so building them in the serialize goroutines
+// would have several writing the same cache. processLock must be held.
+func buildChunkCaches() {
+	for _, player := range playerList {
+		if player.conn == nil {
+			continue
+		}
+
+		packed := wantsPacked(player)
+		intPos := floorXY(&player.pos)
+		for x := -searchChunks; x < searchChunks; x++ {
+			for y := -searchChunks; y < searchChunks; y++ {
+				chunkPos := XY{X: uint32(int(intPos.X/chunkDiv) + x), Y: uint32(int(intPos.Y/chunkDiv) + y)}
+				chunk := player.area.Chunks[chunkPos]
+				if chunk == nil {
+					continue
+				}
+
+				if packed {
+					cachePackedChunk(chunk, chunkPos)
+				} else {
+					cacheChunk(chunk)
+				}
+			}
+		}
+	}
+}
+
+// Plain records for a chunk, players and creatures each tick, objects until they change
+func cacheChunk(chunk *chunkData) {
+	if chunk.pCacheTick != gameTick {
+		var pBuf []byte
+		for _, target := range chunk.players {
+			pBuf = protocol.AppendPlayerRecord(pBuf, &protocol.PlayerRecord{ID: target.id,
+				X: uint32(xyCenter - int(target.pos.X)), Y: uint32(xyCenter - int(target.pos.Y)),
+				Dir: uint8(target.dir), Health: target.health, Effects: uint8(target.effects)})
+		}
+		chunk.playerCache = pBuf
+		chunk.pCacheTick = gameTick
+	}
+
+	if !chunk.hasOcache {
+		var oBuf []byte
+		for _, obj := range chunk.WorldObjects {
+			oBuf = protocol.AppendObjectRecord(oBuf, &protocol.ObjectRecord{Section: obj.ID.Section,
+				Num: obj.ID.Num, Sprite: obj.ID.Sprite, X: obj.Pos.X, Y: obj.Pos.Y})
+		}
+		chunk.objectCache = oBuf
+		chunk.hasOcache = true
+	}
+
+	if uint64(chunk.cCacheTick) != gameTick {
+		var cBuf []byte
+		for _, cre := range chunk.creatrues {
+			cBuf = protocol.AppendCreatureRecord(cBuf, &protocol.CreatureRecord{UID: cre.creatureData.id.UID,
+				Section: cre.creatureData.id.Section, Num: cre.creatureData.id.Num,
+				X: uint32(xyCenter - int(cre.pos.X)), Y: uint32(xyCenter - int(cre.pos.Y)),
+				Dir: uint8(cre.dir), Health: cre.health, Effects: uint8(cre.effects)})
+		}
+		chunk.creatureCache = cBuf
+		chunk.cCacheTick = gameTick
+	}
+}
+
+// Build and send each player's world update, returns total bytes sent
+func serializeTick(wg *sizedwaitgroup.SizedWaitGroup) uint32 {
+	var outsize atomic.Uint32
+
+	//Shared per chunk records, the goroutines below only read them
+	buildChunkCaches()
+
+	//Serialize data for transfer
+	//THREADED
+	for _, player := range playerList {
+		//Waiting to resume, nothing to send to
+		if player.conn == nil {
+			continue
+		}
+
+		wg.Add()
+		go func(player *playerData) {
+			defer wg.Done()
+			defer recoverEntity(player, "serialize")
+
+			var playerBytes, objectBytes, creatureBytes []byte
+			var playerRecords, objectRecords, creatureRecords uint8
+
+			playerBuf := bytes.NewBuffer(playerBytes)
+			objectBuf := bytes.NewBuffer(objectBytes)
+			creatureBuf := bytes.NewBuffer(creatureBytes)
+
+			packed := wantsPacked(player)
+			var packedBuf []byte
+			var packedChunks uint16
+
+			//Search surrounding chunks
+			for x := -searchChunks; x < searchChunks; x++ {
+				for y := -searchChunks; y < searchChunks; y++ {
+
+					//Calc chunk pos
+					intPos := floorXY(&player.pos)
+					chunkPos := XY{X: uint32(int(intPos.X/chunkDiv) + x), Y: uint32(int(intPos.Y/chunkDiv) + y)}
+					chunk := player.area.Chunks[chunkPos]
+
+					if chunk == nil {
+						continue
+					}
+
+					if packed {
+						if block := packChunk(player, chunk, chunkPos, x, y); block != nil {
+							packedBuf = append(packedBuf, block...)
+							packedChunks++
+						}
+						continue
+					}
+
+					//PLAYERS
+					playerBuf.Write(chunk.playerCache)
+					playerRecords += chunk.numPlayers
+
+					/* WORLD OBJECTS */
+					/* Check if player needs this data or not, static objects */
+					if player.visCache[chunkPos] == nil {
+						addVis(player, chunkPos)
+						objectBuf.Write(chunk.objectCache)
+						objectRecords += chunk.numWorldObjects
+					}
+
+					/* CREATURES */
+					creatureBuf.Write(chunk.creatureCache)
+					creatureRecords += chunk.numCreatures
+
+				}
+			}
+
+			self := &protocol.SelfState{Ack: player.inputSeq, X: uint32(xyCenter - int(player.pos.X)),
+				Y: uint32(xyCenter - int(player.pos.Y)), Dir: uint8(player.moveDir)}
+			var outbuf []byte
+			if packed {
+				outbuf = protocol.JoinPackedUpdate(self, packedChunks, packedBuf)
+			} else {
+				outbuf = protocol.JoinWorldUpdate(player.protoVersion, self, playerRecords, playerBuf.Bytes(),
+					objectRecords, objectBuf.Bytes(), creatureRecords, creatureBuf.Bytes())
+			}
+
+			outsize.Add(uint32(len(outbuf)))
+			if err := sendToPlayer(player, CMD_WorldUpdate, outbuf); err != nil {
+				logInfo(SUB_NET, "Error writing response: %v", err)
+				player.sendFailed = true
+			}
+		}(player)
+
+	}
+	wg.Wait()
+
+	//Dropping a player touches other players and playerList, so it waits
+	//until the goroutines are done
+	failed := []*playerData{}
+	for _, player := range playerList {
+		if player.sendFailed {
+			player.sendFailed = false
+			failed = append(failed, player)
+		}
+	}
+	for _, player := range failed {
+		disconnectPlayer(player, "connection lost")
+	}
+
+	return outsize.Load()
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestRadiansToDirection(t *testing.T) {
+	tests := []struct {
+		name string
+		in   float64
+		want DIR
+	}{
+		{"west", 0, DIR_W},
+		{"north west", math.Pi / 4, DIR_NW},
+		{"north", math.Pi / 2, DIR_N},
+		{"north east", math.Pi * 3 / 4, DIR_NE},
+		{"east", math.Pi, DIR_E},
+		{"east from below", -math.Pi + 0.01, DIR_E},
+		{"south east", -math.Pi * 3 / 4, DIR_SE},
+		{"south", -math.Pi / 2, DIR_S},
+		{"south from the east", -math.Pi/2 - 0.1, DIR_S},
+		{"south west", -math.Pi / 4, DIR_SW},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := radiansToDirection(tc.in); got != tc.want {
+				t.Errorf("radiansToDirection(%v) = %v, want %v", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+// Creatures chase with dirTo and walk with moveDir, they have to agree
+func TestDirToMatchesMoveDir(t *testing.T) {
+	for dir := DIR_S; dir < DIR_NONE; dir++ {
+		player := &playerData{pos: XYf32{X: 100, Y: -50}}
+		target := &playerData{pos: moveDir(player.pos, dir, 200)}
+
+		if got := dirTo(player, target); got != dir {
+			t.Errorf("dirTo towards %v = %v", dir, got)
+		}
+	}
+}
+
+func TestMovePlayerCollision(t *testing.T) {
+	tests := []struct {
+		name      string
+		obstacle  string //player, creature, wall or decoration
+		distance  float32
+		injured   bool
+		wantMoved bool
+		wantFight bool
+	}{
+		{name: "open ground", wantMoved: true},
+		{name: "player ahead", obstacle: "player", distance: 30, wantFight: true},
+		{name: "player far ahead", obstacle: "player", distance: 60, wantMoved: true},
+		{name: "creature ahead", obstacle: "creature", distance: 30, wantFight: true},
+		{name: "wall ahead", obstacle: "wall", distance: 50},
+		{name: "wall far ahead", obstacle: "wall", distance: 80, wantMoved: true},
+		{name: "decoration ahead", obstacle: "decoration", distance: 20, wantMoved: true},
+		{name: "injured", injured: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newTestWorld(t)
+			player := w.addPlayer(XYf32{X: 0, Y: 0})
+			player.pvpFlag = true
+			ahead := XYf32{X: 0, Y: tc.distance}
+
+			var other *playerData
+			switch tc.obstacle {
+			case "player":
+				other = w.addPlayer(ahead)
+				other.pvpFlag = true
+			case "creature":
+				other = w.addCreature(ahead, CRE_IDLE)
+			case "wall":
+				w.addObject(ahead, IID{Section: 3})
+			case "decoration":
+				w.addObject(ahead, IID{Section: 2})
+			}
+			if tc.injured {
+				setEffect(player, EFFECT_INJURED)
+			}
+
+			w.walk(player, DIR_N)
+			moved := movePlayer(player, false)
+
+			if moved != tc.wantMoved {
+				t.Fatalf("moved = %v, want %v", moved, tc.wantMoved)
+			}
+			wantPos := XYf32{X: 0, Y: 0}
+			if tc.wantMoved {
+				wantPos.Y = walkSpeed
+			}
+			if player.pos != wantPos {
+				t.Errorf("pos = %v, want %v", player.pos, wantPos)
+			}
+			if !w.inChunk(player) {
+				t.Errorf("player missing from their chunk")
+			}
+			if fighting := player.numTargets > 0; fighting != tc.wantFight {
+				t.Errorf("has target = %v, want %v", fighting, tc.wantFight)
+			}
+			if tc.wantFight && player.targets[0].target != other {
+				t.Errorf("targeted the wrong thing")
+			}
+		})
+	}
+}
+
+func TestCombat(t *testing.T) {
+	tests := []struct {
+		name         string
+		creature     bool
+		pvpFlags     bool
+		zone         ZONE
+		targetHealth int16
+		distance     float32
+		injured      bool
+		wantHealth   int16
+		wantTargeted bool
+		wantEffects  EFF
+	}{
+		{name: "hit creature", creature: true, distance: 20,
+			wantHealth: defaultMaxHealth - 24, wantTargeted: true, wantEffects: EFFECT_ATTACK},
+		{name: "hit flagged player", pvpFlags: true, distance: 20,
+			wantHealth: defaultMaxHealth - 6, wantTargeted: true, wantEffects: EFFECT_ATTACK},
+		{name: "unflagged players can't fight", distance: 20,
+			wantHealth: defaultMaxHealth},
+		{name: "pvp zone", zone: ZONE_PVP, distance: 20,
+			wantHealth: defaultMaxHealth - 6, wantTargeted: true, wantEffects: EFFECT_ATTACK},
+		{name: "safe zone", pvpFlags: true, zone: ZONE_SAFE, distance: 20,
+			wantHealth: defaultMaxHealth},
+		{name: "target out of range", creature: true, distance: playerSize + grace + 10,
+			wantHealth: defaultMaxHealth},
+		{name: "injured attacker", creature: true, distance: 20, injured: true,
+			wantHealth: defaultMaxHealth},
+		{name: "knock down player", pvpFlags: true, distance: 20, targetHealth: 6,
+			wantHealth: -50, wantTargeted: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newTestWorld(t)
+			if tc.zone != ZONE_FLAGGED {
+				addZone(w.area, tc.zone, image.Rect(xyCenter-500, xyCenter-500, xyCenter+500, xyCenter+500))
+			}
+
+			player := w.addPlayer(XYf32{X: 0, Y: 0})
+			var target *playerData
+			if tc.creature {
+				target = w.addCreature(XYf32{X: tc.distance, Y: 0}, CRE_IDLE)
+			} else {
+				target = w.addPlayer(XYf32{X: tc.distance, Y: 0})
+				target.mode = PMODE_PASSIVE
+			}
+			player.pvpFlag = tc.pvpFlags
+			target.pvpFlag = tc.pvpFlags
+			if tc.targetHealth != 0 {
+				target.health = tc.targetHealth
+			}
+			if tc.injured {
+				setEffect(player, EFFECT_INJURED)
+			}
+
+			addTarget(player, target, 0, 0)
+
+			//Damage lands once every 6 ticks
+			w.step(5)
+			if tc.targetHealth == 0 && target.health != defaultMaxHealth {
+				t.Fatalf("damage before the attack tick, health %v", target.health)
+			}
+			w.step(1)
+
+			if target.health != tc.wantHealth {
+				t.Errorf("health = %v, want %v", target.health, tc.wantHealth)
+			}
+			if targeted := player.numTargets > 0; targeted != tc.wantTargeted {
+				t.Errorf("targeted = %v, want %v", targeted, tc.wantTargeted)
+			}
+			if tc.wantEffects != 0 && !hasEffects(player, tc.wantEffects) {
+				t.Errorf("effects = %b, want %b", player.effects, tc.wantEffects)
+			}
+		})
+	}
+}
+
+func TestKnockedDownPlayerIsInjured(t *testing.T) {
+	w := newTestWorld(t)
+	player := w.addPlayer(XYf32{X: 0, Y: 0})
+	target := w.addPlayer(XYf32{X: 20, Y: 0})
+	player.pvpFlag, target.pvpFlag = true, true
+	target.mode = PMODE_PASSIVE
+	target.health = 6
+
+	addTarget(player, target, 0, 0)
+	w.step(6)
+
+	if !hasEffects(target, EFFECT_INJURED) {
+		t.Fatalf("target not injured, health %v", target.health)
+	}
+	w.walk(target, DIR_N)
+	w.step(1)
+	if target.pos != (XYf32{X: 20, Y: 0}) {
+		t.Errorf("injured player moved to %v", target.pos)
+	}
+}
+
+func TestDefeatCreature(t *testing.T) {
+	w := newTestWorld(t)
+	player := w.addPlayer(XYf32{X: 0, Y: 0})
+	creature := w.addCreature(XYf32{X: 20, Y: 0}, CRE_IDLE)
+	creature.health = 24
+
+	addTarget(player, creature, 0, 0)
+	w.step(6)
+
+	if creature.VALID {
+		t.Fatalf("creature still valid, health %v", creature.health)
+	}
+	if w.inChunk(creature) {
+		t.Errorf("defeated creature still in the world")
+	}
+
+	//Dropped on the player's next affect
+	w.step(1)
+	if player.numTargets != 0 {
+		t.Errorf("player still has %v targets", player.numTargets)
+	}
+	if player.xp == 0 {
+		t.Errorf("no xp for the kill")
+	}
+}
+
+// Two killing blows in one tick only count once
+func TestDefeatCreatureTwice(t *testing.T) {
+	w := newTestWorld(t)
+	first := w.addPlayer(XYf32{X: 0, Y: 0})
+	second := w.addPlayer(XYf32{X: 40, Y: 0})
+	creature := w.addCreature(XYf32{X: 20, Y: 0}, CRE_IDLE)
+	creature.health = 24
+
+	addTarget(first, creature, 0, 0)
+	addTarget(second, creature, 0, 0)
+	w.step(6)
+
+	if creature.VALID {
+		t.Fatalf("creature still valid, health %v", creature.health)
+	}
+	if kills := first.kills + second.kills; kills != 1 {
+		t.Errorf("%v kills credited, want 1", kills)
+	}
+	if xp := first.xp + second.xp; xp != creatureXP[creature.creatureData.id.Num] {
+		t.Errorf("%v xp awarded, want %v", xp, creatureXP[creature.creatureData.id.Num])
+	}
+	if len(respawnList) != 1 {
+		t.Errorf("%v respawns queued, want 1", len(respawnList))
+	}
+}
+
+// Defeated creatures come back where they first spawned
+func TestCreatureRespawn(t *testing.T) {
+	w := newTestWorld(t)
+	home := XYf32{X: 20, Y: 0}
+	creature := w.addCreature(home, CRE_IDLE)
+	defeatCreature(creature, nil)
+	w.step(1)
+
+	creatures := func() []*playerData {
+		if chunk := getChunk(w.area, floorXY(&home)); chunk != nil {
+			return chunk.creatrues
+		}
+		return nil
+	}
+	if len(creatures()) != 0 {
+		t.Fatalf("defeated creature still in the world")
+	}
+
+	w.step(creatureRespawnTicks - 1)
+	if len(creatures()) != 0 {
+		t.Errorf("respawned early")
+	}
+	w.step(1)
+	if len(creatures()) != 1 || len(respawnList) != 0 {
+		t.Fatalf("%v creatures after the respawn time, %v still waiting", len(creatures()), len(respawnList))
+	}
+	respawned := creatures()[0]
+	if respawned.pos != home || respawned.health != respawned.maxHealth ||
+		respawned.creatureData.id.UID == creature.creatureData.id.UID {
+		t.Errorf("respawned at %v with %v health, uid %v", respawned.pos, respawned.health, respawned.creatureData.id.UID)
+	}
+}
+
+func TestCreatureChasesPlayer(t *testing.T) {
+	w := newTestWorld(t)
+	player := w.addPlayer(XYf32{X: 0, Y: 0})
+	creature := w.addCreature(XYf32{X: 200, Y: 0}, CRE_ATTACK)
+
+	w.step(1)
+	if creature.dir != DIR_E {
+		t.Fatalf("creature facing %v, want %v", creature.dir, DIR_E)
+	}
+	if creature.pos.X >= 200 {
+		t.Errorf("creature didn't move closer, at %v", creature.pos)
+	}
+
+	//Walk until it bumps into the player and attacks
+	w.step(100)
+	if creature.numTargets != 1 || creature.targets[0].target != player {
+		t.Fatalf("creature isn't attacking the player")
+	}
+	if player.health >= player.maxHealth {
+		t.Errorf("player wasn't hurt, health %v", player.health)
+	}
+}
+
+func TestHealing(t *testing.T) {
+	tests := []struct {
+		name         string
+		creature     bool
+		startHealth  int16
+		injured      bool
+		ticks        int
+		wantHealth   int16
+		wantTargeted bool
+	}{
+		{name: "heal player", startHealth: 50, ticks: 10, wantHealth: 55, wantTargeted: true},
+		{name: "stop at full health", startHealth: defaultMaxHealth - 1, ticks: 10, wantHealth: defaultMaxHealth},
+		{name: "revive injured player", startHealth: 1, injured: true, ticks: 2, wantHealth: 2, wantTargeted: true},
+		{name: "creatures aren't healed", creature: true, startHealth: 50, ticks: 10, wantHealth: 50, wantTargeted: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newTestWorld(t)
+			healer := w.addPlayer(XYf32{X: 0, Y: 0})
+			healer.mode = PMODE_HEAL
+
+			var target *playerData
+			if tc.creature {
+				target = w.addCreature(XYf32{X: 20, Y: 0}, CRE_IDLE)
+			} else {
+				target = w.addPlayer(XYf32{X: 20, Y: 0})
+				target.mode = PMODE_PASSIVE
+			}
+			target.health = tc.startHealth
+			if tc.injured {
+				setEffect(target, EFFECT_INJURED)
+			}
+
+			addTarget(healer, target, 0, 0)
+			w.step(tc.ticks)
+
+			if target.health != tc.wantHealth {
+				t.Errorf("health = %v, want %v", target.health, tc.wantHealth)
+			}
+			if targeted := healer.numTargets > 0; targeted != tc.wantTargeted {
+				t.Errorf("targeted = %v, want %v", targeted, tc.wantTargeted)
+			}
+			if tc.injured && hasEffects(target, EFFECT_INJURED) {
+				t.Errorf("target still injured")
+			}
+			if tc.wantTargeted && !tc.creature {
+				if !hasEffects(healer, EFFECT_HEALER) || !hasEffects(target, EFFECT_HEAL) {
+					t.Errorf("heal effects missing: healer %b, target %b", healer.effects, target.effects)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveTarget(t *testing.T) {
+	w := newTestWorld(t)
+	player := w.addPlayer(XYf32{X: 0, Y: 0})
+	a := w.addCreature(XYf32{X: 20, Y: 0}, CRE_IDLE)
+	b := w.addCreature(XYf32{X: -20, Y: 0}, CRE_IDLE)
+
+	addTarget(player, a, EFFECT_ATTACK, EFFECT_HEAL)
+	addTarget(player, b, 0, 0)
+	addTarget(player, a, 0, 0)
+	if player.numTargets != 2 || len(player.targets) != 2 {
+		t.Fatalf("numTargets = %v, len %v, want 2", player.numTargets, len(player.targets))
+	}
+	if !hasEffects(player, EFFECT_ATTACK) || !hasEffects(a, EFFECT_HEAL) {
+		t.Errorf("target effects not applied")
+	}
+
+	removeTarget(player, a)
+	if player.numTargets != 1 || player.targets[0].target != b {
+		t.Fatalf("wrong target left after remove")
+	}
+	if hasEffects(player, EFFECT_ATTACK) || hasEffects(a, EFFECT_HEAL) {
+		t.Errorf("target effects not removed")
+	}
+
+	removeTarget(player, b)
+	if player.numTargets != 0 || len(player.targets) != 0 {
+		t.Errorf("targets left: %v", player.numTargets)
+	}
+}
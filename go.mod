@@ -6,4 +6,5 @@ require (
 	github.com/gorilla/websocket v1.5.0
 	github.com/remeh/sizedwaitgroup v1.0.0
 	github.com/twpayne/go-geom v1.5.3
+	golang.org/x/crypto v0.33.0
 )
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"goMMOServ/protocol"
+)
+
+// Isolated world for tests, stepped a tick at a time without timers or sockets
+type testWorld struct {
+	t    *testing.T
+	area *areaData
+}
+
+// Swap in an empty world, the real globals are put back when the test ends
+func newTestWorld(t *testing.T) *testWorld {
+	t.Helper()
+
+	oldAreas, oldPlayers, oldNumPlayers := areaList, playerList, numPlayers
+	oldTick, oldRand := gameTick, simRand
+	oldDefeats, oldDropped, oldNumDropped := pendingDefeats, droppedItems, numDroppedItems
+	oldSessions, oldRespawns := sessionList, respawnList
+	t.Cleanup(func() {
+		areaList, playerList, numPlayers = oldAreas, oldPlayers, oldNumPlayers
+		gameTick, simRand = oldTick, oldRand
+		pendingDefeats, droppedItems, numDroppedItems = oldDefeats, oldDropped, oldNumDropped
+		sessionList, respawnList = oldSessions, oldRespawns
+	})
+
+	area := &areaData{Name: "test", ID: 0, Chunks: make(map[XY]*chunkData)}
+	areaList = []*areaData{area}
+	playerList = []*playerData{}
+	numPlayers = 0
+	gameTick = 0 //First step is tick 1, attacks land every 6th
+	simRand = rand.New(rand.NewSource(1))
+	pendingDefeats = []*playerData{}
+	droppedItems = []*droppedItem{}
+	numDroppedItems = 0
+	respawnList = []*creatureRespawn{}
+	sessionList = map[protocol.SessionToken]*playerData{}
+
+	return &testWorld{t: t, area: area}
+}
+
+// Add a player with no connection, set up the same way handleConnection does
+func (w *testWorld) addPlayer(pos XYf32) *playerData {
+	pid := makePlayerID()
+	player := &playerData{id: pid, name: "Tester", pos: pos, area: w.area,
+		dir: DIR_N, moveDir: DIR_NONE, mode: PMODE_ATTACK, lastDirUpdate: gameTick,
+		VALID: true, visCache: make(map[XY]*visCacheData)}
+	setLevel(player, 1)
+	player.health = player.maxHealth
+
+	playerList = append(playerList, player)
+	numPlayers++
+	addPlayerToWorld(w.area, pos, player)
+	return player
+}
+
+// Add a creature, set up the same way spawnCreature does
+func (w *testWorld) addCreature(pos XYf32, mode CRE) *playerData {
+	creature := &playerData{
+		area:         w.area,
+		creatureData: &creatureData{id: IID{Section: 1, Num: 0, UID: makeCreatureID()}, mode: mode, home: pos},
+		pos:          pos, health: defaultMaxHealth, maxHealth: defaultMaxHealth,
+		dir: DIR_S, moveDir: DIR_NONE, VALID: true, mode: PMODE_ATTACK}
+
+	addPlayerToWorld(w.area, pos, creature)
+	return creature
+}
+
+// Add a world object, section 3 blocks movement
+func (w *testWorld) addObject(pos XYf32, id IID) *worldObject {
+	obj := &worldObject{ID: id, Pos: floorXY(&pos)}
+	addWorldObject(w.area, obj.Pos, obj)
+	return obj
+}
+
+// Run ticks the same way runTick does, minus serializing
+func (w *testWorld) step(ticks int) {
+	for i := 0; i < ticks; i++ {
+		gameTick++
+
+		processLock.Lock()
+		processIsolated()
+		simulateTick()
+		processLock.Unlock()
+	}
+}
+
+// Keep a player walking, otherwise the lag check stops them
+func (w *testWorld) walk(player *playerData, dir DIR) {
+	player.moveDir = dir
+	player.dir = dir
+	player.lastDirUpdate = gameTick
+}
+
+// Check a creature or player is still in the chunk for its position
+func (w *testWorld) inChunk(player *playerData) bool {
+	chunk := getChunk(w.area, floorXY(&player.pos))
+	if chunk == nil {
+		return false
+	}
+
+	list := chunk.players
+	if player.creatureData != nil {
+		list = chunk.creatrues
+	}
+	for _, p := range list {
+		if p == player {
+			return true
+		}
+	}
+	return false
+}
+
+// Run a command as a player, returning the replies
+func runAs(player *playerData, admin bool, line string) []string {
+	replies := []string{}
+	runCommand(&cmdContext{player: player, admin: admin, reply: func(str string) {
+		replies = append(replies, str)
+	}}, line)
+	passwordJobs.Wait()
+	return replies
+}
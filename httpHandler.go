@@ -5,23 +5,39 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{EnableCompression: false}
+var upgrader = websocket.Upgrader{EnableCompression: true}
 
 func gsHandler(w http.ResponseWriter, r *http.Request) {
 	defer reportPanic("gsHandler")
 
+	if shuttingDown.Load() {
+		http.Error(w, "Server is restarting.", http.StatusServiceUnavailable)
+		return
+	}
+
 	c, err := upgrader.Upgrade(w, r, w.Header())
 	if err != nil {
 		log.Print("upgrade:", err)
 		return
 	}
-	go handleConnection(c)
+	go handleConnection(newWSTransport(c, offersDeflate(r)))
+}
+
+// The upgrader accepts permessage-deflate whenever the client offers it
+func offersDeflate(r *http.Request) bool {
+	for _, ext := range r.Header.Values("Sec-Websocket-Extensions") {
+		if strings.Contains(ext, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
 }
 
 func siteHandler(w http.ResponseWriter, r *http.Request) {
@@ -36,60 +52,86 @@ var (
 	numPlayers     int
 	playerListLock sync.Mutex
 
-	maxNetRead           = 1024 * 500 //500kb
-	maxConnections int32 = 50000
-	spawnArea            = 256
-	halfArea             = spawnArea / 2
+	//Set from config, only read with processLock held
+	spawnArea = 256
+	halfArea  = spawnArea / 2
 )
 
 func redirectToTls(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, "https://gommo.go-game.net/"+r.RequestURI, http.StatusMovedPermanently)
+	http.Redirect(w, r, "https://"+config.Load().RedirectHost+r.RequestURI, http.StatusMovedPermanently)
 }
 
-func handleConnection(conn *websocket.Conn) {
+// Read loop for one client, on any transport
+func handleConnection(conn transport) {
 	defer reportPanic("handleConnection")
 
 	if conn == nil {
 		return
 	}
 
-	if numConnections.Load() > maxConnections {
+	cfg := config.Load()
+	if numConnections.Load() > cfg.MaxConnections {
 		return
 	}
 
-	startLoc := XYf32{X: float32(halfArea - rand.Intn(spawnArea)),
-		Y: float32(halfArea - rand.Intn(spawnArea))}
+	addr := remoteIP(conn.RemoteAddr())
+	if isBannedIP(addr) {
+		logInfo(SUB_NET, "Banned IP refused: %v", addr)
+		conn.Close()
+		return
+	}
+
+	startLoc := XYf32{X: float32(cfg.SpawnArea/2 - rand.Intn(cfg.SpawnArea)),
+		Y: float32(cfg.SpawnArea/2 - rand.Intn(cfg.SpawnArea))}
 	pid := makePlayerID()
-	player := &playerData{conn: conn, id: pid, name: fmt.Sprintf("Player-%v", pid),
-		pos: startLoc, area: areaList[0], health: 100, dir: DIR_N, moveDir: DIR_NONE, mode: PMODE_ATTACK,
+	player := &playerData{conn: conn, addr: addr, id: pid, name: fmt.Sprintf("Player-%v", pid),
+		pos: startLoc, area: areaList[0], dir: DIR_N, moveDir: DIR_NONE, mode: PMODE_ATTACK,
 		VALID: true, visCache: make(map[XY]*visCacheData)}
+	setLevel(player, 1)
+	player.health = player.maxHealth
 
 	playerList = append(playerList, player)
 	numPlayers++
-	conn.SetReadLimit(int64(maxNetRead))
+	defer recoverEntity(player, "handleConnection")
 
 	numConnections.Add(1)
+	connAccepted.Add(1)
 	for {
-		_, data, err := conn.ReadMessage()
+		data, err := conn.Receive()
 
 		if err != nil {
-			doLog(true, "Error on connection read: %v", err)
-			removePlayer(player, "connection lost")
+			logInfo(SUB_NET, "Error on connection read: %v", err)
+			processLock.Lock()
+			//A resume may have moved the player to a newer connection
+			if player.conn == conn {
+				disconnectPlayer(player, "connection lost")
+			}
+			processLock.Unlock()
 			return
 		}
 		newParser(data, player)
+
+		//This connection took over an older session
+		if player.resumed != nil {
+			player = player.resumed
+		}
 	}
 }
 
 func removePlayer(player *playerData, reason string) {
 	defer reportPanic("removePlayer")
 
-	if player == nil {
+	//Already removed
+	if player == nil || !player.VALID {
 		return
 	}
 
 	reasonStr := fmt.Sprintf("%v left the game. (%v)", player.name, reason)
 
+	savePlayer(player)
+	endSession(player)
+	endDuel(player, false)
+	leaveParty(player)
 	killConnection(player, true)
 	removePlayerWorld(player.area, player.pos, player)
 	deletePlayer(player)
@@ -105,7 +147,7 @@ func deletePlayer(player *playerData) {
 	player.VALID = false
 
 	/* Fast, does not preserve order */
-	for i := 0; i < numPlayers-1; i++ {
+	for i := 0; i < numPlayers; i++ {
 		if playerList[i].id == player.id {
 			if numPlayers == 1 {
 				playerList = []*playerData{}
@@ -120,6 +162,14 @@ func deletePlayer(player *playerData) {
 	}
 }
 
+// Close frame with a reason the client can show, the connection is closed after
+func sendClose(player *playerData, code int, reason string) {
+	if player == nil || player.conn == nil {
+		return
+	}
+	player.conn.SendClose(code, reason)
+}
+
 func killConnection(player *playerData, force bool) {
 	defer reportPanic("killConnection")
 
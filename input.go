@@ -0,0 +1,43 @@
+package main
+
+import "sync/atomic"
+
+// Moves waiting for a tick, more than this and the oldest are dropped
+const maxInputBuffer = 8
+
+type moveInput struct {
+	seq uint16
+	dir DIR
+}
+
+var inputsDropped atomic.Uint64
+
+// Buffer a move from the client, applied on a later tick. processLock must be held.
+func queueInput(player *playerData, seq uint16, dir DIR) {
+	if len(player.inputs) >= maxInputBuffer {
+		//Client is sending faster than we tick, keep the newest
+		player.inputs = player.inputs[1:]
+		inputsDropped.Add(1)
+	}
+	player.inputs = append(player.inputs, moveInput{seq: seq, dir: dir})
+}
+
+// Apply the next buffered move, one per tick so the client can predict each step
+func applyInput(player *playerData) {
+	if len(player.inputs) == 0 {
+		return
+	}
+
+	input := player.inputs[0]
+	player.inputs = player.inputs[1:]
+	if len(player.inputs) == 0 {
+		player.inputs = nil
+	}
+
+	player.moveDir = input.dir
+	if input.dir != DIR_NONE {
+		player.dir = input.dir
+	}
+	player.lastDirUpdate = gameTick
+	player.inputSeq = input.seq
+}
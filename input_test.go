@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestInputAppliedOnePerTick(t *testing.T) {
+	w := newTestWorld(t)
+	player := w.addPlayer(XYf32{X: 0, Y: 0})
+
+	queueInput(player, 1, DIR_N)
+	queueInput(player, 2, DIR_N)
+	queueInput(player, 3, DIR_W)
+
+	tests := []struct {
+		wantSeq uint16
+		wantPos XYf32
+	}{
+		{1, XYf32{X: 0, Y: walkSpeed}},
+		{2, XYf32{X: 0, Y: walkSpeed * 2}},
+		{3, XYf32{X: walkSpeed, Y: walkSpeed * 2}},
+		{3, XYf32{X: walkSpeed * 2, Y: walkSpeed * 2}}, //Keeps walking with no new input
+	}
+
+	for i, tc := range tests {
+		w.step(1)
+		if player.inputSeq != tc.wantSeq || player.pos != tc.wantPos {
+			t.Errorf("tick %v: seq %v pos %v, want seq %v pos %v",
+				i+1, player.inputSeq, player.pos, tc.wantSeq, tc.wantPos)
+		}
+	}
+}
+
+func TestInputBufferDropsOldest(t *testing.T) {
+	w := newTestWorld(t)
+	player := w.addPlayer(XYf32{X: 0, Y: 0})
+	dropped := inputsDropped.Load()
+
+	for seq := uint16(1); seq <= maxInputBuffer+2; seq++ {
+		queueInput(player, seq, DIR_S)
+	}
+
+	if len(player.inputs) != maxInputBuffer {
+		t.Fatalf("buffered %v inputs, want %v", len(player.inputs), maxInputBuffer)
+	}
+	if player.inputs[0].seq != 3 {
+		t.Errorf("oldest input is %v, want 3", player.inputs[0].seq)
+	}
+	if inputsDropped.Load()-dropped != 2 {
+		t.Errorf("dropped %v inputs, want 2", inputsDropped.Load()-dropped)
+	}
+
+	w.step(maxInputBuffer)
+	if player.inputSeq != maxInputBuffer+2 || len(player.inputs) != 0 {
+		t.Errorf("seq %v with %v left, want %v with none", player.inputSeq, len(player.inputs), maxInputBuffer+2)
+	}
+}
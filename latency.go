@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"goMMOServ/protocol"
+)
+
+const (
+	pingTicks   = 15               //~2 seconds
+	pingTimeout = 10 * time.Second //Unanswered pings are replaced after this
+	posHistory  = 8                //Ticks of positions kept for lag compensation, ~1 second
+)
+
+type posRecord struct {
+	tick uint64
+	pos  XYf32
+}
+
+// Ping everyone who can answer, one outstanding ping each. processLock must be held.
+func sendPings() {
+	for _, player := range playerList {
+		if player.conn == nil || player.protoVersion < protocol.VersionPing {
+			continue
+		}
+		if !player.pingSent.IsZero() && time.Since(player.pingSent) < pingTimeout {
+			continue
+		}
+
+		player.pingID++
+		player.pingSent = time.Now()
+		writeToPlayer(player, CMD_Ping, (&protocol.Ping{ID: player.pingID}).Encode())
+	}
+}
+
+func cmd_pong(player *playerData, data []byte) {
+	defer reportPanic("cmd_pong")
+
+	msg, err := protocol.DecodePing(data)
+	if err != nil {
+		badInput(player, CMD_Pong, err)
+		return
+	}
+
+	//Late answer to a ping that timed out
+	if player.pingSent.IsZero() || msg.ID != player.pingID {
+		logDebug(SUB_NET, "ID: %v, stale pong %v, waiting on %v", player.id, msg.ID, player.pingID)
+		return
+	}
+
+	updateRTT(player, time.Since(player.pingSent))
+	player.pingSent = time.Time{}
+}
+
+// Smoothed like TCP does, so one slow answer doesn't swing it
+func updateRTT(player *playerData, sample time.Duration) {
+	if player.rtt == 0 {
+		player.rtt = sample
+		return
+	}
+	player.rtt += (sample - player.rtt) / 8
+}
+
+// For /who, older clients can't be pinged
+func rttString(player *playerData) string {
+	if !player.disconnectedAt.IsZero() {
+		return "reconnecting"
+	}
+	if player.rtt == 0 {
+		return "? ms"
+	}
+	return fmt.Sprintf("%v ms", player.rtt.Milliseconds())
+}
+
+// Ticks the player's view is behind the server, capped at LagCompMaxMS
+func lagTicks(player *playerData) int {
+	frame := time.Duration(FrameSpeedNS)
+	rtt := min(player.rtt, time.Duration(config.Load().LagCompMaxMS)*time.Millisecond)
+
+	return min(int((rtt+frame/2)/frame), posHistory-1)
+}
+
+// Called once per tick after moving
+func recordPos(player *playerData) {
+	player.history[gameTick%posHistory] = posRecord{tick: gameTick, pos: player.pos}
+}
+
+// Forget old positions after a teleport, so nobody can hit where we were
+func clearPosHistory(player *playerData) {
+	player.history = [posHistory]posRecord{}
+}
+
+// Where the player was ticksAgo, or where they are now if that isn't known
+func posAt(player *playerData, ticksAgo int) XYf32 {
+	if ticksAgo <= 0 || uint64(ticksAgo) >= gameTick {
+		return player.pos
+	}
+
+	tick := gameTick - uint64(ticksAgo)
+	rec := player.history[tick%posHistory]
+	if rec.tick != tick {
+		return player.pos
+	}
+	return rec.pos
+}
+
+// In range of the target where it is now, or where the attacker saw it
+// when they acted. Creatures have no latency, so only get the first check.
+func inReach(player, target *playerData) bool {
+	const reach = playerSize + grace
+
+	if distanceFloat(player.pos, target.pos) <= reach {
+		return true
+	}
+
+	lag := lagTicks(player)
+	if lag == 0 {
+		return false
+	}
+	return distanceFloat(player.pos, posAt(target, lag)) <= reach
+}
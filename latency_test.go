@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLagTicks(t *testing.T) {
+	oldConfig, oldFrame := config.Load(), FrameSpeedNS
+	t.Cleanup(func() {
+		config.Store(oldConfig)
+		FrameSpeedNS = oldFrame
+	})
+	config.Store(defaultConfig())
+	config.Load().LagCompMaxMS = 300
+	FrameSpeedNS = int64(100 * time.Millisecond)
+
+	tests := []struct {
+		rtt  time.Duration
+		want int
+	}{
+		{0, 0},
+		{40 * time.Millisecond, 0},
+		{60 * time.Millisecond, 1},
+		{210 * time.Millisecond, 2},
+		{2 * time.Second, 3}, //Capped at LagCompMaxMS
+	}
+
+	for _, tc := range tests {
+		player := &playerData{rtt: tc.rtt}
+		if got := lagTicks(player); got != tc.want {
+			t.Errorf("rtt %v: got %v ticks, want %v", tc.rtt, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateRTT(t *testing.T) {
+	player := &playerData{}
+
+	updateRTT(player, 200*time.Millisecond)
+	if player.rtt != 200*time.Millisecond {
+		t.Fatalf("first sample: rtt %v, want 200ms", player.rtt)
+	}
+
+	//One spike only moves it an eighth of the way
+	updateRTT(player, 1000*time.Millisecond)
+	if player.rtt != 300*time.Millisecond {
+		t.Errorf("after a spike: rtt %v, want 300ms", player.rtt)
+	}
+}
+
+// A target that just stepped out of reach can still be hit by a player who saw it in reach
+func TestLagCompensatedReach(t *testing.T) {
+	tests := []struct {
+		name      string
+		rttTicks  int
+		wantTicks int //Ticks the target is kept after moving away
+	}{
+		{"no latency", 0, 0},
+		{"two ticks", 2, 2},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newTestWorld(t)
+			oldConfig := config.Load()
+			t.Cleanup(func() { config.Store(oldConfig) })
+			config.Store(defaultConfig())
+
+			player := w.addPlayer(XYf32{X: 0, Y: 0})
+			player.rtt = time.Duration(FrameSpeedNS) * time.Duration(tc.rttTicks)
+			creature := w.addCreature(XYf32{X: 30, Y: 0}, CRE_IDLE)
+			w.step(posHistory)
+
+			addTarget(player, creature, 0, 0)
+			movePlayerChunk(w.area, XYf32{X: 60, Y: 0}, creature)
+
+			for tick := 0; tick <= tc.wantTicks; tick++ {
+				w.step(1)
+				kept := player.numTargets == 1
+				if want := tick < tc.wantTicks; kept != want {
+					t.Fatalf("tick %v after moving: kept target %v, want %v", tick+1, kept, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import "fmt"
+
+const (
+	lootSection      = 6    //World objects that can be picked up
+	dropOwnerTicks   = 225  //~30 seconds only the killer's party can pick it up
+	dropDespawnTicks = 1350 //~3 minutes
+	dropScatter      = 24
+	pickupDistance   = 24
+
+	creatureRespawnTicks = 450 //~1 minute
+)
+
+type lootDrop struct {
+	ID     IID
+	Chance float32 //0-1
+	Name   string
+}
+
+// Loot for section 7 creatures, by Num
+var lootTables = map[uint8][]lootDrop{
+	0: { //Zombie
+		{ID: IID{Section: lootSection, Num: 0}, Chance: 0.5, Name: "Bone"},
+		{ID: IID{Section: lootSection, Num: 1}, Chance: 0.25, Name: "Rotten Cloth"},
+		{ID: IID{Section: lootSection, Num: 2}, Chance: 0.05, Name: "Old Coin"},
+	},
+}
+
+type droppedItem struct {
+	area *areaData
+	obj  *worldObject
+}
+
+// A defeated creature waiting to come back
+type creatureRespawn struct {
+	area *areaData
+	id   IID
+	mode CRE
+	pos  XYf32
+	tick uint64
+}
+
+var (
+	droppedItems    []*droppedItem
+	pendingDefeats  []*playerData
+	respawnList     []*creatureRespawn
+	numDroppedItems int
+)
+
+// Credit the kill, drop loot and queue the corpse for removal.
+// Only the first killing blow counts, others can land in the same tick.
+func defeatCreature(creature *playerData, killer *playerData) {
+	defer reportPanic("defeatCreature")
+
+	if creature.creatureData == nil || !creature.VALID || creature.creatureData.defeated {
+		return
+	}
+	creature.creatureData.defeated = true
+
+	logDebug(SUB_COMBAT, "Creature %v defeated at %v,%v", creature.creatureData.id.UID, creature.pos.X, creature.pos.Y)
+	creditKill(creature)
+	dropLoot(creature, killer)
+
+	//Removed after the tick, we are still iterating chunks
+	pendingDefeats = append(pendingDefeats, creature)
+}
+
+// Remove defeated creatures from the world, they come back after creatureRespawnTicks
+func processDefeats() {
+	for _, creature := range pendingDefeats {
+		if !creature.VALID {
+			continue
+		}
+		for creature.numTargets > 0 {
+			removeTarget(creature, creature.targets[0].target)
+		}
+		removePlayerWorld(creature.area, creature.pos, creature)
+		creature.VALID = false
+
+		respawnList = append(respawnList, &creatureRespawn{area: creature.area,
+			id:   IID{Section: creature.creatureData.id.Section, Num: creature.creatureData.id.Num},
+			mode: creature.creatureData.mode, pos: creature.creatureData.home,
+			tick: gameTick + creatureRespawnTicks})
+	}
+	pendingDefeats = []*playerData{}
+}
+
+// Bring back creatures whose respawn time is up
+func respawnCreatures() {
+	for i := 0; i < len(respawnList); i++ {
+		respawn := respawnList[i]
+		if respawn.tick > gameTick {
+			continue
+		}
+
+		id := respawn.id
+		id.UID = makeCreatureID()
+		spawnCreature(respawn.area, id, respawn.mode, respawn.pos)
+
+		respawnList[i] = respawnList[len(respawnList)-1]
+		respawnList = respawnList[:len(respawnList)-1]
+		i--
+	}
+}
+
+// Add a creature at full health, moved somewhere random if pos is blocked
+func spawnCreature(area *areaData, id IID, mode CRE, pos XYf32) *playerData {
+	creature := &playerData{
+		area:         area,
+		creatureData: &creatureData{id: id, mode: mode},
+		pos:          pos, health: defaultMaxHealth, maxHealth: defaultMaxHealth,
+		dir: DIR_S, moveDir: DIR_NONE, VALID: true, mode: PMODE_ATTACK}
+
+	addPlayerToWorld(area, pos, creature)
+
+	for !movePlayer(creature, true) {
+		pos = XYf32{X: 10000 - (simRand.Float32() * 20000.0), Y: 10000 - (simRand.Float32() * 20000.0)}
+		movePlayerChunk(creature.area, pos, creature)
+		logDebug(SUB_WORLD, "Spawn blocked.")
+	}
+	creature.creatureData.home = creature.pos
+	return creature
+}
+
+// Roll a creature's loot table and spawn the drops around it
+func dropLoot(creature *playerData, killer *playerData) {
+	table := lootTables[creature.creatureData.id.Num]
+
+	for _, drop := range table {
+		if simRand.Float32() >= drop.Chance {
+			continue
+		}
+
+		dropPos := XYf32{X: creature.pos.X + float32(dropScatter/2-simRand.Intn(dropScatter)),
+			Y: creature.pos.Y + float32(dropScatter/2-simRand.Intn(dropScatter))}
+		pos := floorXY(&dropPos)
+
+		obj := &worldObject{ID: drop.ID, Pos: pos,
+			ownerTick: gameTick + dropOwnerTicks, despawnTick: gameTick + dropDespawnTicks}
+		if killer != nil && killer.creatureData == nil {
+			obj.owner = killer
+		}
+		addWorldObject(creature.area, pos, obj)
+
+		droppedItems = append(droppedItems, &droppedItem{area: creature.area, obj: obj})
+		numDroppedItems++
+	}
+}
+
+// Remove drops nobody picked up
+func despawnLoot() {
+	for i := 0; i < numDroppedItems; i++ {
+		item := droppedItems[i]
+		if item.obj.despawnTick > gameTick {
+			continue
+		}
+
+		removeWorldObject(item.area, item.obj.Pos, item.obj.ID)
+		droppedItems[i] = droppedItems[numDroppedItems-1]
+		droppedItems = droppedItems[:numDroppedItems-1]
+		numDroppedItems--
+		i--
+	}
+}
+
+// Pick up any drops we are standing on
+func pickupLoot(player *playerData) {
+	if player.creatureData != nil || hasEffects(player, EFFECT_INJURED) {
+		return
+	}
+
+	for i := 0; i < numDroppedItems; i++ {
+		item := droppedItems[i]
+		if item.area != player.area {
+			continue
+		}
+		if distanceInt(item.obj.Pos, floorXY(&player.pos)) > pickupDistance {
+			continue
+		}
+
+		//Only the killer or their party, until ownership runs out
+		owner := item.obj.owner
+		if item.obj.ownerTick > gameTick && owner != nil && owner.VALID &&
+			owner != player && !samePartyOf(owner, player) {
+			continue
+		}
+
+		key := IID{Section: item.obj.ID.Section, Num: item.obj.ID.Num}
+		if player.inventory == nil {
+			player.inventory = make(map[IID]uint32)
+		}
+		player.inventory[key]++
+		writeToPlayer(player, CMD_Chat, []byte(fmt.Sprintf("You picked up %v.", lootName(key))))
+
+		removeWorldObject(item.area, item.obj.Pos, item.obj.ID)
+		droppedItems[i] = droppedItems[numDroppedItems-1]
+		droppedItems = droppedItems[:numDroppedItems-1]
+		numDroppedItems--
+		i--
+	}
+}
+
+// Name of a loot item, for messages
+func lootName(id IID) string {
+	for _, table := range lootTables {
+		for _, drop := range table {
+			if sameIID(drop.ID, id) {
+				return drop.Name
+			}
+		}
+	}
+	return "something"
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"runtime/pprof"
@@ -22,9 +22,14 @@ func main() {
 	defer time.Sleep(time.Second)
 
 	//Parse launch params
+	configPath := flag.String("config", defaultConfigFile, "config file to load")
 	devMode := flag.Bool("dev", false, "dev mode enable")
 	bindIP := flag.String("ip", "", "IP to bind to")
 	bindPort := flag.Int("port", 443, "port to bind to for HTTPS")
+	httpPort := flag.Int("httpport", 80, "port to bind to for the HTTP redirect, 0 to disable")
+	consoleSocket := flag.String("console", "", "unix socket path for the operator console")
+	adminAddr := flag.String("admin", "127.0.0.1:8081", "address for the admin/metrics listener, blank to disable")
+	tcpAddr := flag.String("tcp", "", "address for native TCP clients, blank to disable")
 	testMode := flag.Bool("test", false, "load many test characters")
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 	flag.Parse()
@@ -34,12 +39,12 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		doLog(true, "pprof started")
+		logInfo(SUB_GENERAL, "pprof started")
 		pprof.StartCPUProfile(f)
 		go func() {
 			time.Sleep(time.Minute)
 			pprof.StopCPUProfile()
-			doLog(true, "pprof complete")
+			logInfo(SUB_GENERAL, "pprof complete")
 		}()
 	}
 
@@ -49,10 +54,47 @@ func main() {
 	startLog()
 	logDaemon()
 
+	//Load config, command line flags override it
+	configFile = *configPath
+	if err := loadConfig(); err != nil {
+		logError(SUB_GENERAL, "Invalid config: %v", err)
+		return
+	}
+	cfg := *config.Load()
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dev":
+			cfg.DevMode = *devMode
+		case "ip":
+			cfg.BindIP = *bindIP
+		case "port":
+			cfg.HTTPSPort = *bindPort
+		case "httpport":
+			cfg.HTTPPort = *httpPort
+		case "admin":
+			cfg.AdminAddr = *adminAddr
+		case "console":
+			cfg.ConsoleSocket = *consoleSocket
+		case "tcp":
+			cfg.TCPAddr = *tcpAddr
+		}
+	})
+	if err := validateConfig(&cfg); err != nil {
+		logError(SUB_GENERAL, "Invalid config: %v", err)
+		return
+	}
+	config.Store(&cfg)
+	configReloadDaemon()
+	shutdownSignalDaemon()
+
 	/* make test area */
 	tmp := &areaData{Name: "test", ID: 0, Chunks: make(map[XY]*chunkData)}
 	areaList = append(areaList, tmp)
 	loadWorld()
+	loadLevels()
+	loadBans()
+	loadNameLists()
+	loadDictionary()
 
 	go autoSaveWorld()
 
@@ -60,36 +102,26 @@ func main() {
 
 	//Test zombies!
 	for x := 0; x < 100; x++ {
-
-		startPos := XYf32{X: 0, Y: 0}
-
-		newCreature := &playerData{
-			area:         areaList[0],
-			creatureData: &creatureData{id: IID{Section: 1, Num: 0, UID: makeCreatureID()}, mode: CRE_ATTACK},
-			pos:          startPos, health: 100,
-			dir: DIR_S, moveDir: DIR_NONE, VALID: true, mode: PMODE_ATTACK}
-
-		addPlayerToWorld(areaList[0], startPos, newCreature)
-
-		for !movePlayer(newCreature, true) {
-			randx := 10000 - (rand.Float32() * 20000.0)
-			randy := 10000 - (rand.Float32() * 20000.0)
-			startPos = XYf32{X: randx, Y: randy}
-			movePlayerChunk(newCreature.area, startPos, newCreature)
-			fmt.Println("Spawn blocked.")
-		}
+		id := IID{Section: 1, Num: 0, UID: makeCreatureID()}
+		spawnCreature(areaList[0], id, CRE_ATTACK, XYf32{X: 0, Y: 0})
 	}
 
 	processLock.Unlock()
 
 	processGame()
+	startAdminServer()
+	startConsole()
+	if cfg.TCPAddr != "" {
+		startTCPListener(cfg.TCPAddr)
+	}
 
 	/* Download server start */
 	fileServer = http.FileServer(http.Dir("www"))
 
 	/* Create HTTPS server */
 	server := &http.Server{}
-	server.Addr = fmt.Sprintf("%v:%v", *bindIP, *bindPort)
+	server.Addr = fmt.Sprintf("%v:%v", cfg.BindIP, cfg.HTTPSPort)
+	httpsServer = server
 
 	/* HTTPS server */
 	http.HandleFunc("/gs", gsHandler) //websocket
@@ -98,57 +130,42 @@ func main() {
 	//If not in development mode, setup an origin check
 	upgrader.CheckOrigin = func(r *http.Request) bool {
 		origin := r.Header.Get("Origin")
-		if !*devMode && origin != "https://gommo.go-game.net" {
-			doLog(true, "Connection failed origin check: %v", r.RemoteAddr)
+		current := config.Load()
+		if !current.DevMode && origin != current.AllowedOrigin {
+			logWarn(SUB_NET, "Connection failed origin check: %v", r.RemoteAddr)
 			return false
 		}
 		return true
 	}
 
 	/* Start server*/
-	doLog(true, "Starting server...")
-
-	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf("%v:80", *bindIP), http.HandlerFunc(redirectToTls)); err != nil {
-			log.Fatalf("ListenAndServe error: %v", err)
-		}
-	}()
+	logInfo(SUB_GENERAL, "Starting server...")
 
-	go func() {
-		for {
-			time.Sleep(time.Second * 5)
-
-			filePath := "fullchain.pem"
-			initialStat, erra := os.Stat(filePath)
-
-			if erra != nil {
-				continue
-			}
-
-			for initialStat != nil {
-				time.Sleep(time.Second * 5)
-
-				stat, errb := os.Stat(filePath)
-				if errb != nil {
-					break
-				}
-
-				if stat.Size() != initialStat.Size() || stat.ModTime() != initialStat.ModTime() {
-					doLog(true, "Cert updated, closing.")
-					time.Sleep(time.Second * 5)
-					os.Exit(0)
-					break
-				}
+	if cfg.HTTPPort != 0 {
+		go func() {
+			if err := http.ListenAndServe(fmt.Sprintf("%v:%v", cfg.BindIP, cfg.HTTPPort), http.HandlerFunc(redirectToTls)); err != nil {
+				log.Fatalf("ListenAndServe error: %v", err)
 			}
+		}()
+	}
 
-		}
-	}()
-
-	err := server.ListenAndServeTLS("fullchain.pem", "privkey.pem")
+	//Certificate renewals are swapped in without a restart
+	certs, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
 	if err != nil {
-		doLog(true, "ListenAndServeTLS: %v", err)
+		logError(SUB_NET, "Unable to load certificate: %v", err)
+		return
+	}
+	certs.watch()
+	server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+
+	err = server.ListenAndServeTLS("", "")
+	if err == http.ErrServerClosed {
+		//Wait for saves to finish
+		<-shutdownDone
+	} else if err != nil {
+		logError(SUB_NET, "ListenAndServeTLS: %v", err)
 		return
 	}
 
-	doLog(true, "Goodbye.")
+	logInfo(SUB_GENERAL, "Goodbye.")
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type histogram struct {
+	buckets []float64 //Upper bounds, in seconds
+	counts  []uint64
+	sum     float64
+	count   uint64
+
+	lock sync.Mutex
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	secs := d.Seconds()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for b, bound := range h.buckets {
+		if secs <= bound {
+			h.counts[b]++
+		}
+	}
+	h.sum += secs
+	h.count++
+}
+
+// Prometheus text format, labels should be blank or `key="value"`
+func (h *histogram) write(sb *strings.Builder, name, labels string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for b, bound := range h.buckets {
+		fmt.Fprintf(sb, "%v_bucket{%v%vle=\"%v\"} %v\n", name, labels, sep, bound, h.counts[b])
+	}
+	fmt.Fprintf(sb, "%v_bucket{%v%vle=\"+Inf\"} %v\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(sb, "%v_sum%v %v\n", name, labels, h.sum)
+	fmt.Fprintf(sb, "%v_count%v %v\n", name, labels, h.count)
+}
+
+// Tick phases
+const (
+	PHASE_PLAYERS = iota
+	PHASE_CREATURES
+	PHASE_SERIALIZE
+	PHASE_TOTAL
+	PHASE_MAX
+)
+
+var phaseNames = [PHASE_MAX]string{"players", "creatures", "serialize", "total"}
+
+var (
+	tickBuckets   = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.133, 0.25, 0.5, 1}
+	tickHistogram [PHASE_MAX]*histogram
+	saveHistogram = newHistogram(0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5)
+
+	bytesOut     [256]atomic.Uint64
+	messagesOut  [256]atomic.Uint64
+	bytesIn      [256]atomic.Uint64
+	messagesIn   [256]atomic.Uint64
+	ticksBehind  atomic.Uint64
+	connAccepted atomic.Uint64
+)
+
+func init() {
+	for p := range tickHistogram {
+		tickHistogram[p] = newHistogram(tickBuckets...)
+	}
+}
+
+func countOut(header CMD, size int) {
+	bytesOut[header].Add(uint64(size))
+	messagesOut[header].Add(1)
+}
+
+func countIn(header CMD, size int) {
+	bytesIn[header].Add(uint64(size))
+	messagesIn[header].Add(1)
+}
+
+// Serve all metrics in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	defer reportPanic("metricsHandler")
+
+	var sb strings.Builder
+
+	sb.WriteString("# TYPE gommo_tick_seconds histogram\n")
+	for p, h := range tickHistogram {
+		h.write(&sb, "gommo_tick_seconds", fmt.Sprintf("phase=%q", phaseNames[p]))
+	}
+	fmt.Fprintf(&sb, "# TYPE gommo_ticks_behind_total counter\ngommo_ticks_behind_total %v\n", ticksBehind.Load())
+
+	sb.WriteString("# TYPE gommo_save_seconds histogram\n")
+	saveHistogram.write(&sb, "gommo_save_seconds", "")
+
+	fmt.Fprintf(&sb, "# TYPE gommo_connections gauge\ngommo_connections %v\n", numConnections.Load())
+	fmt.Fprintf(&sb, "# TYPE gommo_connections_accepted_total counter\ngommo_connections_accepted_total %v\n", connAccepted.Load())
+	fmt.Fprintf(&sb, "# TYPE gommo_inputs_dropped_total counter\ngommo_inputs_dropped_total %v\n", inputsDropped.Load())
+
+	writeCmdCounters(&sb, "gommo_bytes_out_total", &bytesOut)
+	writeCmdCounters(&sb, "gommo_messages_out_total", &messagesOut)
+	writeCmdCounters(&sb, "gommo_bytes_in_total", &bytesIn)
+	writeCmdCounters(&sb, "gommo_messages_in_total", &messagesIn)
+	writeCmdCounters(&sb, "gommo_compress_in_bytes_total", &compressIn)
+	writeCmdCounters(&sb, "gommo_compress_out_bytes_total", &compressOut)
+	writeCmdCounters(&sb, "gommo_compress_skipped_total", &compressSkipped)
+	writeCmdCounters(&sb, "gommo_deflate_bytes_total", &deflateBytes)
+
+	writeAreaGauges(&sb)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(sb.String()))
+}
+
+func writeCmdCounters(sb *strings.Builder, name string, counters *[256]atomic.Uint64) {
+	fmt.Fprintf(sb, "# TYPE %v counter\n", name)
+	for c := range counters {
+		val := counters[c].Load()
+		if val == 0 {
+			continue
+		}
+		cmdName := cmdNames[CMD(c)]
+		if cmdName == "" {
+			cmdName = fmt.Sprintf("0x%02X", c)
+		}
+		fmt.Fprintf(sb, "%v{cmd=%q} %v\n", name, cmdName, val)
+	}
+}
+
+// Players, creatures and chunks per area
+func writeAreaGauges(sb *strings.Builder) {
+	processLock.RLock()
+	defer processLock.RUnlock()
+
+	type areaCount struct {
+		name                       string
+		players, creatures, chunks int
+	}
+	var counts []areaCount
+
+	for _, area := range areaList {
+		if area == nil {
+			continue
+		}
+		count := areaCount{name: area.Name, chunks: len(area.Chunks)}
+		for _, chunk := range area.Chunks {
+			count.players += int(chunk.numPlayers)
+			count.creatures += int(chunk.numCreatures)
+		}
+		counts = append(counts, count)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].name < counts[j].name })
+
+	sb.WriteString("# TYPE gommo_players gauge\n")
+	for _, c := range counts {
+		fmt.Fprintf(sb, "gommo_players{area=%q} %v\n", c.name, c.players)
+	}
+	sb.WriteString("# TYPE gommo_creatures gauge\n")
+	for _, c := range counts {
+		fmt.Fprintf(sb, "gommo_creatures{area=%q} %v\n", c.name, c.creatures)
+	}
+	sb.WriteString("# TYPE gommo_chunks gauge\n")
+	for _, c := range counts {
+		fmt.Fprintf(sb, "gommo_chunks{area=%q} %v\n", c.name, c.chunks)
+	}
+	fmt.Fprintf(sb, "# TYPE gommo_dropped_items gauge\ngommo_dropped_items %v\n", numDroppedItems)
+	fmt.Fprintf(sb, "# TYPE gommo_tick gauge\ngommo_tick %v\n", gameTick)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	minNameLength = 3  //In graphemes, what a player sees as one character
+	maxNameLength = 20 //In graphemes
+	maxNameBytes  = 64 //Combining marks can make a short name long
+
+	reservedNameFile = "reserved_names.json"
+	nameLogFile      = "names.log"
+	maxNameHistory   = 20 //Kept in each save, the log has all of them
+
+	zwnj = '\u200c' //Zero width non-joiner
+	zwj  = '\u200d' //Zero width joiner
+)
+
+var (
+	errNameShort    = errors.New("Name not long enough.")
+	errNameLong     = errors.New("Name too long.")
+	errNameEncoding = errors.New("Name is not valid UTF-8.")
+	errNameChars    = errors.New("Names can only have letters, numbers, single spaces and - _ . '")
+)
+
+// Names nobody can take, on top of any in reserved_names.json
+var defaultReservedNames = []string{"admin", "administrator", "moderator", "mod", "server",
+	"system", "console", "staff", "support", "gm"}
+
+var (
+	reservedNames = map[string]bool{}   //By nameKey
+	savedNames    = map[string]string{} //Account of each saved player, by nameKey of the account and display name
+	nameListsLock sync.Mutex
+	nameLogLock   sync.Mutex
+)
+
+// One display name change, kept with the player
+type nameChange struct {
+	Time time.Time
+	Old  string
+	New  string
+}
+
+// A line in log/names.log
+type nameLogEntry struct {
+	Time    time.Time
+	ID      uint32
+	Account string
+	Old     string
+	New     string
+}
+
+// Letters that look like a latin one, so they can't be used to pose as someone
+var confusables = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p',
+	'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j', 'ѕ': 's', 'ԁ': 'd',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x',
+}
+
+// Accented latin letters, by the letter without the accent. Decomposed
+// accents are marks, nameKey drops those.
+var accentFolds = map[rune]string{
+	'a': "àáâãäåāăą", 'c': "çćĉċč", 'd': "ďđ", 'e': "èéêëēĕėęě", 'g': "ĝğġģ",
+	'h': "ĥħ", 'i': "ìíîïĩīĭįı", 'j': "ĵ", 'k': "ķ", 'l': "ĺļľŀł", 'n': "ñńņň",
+	'o': "òóôõöøōŏő", 'r': "ŕŗř", 's': "śŝşš", 't': "ţťŧ", 'u': "ùúûüũūŭůűų",
+	'w': "ŵ", 'y': "ýÿŷ", 'z': "źżž",
+}
+
+func init() {
+	for base, accented := range accentFolds {
+		for _, r := range accented {
+			confusables[r] = base
+		}
+	}
+}
+
+// The part of a name that has to be unique: lowercase, without accents,
+// spaces or punctuation, and with lookalike letters folded together
+func nameKey(name string) string {
+	var key strings.Builder
+	for _, r := range name {
+		r = unicode.ToLower(r)
+		if unicode.IsMark(r) || r == zwj || r == zwnj || unicode.IsSpace(r) || unicode.IsPunct(r) {
+			continue
+		}
+		if folded, ok := confusables[r]; ok {
+			r = folded
+		}
+		key.WriteRune(r)
+	}
+	return key.String()
+}
+
+// Characters as a player would count them. Marks, joiners, variation
+// selectors and skin tones belong to the character before them, and
+// regional indicators (flags) come in pairs.
+func graphemeCount(text string) int {
+	count := 0
+	joined, flagHalf := false, false
+	for _, r := range text {
+		switch {
+		case unicode.IsMark(r), r >= 0xFE00 && r <= 0xFE0F, r >= 0x1F3FB && r <= 0x1F3FF:
+			count = max(count, 1)
+			continue
+		case r == zwj:
+			count = max(count, 1)
+			joined = true
+			continue
+		case r >= 0x1F1E6 && r <= 0x1F1FF:
+			if flagHalf {
+				flagHalf = false
+				continue
+			}
+			flagHalf = true
+		default:
+			flagHalf = false
+		}
+		if joined {
+			joined = false
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+func nameRuneAllowed(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsNumber(r) || strings.ContainsRune(" -_.'", r)
+}
+
+// Check a name a player asked for, the reply says what is wrong with it
+func validateName(name string) error {
+	if !utf8.ValidString(name) {
+		return errNameEncoding
+	}
+	if len(name) > maxNameBytes {
+		return errNameLong
+	}
+
+	hasLetter := false
+	runes := []rune(name)
+	for i, r := range runes {
+		switch {
+		case r == zwj || r == zwnj:
+			//Some scripts need these between letters
+			if i == 0 || i == len(runes)-1 {
+				return errNameChars
+			}
+		case r == ' ':
+			if i == 0 || i == len(runes)-1 || runes[i-1] == ' ' {
+				return errNameChars
+			}
+		case !nameRuneAllowed(r):
+			return errNameChars
+		case unicode.IsLetter(r):
+			hasLetter = true
+		}
+	}
+	if !hasLetter {
+		return errNameChars
+	}
+
+	length := graphemeCount(name)
+	if length < minNameLength {
+		return errNameShort
+	} else if length > maxNameLength {
+		return errNameLong
+	}
+	return nil
+}
+
+// Reserved names match with any numbers or punctuation added, "Admin_1" is "admin"
+func isReservedName(name string) bool {
+	key := strings.TrimFunc(nameKey(name), unicode.IsDigit)
+
+	nameListsLock.Lock()
+	defer nameListsLock.Unlock()
+	return reservedNames[key] || reservedNames[nameKey(name)]
+}
+
+// Account of the saved player using this name, "" if none
+func savedNameFor(name string) string {
+	nameListsLock.Lock()
+	defer nameListsLock.Unlock()
+	return savedNames[nameKey(name)]
+}
+
+// Called after a player is saved
+func addSavedName(account, display string) {
+	nameListsLock.Lock()
+	defer nameListsLock.Unlock()
+	savedNames[nameKey(account)] = account
+	savedNames[nameKey(display)] = account
+}
+
+// Free a display name that was given up, accounts keep theirs
+func removeSavedName(account, display string) {
+	nameListsLock.Lock()
+	defer nameListsLock.Unlock()
+	if nameKey(display) != nameKey(account) && savedNames[nameKey(display)] == account {
+		delete(savedNames, nameKey(display))
+	}
+}
+
+// Why a player can't take this name, nil if they can. processLock must be held.
+func checkNameAvailable(player *playerData, name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	if isBannedName(name) || isReservedName(name) {
+		return errors.New("That name is not allowed.")
+	}
+	if other := findPlayerByName(name); other != nil && other != player {
+		return errors.New("That name is in use.")
+	}
+
+	//Saved players keep their names while offline, the owner picks their
+	//save up with its password through claimAccount
+	owner := savedNameFor(name)
+	if owner == "" || strings.EqualFold(owner, player.account) {
+		return nil
+	}
+	return errors.New("That name is taken.")
+}
+
+// Time left before this player can change their display name again
+func renameWait(player *playerData) time.Duration {
+	cooldown := time.Duration(config.Load().NameCooldownMinutes) * time.Minute
+	if player.lastRename.IsZero() {
+		return 0
+	}
+	return max(cooldown-time.Since(player.lastRename), 0)
+}
+
+// Change a display name, the account stays the same. Everyone is told, and
+// the change is logged for moderators.
+func renamePlayer(player *playerData, name string) {
+	old := player.name
+	change := nameChange{Time: time.Now().UTC(), Old: old, New: name}
+
+	player.name = name
+	player.lastRename = change.Time
+	player.nameHistory = append(player.nameHistory, change)
+	if len(player.nameHistory) > maxNameHistory {
+		player.nameHistory = player.nameHistory[len(player.nameHistory)-maxNameHistory:]
+	}
+
+	logInfo(SUB_ADMIN, "%v (%v) renamed to %v, account %v", old, player.id, name, player.account)
+	writeNameLog(nameLogEntry{Time: change.Time, ID: player.id, Account: player.account, Old: old, New: name})
+
+	if player.account != "" {
+		removeSavedName(player.account, old)
+		savePlayer(player)
+	}
+	sendPlayernames(player, true)
+	send_chat(fmt.Sprintf("%v is now known as %v.", old, name))
+}
+
+func writeNameLog(entry nameLogEntry) {
+	defer reportPanic("writeNameLog")
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logError(SUB_ADMIN, "writeNameLog: %v", err)
+		return
+	}
+
+	nameLogLock.Lock()
+	defer nameLogLock.Unlock()
+
+	os.MkdirAll(logDir, 0755)
+	file, err := os.OpenFile(filepath.Join(logDir, nameLogFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logError(SUB_ADMIN, "writeNameLog: %v", err)
+		return
+	}
+	defer file.Close()
+
+	file.Write(append(data, '\n'))
+}
+
+// Logged changes to or from a name, or on its account, newest last
+func searchNameLog(name string, limit int) []nameLogEntry {
+	nameLogLock.Lock()
+	data, err := os.ReadFile(filepath.Join(logDir, nameLogFile))
+	nameLogLock.Unlock()
+	if err != nil {
+		return nil
+	}
+
+	key := nameKey(name)
+	found := []nameLogEntry{}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var entry nameLogEntry
+		if len(line) == 0 || json.Unmarshal(line, &entry) != nil {
+			continue
+		}
+		if nameKey(entry.Account) == key || nameKey(entry.Old) == key || nameKey(entry.New) == key {
+			found = append(found, entry)
+		}
+	}
+	if len(found) > limit {
+		found = found[len(found)-limit:]
+	}
+	return found
+}
+
+// Load the reserved list and index saved players, at startup
+func loadNameLists() {
+	reserved := map[string]bool{}
+	for _, name := range defaultReservedNames {
+		reserved[nameKey(name)] = true
+	}
+
+	filePath := fmt.Sprintf("%v/%v", dataDir, reservedNameFile)
+	if data, err := os.ReadFile(filePath); err == nil {
+		var names []string
+		if err := json.NewDecoder(bytes.NewBuffer(data)).Decode(&names); err != nil {
+			logError(SUB_ADMIN, "Unable to decode json: %v", filePath)
+		}
+		for _, name := range names {
+			reserved[nameKey(name)] = true
+		}
+	}
+
+	saved := map[string]string{}
+	dir := fmt.Sprintf("%v/%v", dataDir, playerDir)
+	files, _ := os.ReadDir(dir)
+	for _, file := range files {
+		data, err := os.ReadFile(dir + "/" + file.Name())
+		if err != nil {
+			continue
+		}
+		var sdat playerSave
+		if err := json.Unmarshal(data, &sdat); err != nil || sdat.Name == "" {
+			logError(SUB_SAVE, "Unable to decode json: %v/%v", dir, file.Name())
+			continue
+		}
+		if other, ok := saved[nameKey(sdat.Name)]; ok {
+			logWarn(SUB_SAVE, "Saved players %q and %q look the same, only %q can be reclaimed", other, sdat.Name, other)
+			continue
+		}
+		saved[nameKey(sdat.Name)] = sdat.Name
+		if sdat.Display != "" {
+			if _, ok := saved[nameKey(sdat.Display)]; !ok {
+				saved[nameKey(sdat.Display)] = sdat.Name
+			}
+		}
+	}
+
+	nameListsLock.Lock()
+	reservedNames, savedNames = reserved, saved
+	nameListsLock.Unlock()
+
+	logInfo(SUB_SAVE, "Loaded %v reserved names, %v saved players.", len(reserved), len(saved))
+}
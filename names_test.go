@@ -0,0 +1,485 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"goMMOServ/protocol"
+)
+
+// Swap in empty name lists with the default reserved names
+func newNameTest(t *testing.T) *testWorld {
+	t.Helper()
+	w := newTestWorld(t)
+
+	oldReserved, oldSaved, oldBans := reservedNames, savedNames, banList
+	t.Cleanup(func() { reservedNames, savedNames, banList = oldReserved, oldSaved, oldBans })
+	reservedNames = map[string]bool{}
+	for _, name := range defaultReservedNames {
+		reservedNames[nameKey(name)] = true
+	}
+	savedNames = map[string]string{}
+	banList = nil
+	return w
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name string
+		want error
+	}{
+		{"Tester", nil},
+		{"Zoë", nil},
+		{"Zoe\u0308", nil},       //e and a combining diaeresis is one character
+		{"김민준", nil},             //Three characters, nine bytes
+		{"Мария", nil},           //Cyrillic
+		{"Jean-Luc O'Neil", nil}, //Single spaces and punctuation
+		{"क्षत्रिय", nil},        //Devanagari with virama marks
+		{"Ab", errNameShort},
+		{"Ae\u0301\u0301", errNameShort}, //Marks don't add length
+		{strings.Repeat("x", maxNameLength+1), errNameLong},
+		{strings.Repeat("é", maxNameLength), nil},
+		{"e" + strings.Repeat("\u0301", 40), errNameLong}, //Over maxNameBytes
+		{"bad\xffname", errNameEncoding},
+		{" Tester", errNameChars},
+		{"Test  er", errNameChars},
+		{"Tester\u200d", errNameChars},
+		{"Test\ner", errNameChars},
+		{"Tester\U0001F600", errNameChars},
+		{"1234", errNameChars}, //No letters
+	}
+
+	for _, tc := range tests {
+		if got := validateName(tc.name); got != tc.want {
+			t.Errorf("%q: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestGraphemeCount(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"Zoë", 3},
+		{"김민준", 3},
+		{"\U0001F44D\U0001F3FD", 1},       //Skin tone
+		{"\U0001F469\u200d\U0001F4BB", 1}, //Joined emoji
+		{"\U0001F1F3\U0001F1FF\U0001F1EF\U0001F1F5", 2}, //Two flags
+		{"\u0301a", 2},       //A mark with nothing before it
+		{"\u2764\uFE0F!", 2}, //Variation selector
+	}
+
+	for _, tc := range tests {
+		if got := graphemeCount(tc.text); got != tc.want {
+			t.Errorf("%q: got %v, want %v", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestNameKey(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"Tester", "tester", true},
+		{"Zoë", "Zoe", true},
+		{"Zoë", "Zoë", true},
+		{"Jean-Luc", "jean luc", true},
+		{"Paypal", "P\u0430yp\u0430l", true}, //Cyrillic a
+		{"Omega", "\u039fmega", true},        //Greek omicron
+		{"Tester", "Tester2", false},
+		{"김민준", "김민수", false},
+	}
+
+	for _, tc := range tests {
+		if got := nameKey(tc.a) == nameKey(tc.b); got != tc.same {
+			t.Errorf("%q and %q: same %v, want %v", tc.a, tc.b, got, tc.same)
+		}
+	}
+}
+
+func TestCheckNameAvailable(t *testing.T) {
+	w := newNameTest(t)
+	player := w.addPlayer(XYf32{X: 0, Y: 0})
+	player.name, player.account = "Zoë", "Zoë"
+	other := w.addPlayer(XYf32{X: 0, Y: 0})
+	other.name = ""
+	addSavedName("Mallory", "Mallory")
+	banList = []*banEntry{{Name: "Griefer"}}
+
+	tests := []struct {
+		name string
+		want string //The reply, "" if allowed
+	}{
+		{"Alice", ""},
+		{"Zoe", "That name is in use."},
+		{"ZOË", "That name is in use."},
+		{"Mallory", "That name is taken."}, //Only with the password, through /account
+		{"mallory", "That name is taken."},
+		{"Ma11ory", ""},
+		{"M\u0430llory", "That name is taken."}, //Cyrillic a
+		{"Admin_7", "That name is not allowed."},
+		{"M\u043ed", "That name is not allowed."}, //Cyrillic o
+		{"griefer", "That name is not allowed."},
+		{"Ab", errNameShort.Error()},
+	}
+
+	for _, tc := range tests {
+		err := checkNameAvailable(other, tc.name)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	//Someone can respell their own name
+	if err := checkNameAvailable(player, "Zoe"); err != nil {
+		t.Errorf("respelling own name: %v", err)
+	}
+}
+
+// Saved players and data/reserved_names.json are read at startup
+func TestLoadNameLists(t *testing.T) {
+	newNameTest(t)
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	os.MkdirAll(dataDir+"/"+playerDir, 0755)
+	os.WriteFile(dataDir+"/"+reservedNameFile, []byte(`["Dragon King"]`), 0644)
+	savePlayer(&playerData{name: "Zoë", account: "Zoë", level: 1})
+
+	loadNameLists()
+	if !isReservedName("dragonking") || !isReservedName("Admin") {
+		t.Errorf("reserved names from the file and defaults not loaded")
+	}
+	if got := savedNameFor("ZOE"); got != "Zoë" {
+		t.Errorf("saved name for ZOE: got %q, want Zoë", got)
+	}
+}
+
+// Names go out as UTF-8 from VersionNames, and as a rune per int32 before it
+func TestSendPlayernames(t *testing.T) {
+	w := newNameTest(t)
+	named := w.addPlayer(XYf32{X: 0, Y: 0})
+	named.name = "김민준"
+
+	tests := []struct {
+		name    string
+		version uint16
+	}{
+		{"runes", protocol.VersionNames - 1},
+		{"utf-8", protocol.VersionNames},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			player := w.addPlayer(XYf32{X: 0, Y: 0})
+			conn := &fakeConn{}
+			player.conn = conn
+			player.protoVersion = tc.version
+
+			sendPlayernames(named, true)
+			if len(conn.sent) != 1 || CMD(conn.sent[0][0]) != CMD_PlayerNamesComp {
+				t.Fatalf("sent %v messages, want one CMD_PlayerNamesComp", len(conn.sent))
+			}
+			msg, err := protocol.DecodePlayerNamesComp(conn.sent[0][1:], tc.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msg.Names) != 1 || msg.Names[0].Name != "김민준" {
+				t.Errorf("got %+v", msg.Names)
+			}
+		})
+	}
+}
+
+// Work in a temp dir, saves and the name log are written there
+func newAccountTest(t *testing.T) *testWorld {
+	t.Helper()
+	w := newNameTest(t)
+
+	oldConfig := config.Load()
+	config.Store(defaultConfig())
+	loginFailList = map[string]*loginFails{}
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	t.Cleanup(func() {
+		config.Store(oldConfig)
+		os.Chdir(wd)
+	})
+	return w
+}
+
+func TestAccountAndDisplayName(t *testing.T) {
+	w := newAccountTest(t)
+	player := w.addPlayer(XYf32{X: 0, Y: 0})
+	player.name = ""
+
+	//Picking the account sets the first display name
+	runAs(player, false, "/account Mallory hunter22")
+	if player.account != "Mallory" || player.name != "Mallory" {
+		t.Fatalf("account %q, name %q, want both Mallory", player.account, player.name)
+	}
+
+	if got := runAs(player, false, "/name Mal the Great"); player.name != "Mal the Great" {
+		t.Fatalf("rename: %v", got)
+	}
+	if player.account != "Mallory" {
+		t.Errorf("account changed to %q", player.account)
+	}
+	if got := runAs(player, false, "/account Other hunter22"); player.account != "Mallory" {
+		t.Errorf("account switched: %v", got)
+	}
+
+	//Too soon for another
+	got := runAs(player, false, "/name Mal")
+	if player.name != "Mal the Great" || len(got) != 1 || !strings.HasPrefix(got[0], "You can change your name again in") {
+		t.Errorf("second rename inside the cooldown: %v, name %q", got, player.name)
+	}
+	player.lastRename = player.lastRename.Add(-time.Duration(config.Load().NameCooldownMinutes) * time.Minute)
+	runAs(player, false, "/name Mal")
+	if player.name != "Mal" {
+		t.Errorf("rename after the cooldown: name %q", player.name)
+	}
+
+	//Nobody else can take either the account or the dropped name right away,
+	//but the old display name is free again
+	other := w.addPlayer(XYf32{X: 0, Y: 0})
+	other.name = ""
+	for _, name := range []string{"Mallory", "Mal", "mal"} {
+		if err := checkNameAvailable(other, name); err == nil {
+			t.Errorf("%q: available to someone else", name)
+		}
+	}
+	if err := checkNameAvailable(other, "Mal the Great"); err != nil {
+		t.Errorf("given up name: %v", err)
+	}
+
+	//Back on the same account later, with the display name and history
+	removePlayer(player, "test")
+	returning := w.addPlayer(XYf32{X: 0, Y: 0})
+	returning.name = ""
+	runAs(returning, false, "/account Mallory hunter22")
+	if returning.name != "Mal" || len(returning.nameHistory) != 2 {
+		t.Errorf("loaded name %q with %v changes, want Mal with 2", returning.name, len(returning.nameHistory))
+	}
+	if wait := renameWait(returning); wait == 0 {
+		t.Errorf("cooldown lost on reload")
+	}
+}
+
+// Guests can rename too, with the same cooldown and the same names off limits
+func TestGuestRename(t *testing.T) {
+	w := newAccountTest(t)
+	owner := w.addPlayer(XYf32{X: 0, Y: 0})
+	owner.name = ""
+	runAs(owner, false, "/account Mallory hunter22")
+	removePlayer(owner, "test")
+
+	guest := w.addPlayer(XYf32{X: 0, Y: 0})
+	guest.name = "Player-1"
+
+	tests := []struct {
+		line  string
+		reply string
+		name  string
+	}{
+		{"/name Mallory", "That name is taken.", "Player-1"},
+		{"/name Admin", "That name is not allowed.", "Player-1"},
+		{"/name Wanderer", "Name changed.", "Wanderer"},
+		{"/name Rover", "You can change your name again in", "Wanderer"},
+	}
+
+	for _, tc := range tests {
+		replies := runAs(guest, false, tc.line)
+		if len(replies) != 1 || !strings.HasPrefix(replies[0], tc.reply) || guest.name != tc.name {
+			t.Errorf("%q: got %q, name %q, want %q, name %q", tc.line, replies, guest.name, tc.reply, tc.name)
+		}
+	}
+	if guest.account != "" {
+		t.Errorf("renaming gave a guest account %q", guest.account)
+	}
+	if changes := searchNameLog("Wanderer", 10); len(changes) != 1 || changes[0].Account != "" {
+		t.Errorf("guest rename log: %+v", changes)
+	}
+}
+
+// A save is only loaded with its password, old saves need one set first
+func TestAccountPassword(t *testing.T) {
+	w := newAccountTest(t)
+	owner := w.addPlayer(XYf32{X: 0, Y: 0})
+	owner.name = ""
+	runAs(owner, false, "/account Mallory hunter22")
+	owner.xp, owner.level = 500, 4
+	savePlayer(owner)
+	removePlayer(owner, "test")
+
+	writePlayerSave(&playerSave{Version: 2, Name: "Oldtimer", Display: "Oldtimer", Level: 7})
+	addSavedName("Oldtimer", "Oldtimer")
+
+	tests := []struct {
+		line  string
+		reply string
+		level uint8 //Loaded level, 0 if nothing loads
+	}{
+		{"/account Mallory", "Usage: /account AccountName Password", 0},
+		{"/account Mallory wrong", errWrongPassword.Error(), 0},
+		{"/account Oldtimer hunter22", errNoPassword.Error(), 0},
+		{"/account Bob short", errShortPassword.Error(), 0},
+		{"/account mallory hunter22", "Welcome back Mallory, level 4.", 4},
+	}
+
+	for _, tc := range tests {
+		player := w.addPlayer(XYf32{X: 0, Y: 0})
+		player.name = ""
+		replies := runAs(player, false, tc.line)
+		if len(replies) != 1 || replies[0] != tc.reply {
+			t.Errorf("%q: got %q, want %q", tc.line, replies, tc.reply)
+		}
+		if tc.level == 0 && player.account != "" {
+			t.Errorf("%q: got account %q", tc.line, player.account)
+		}
+		if tc.level != 0 && (player.account != "Mallory" || player.level != tc.level) {
+			t.Errorf("%q: account %q level %v, want Mallory level %v", tc.line, player.account, player.level, tc.level)
+		}
+		removePlayer(player, "test")
+	}
+
+	//An admin sets a password for the old save, and the player changes it
+	if replies := runAs(nil, true, "/setpassword Oldtimer letmein1"); len(replies) != 1 || replies[0] != "Password set." {
+		t.Fatalf("/setpassword: %q", replies)
+	}
+	player := w.addPlayer(XYf32{X: 0, Y: 0})
+	player.name = ""
+	runAs(player, false, "/account Oldtimer letmein1")
+	if player.account != "Oldtimer" || player.level != 7 {
+		t.Fatalf("old save: account %q level %v", player.account, player.level)
+	}
+	runAs(player, false, "/password letmein1 newsecret")
+	if sdat, _ := readPlayerSave("Oldtimer"); checkPassword(sdat.PassHash, "newsecret") != nil {
+		t.Errorf("/password: new password not saved")
+	}
+}
+
+// Wrong passwords lock out both the address and the account for a while
+func TestLoginLimit(t *testing.T) {
+	w := newAccountTest(t)
+	owner := w.addPlayer(XYf32{X: 0, Y: 0})
+	owner.name = ""
+	runAs(owner, false, "/account Mallory hunter22")
+	removePlayer(owner, "test")
+
+	guesser := w.addPlayer(XYf32{X: 0, Y: 0})
+	guesser.name, guesser.addr = "", "10.0.0.1"
+	for i := 0; i < maxLoginFails; i++ {
+		if replies := runAs(guesser, false, "/account Mallory guess"+strconv.Itoa(i)); len(replies) != 1 || replies[0] != errWrongPassword.Error() {
+			t.Fatalf("guess %v: %q", i, replies)
+		}
+	}
+	if guesser.cheat.score < maxLoginFails*scoreBadPassword {
+		t.Errorf("cheat score %v after %v wrong passwords", guesser.cheat.score, maxLoginFails)
+	}
+
+	tests := []struct {
+		addr   string
+		line   string
+		locked bool
+	}{
+		{"10.0.0.1", "/account Mallory hunter22", true},
+		{"10.0.0.2", "/account Mallory hunter22", true},
+		{"10.0.0.1", "/account Alice hunter22", true},
+		{"10.0.0.2", "/account Alice hunter22", false},
+	}
+
+	for _, tc := range tests {
+		player := w.addPlayer(XYf32{X: 0, Y: 0})
+		player.name, player.addr = "", tc.addr
+		replies := runAs(player, false, tc.line)
+		locked := len(replies) == 1 && strings.HasPrefix(replies[0], "Too many wrong passwords")
+		if locked != tc.locked || (player.account != "") == tc.locked {
+			t.Errorf("%v %q: %q, account %q", tc.addr, tc.line, replies, player.account)
+		}
+		removePlayer(player, "test")
+	}
+}
+
+func TestNameHistory(t *testing.T) {
+	w := newAccountTest(t)
+	config.Load().NameCooldownMinutes = 0
+	player := w.addPlayer(XYf32{X: 0, Y: 0})
+	player.name = ""
+	runAs(player, false, "/account Alice hunter22")
+	runAs(player, false, "/name Bob")
+	runAs(player, false, "/name Carol")
+
+	changes := searchNameLog("Bob", 10)
+	if len(changes) != 2 || changes[0].New != "Bob" || changes[1].Old != "Bob" {
+		t.Fatalf("log for Bob: %+v", changes)
+	}
+	if changes := searchNameLog("Alice", 10); len(changes) != 2 {
+		t.Errorf("log by account: %v changes, want 2", len(changes))
+	}
+	if changes := searchNameLog("Alice", 1); len(changes) != 1 || changes[0].New != "Carol" {
+		t.Errorf("limit keeps the newest: %+v", changes)
+	}
+
+	replies := runAs(nil, true, "/names Bob")
+	want := "Nobody has that name now."
+	if len(replies) != 4 || replies[0] != want || !strings.Contains(replies[3], "Bob -> Carol") {
+		t.Errorf("/names Bob: %q", replies)
+	}
+	if replies := runAs(player, false, "/names Bob"); len(replies) != 1 {
+		t.Errorf("/names is for admins: %q", replies)
+	}
+}
+
+// New clients get chat tagged with the sender's ID, older ones the text
+func TestChatFrom(t *testing.T) {
+	w := newNameTest(t)
+	speaker := w.addPlayer(XYf32{X: 0, Y: 0})
+	speaker.name = "Mallory"
+
+	tests := []struct {
+		name    string
+		version uint16
+		want    CMD
+	}{
+		{"tagged", protocol.VersionChatFrom, CMD_ChatFrom},
+		{"plain", protocol.VersionChatFrom - 1, CMD_Chat},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			player := w.addPlayer(XYf32{X: 0, Y: 0})
+			conn := &fakeConn{}
+			player.conn = conn
+			player.protoVersion = tc.version
+
+			cmd_chat(speaker, []byte("hello"))
+			if len(conn.sent) != 1 || CMD(conn.sent[0][0]) != tc.want {
+				t.Fatalf("sent %v messages, want one %v", len(conn.sent), cmdNames[tc.want])
+			}
+			if tc.want == CMD_Chat {
+				if got := string(conn.sent[0][1:]); got != "Mallory says: hello" {
+					t.Errorf("got %q", got)
+				}
+				return
+			}
+			msg, err := protocol.DecodeChatFrom(conn.sent[0][1:])
+			want := protocol.ChatFrom{ID: speaker.id, Channel: protocol.CHAT_SAY, Text: "hello"}
+			if err != nil || msg != want {
+				t.Errorf("got %+v, %v, want %+v", msg, err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import "goMMOServ/protocol"
+
+// Clients that get bit-packed world updates
+func wantsPacked(player *playerData) bool {
+	return player.protoVersion >= protocol.VersionPacked && player.caps&protocol.CAP_PACKED_RECORDS != 0
+}
+
+// Packed records carry health as a percent, injured players are at 0
+func healthPercent(player *playerData) int16 {
+	if player.health <= 0 || player.maxHealth <= 0 {
+		return 0
+	}
+	return int16(min(int(player.health)*100/int(player.maxHealth), 100))
+}
+
+// Build a chunk's packed records for this tick. Every packed update that
+// sees the chunk shares them, so this runs before serializing, not in it.
+func cachePackedChunk(chunk *chunkData, chunkPos XY) {
+	//PLAYERS
+	if chunk.packedPlayers == nil || chunk.ppCacheTick != gameTick {
+		recs := make([]protocol.PlayerRecord, 0, len(chunk.players))
+		for _, target := range chunk.players {
+			pos := floorXY(&target.pos)
+			recs = append(recs, protocol.PlayerRecord{ID: target.id, X: pos.X, Y: pos.Y,
+				Dir: uint8(target.dir), Health: healthPercent(target), Effects: uint8(target.effects)})
+		}
+		chunk.packedPlayers = protocol.PackPlayers(chunkPos.X, chunkPos.Y, recs)
+		chunk.ppCacheTick = gameTick
+	}
+
+	/* WORLD OBJECTS */
+	//Kept until the objects change
+	if !chunk.hasPackedOcache {
+		recs := make([]protocol.ObjectRecord, 0, len(chunk.WorldObjects))
+		for _, obj := range chunk.WorldObjects {
+			recs = append(recs, protocol.ObjectRecord{Section: obj.ID.Section, Num: obj.ID.Num,
+				Sprite: obj.ID.Sprite, X: obj.Pos.X, Y: obj.Pos.Y})
+		}
+		chunk.packedObjects = protocol.PackObjects(chunkPos.X, chunkPos.Y, recs)
+		chunk.hasPackedOcache = true
+	}
+
+	/* CREATURES */
+	if chunk.packedCreatures == nil || chunk.pcCacheTick != gameTick {
+		recs := make([]protocol.CreatureRecord, 0, len(chunk.creatrues))
+		for _, cre := range chunk.creatrues {
+			pos := floorXY(&cre.pos)
+			recs = append(recs, protocol.CreatureRecord{UID: cre.creatureData.id.UID,
+				Section: cre.creatureData.id.Section, Num: cre.creatureData.id.Num, X: pos.X, Y: pos.Y,
+				Dir: uint8(cre.dir), Health: healthPercent(cre), Effects: uint8(cre.effects)})
+		}
+		chunk.packedCreatures = protocol.PackCreatures(chunkPos.X, chunkPos.Y, recs)
+		chunk.pcCacheTick = gameTick
+	}
+}
+
+// One chunk of a packed world update, nil if it has nothing for this player.
+// Only reads the chunk, cachePackedChunk has already run this tick. dx, dy is per player.
+func packChunk(player *playerData, chunk *chunkData, chunkPos XY, dx, dy int) []byte {
+	//Objects only the first time this player sees the chunk
+	var objects []byte
+	if player.visCache[chunkPos] == nil {
+		addVis(player, chunkPos)
+		if len(chunk.WorldObjects) > 0 {
+			objects = chunk.packedObjects
+		}
+	}
+
+	//Nothing to send, skip the chunk
+	if len(chunk.players) == 0 && objects == nil && len(chunk.creatrues) == 0 {
+		return nil
+	}
+	return protocol.AppendPackedChunk(nil, int8(dx), int8(dy), chunk.packedPlayers, objects, chunk.packedCreatures)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"testing"
+
+	"goMMOServ/protocol"
+
+	"github.com/remeh/sizedwaitgroup"
+)
+
+// Add a player that gets world updates, packed or plain
+func addViewer(w *testWorld, pos XYf32, packed bool) (*playerData, *fakeConn) {
+	player := w.addPlayer(pos)
+	conn := &fakeConn{}
+	player.conn = conn
+	player.protoVersion = protocol.Version
+	if packed {
+		player.caps = protocol.CAP_PACKED_RECORDS
+	}
+	return player, conn
+}
+
+func serializeOnce() {
+	wg := sizedwaitgroup.New(2)
+	processLock.Lock()
+	serializeTick(&wg)
+	processLock.Unlock()
+}
+
+// Both layouts describe the same world, the packed one in fewer bytes
+func TestPackedWorldUpdate(t *testing.T) {
+	w := newTestWorld(t)
+	w.step(1)
+
+	_, plainConn := addViewer(w, XYf32{X: 0, Y: 0}, false)
+	_, packedConn := addViewer(w, XYf32{X: 0, Y: 0}, true)
+
+	injured := w.addPlayer(XYf32{X: 40, Y: -20})
+	downPlayer(injured)
+	w.addObject(XYf32{X: -300, Y: 10}, IID{Section: 3, Num: 1, Sprite: 2})
+	for i := 0; i < 20; i++ {
+		creature := w.addCreature(XYf32{X: float32(i*30 - 300), Y: 100}, CRE_IDLE)
+		creature.health = int16(i * 5)
+	}
+
+	//Only the world update
+	plainConn.sent, packedConn.sent = nil, nil
+	serializeOnce()
+	if len(plainConn.sent) != 1 || len(packedConn.sent) != 1 {
+		t.Fatalf("sent %v plain and %v packed messages, want one each", len(plainConn.sent), len(packedConn.sent))
+	}
+
+	plain, err := protocol.DecodeWorldUpdate(plainConn.sent[0][1:], protocol.Version)
+	if err != nil {
+		t.Fatalf("plain: %v", err)
+	}
+	packed, err := protocol.DecodePackedWorldUpdate(packedConn.sent[0][1:])
+	if err != nil {
+		t.Fatalf("packed: %v", err)
+	}
+
+	if len(packed.Players) != len(plain.Players) || len(packed.Objects) != len(plain.Objects) ||
+		len(packed.Creatures) != len(plain.Creatures) {
+		t.Fatalf("packed %v/%v/%v records, plain %v/%v/%v", len(packed.Players), len(packed.Objects),
+			len(packed.Creatures), len(plain.Players), len(plain.Objects), len(plain.Creatures))
+	}
+	byID := map[uint32]*playerData{}
+	for _, player := range playerList {
+		byID[player.id] = player
+	}
+	for i, rec := range packed.Players {
+		want := plain.Players[i]
+		if rec.ID != want.ID || rec.X != want.X || rec.Y != want.Y || rec.Dir != want.Dir ||
+			rec.Health != healthPercent(byID[rec.ID]) {
+			t.Errorf("player %v: packed %+v, plain %+v", i, rec, want)
+		}
+	}
+	for i, rec := range packed.Creatures {
+		want := plain.Creatures[i]
+		if rec.UID != want.UID || rec.X != want.X || rec.Y != want.Y || rec.Dir != want.Dir ||
+			rec.Health != want.Health*100/defaultMaxHealth {
+			t.Errorf("creature %v: packed %+v, plain %+v", i, rec, want)
+		}
+	}
+	if packed.Objects[0] != plain.Objects[0] {
+		t.Errorf("object: packed %+v, plain %+v", packed.Objects[0], plain.Objects[0])
+	}
+	if size, plainSize := len(packedConn.sent[0]), len(plainConn.sent[0]); size >= plainSize {
+		t.Errorf("packed update %vb, plain %vb", size, plainSize)
+	}
+
+	//Objects are only sent the first time
+	serializeOnce()
+	packed, err = protocol.DecodePackedWorldUpdate(packedConn.sent[1][1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packed.Objects) != 0 || len(packed.Creatures) != 20 {
+		t.Errorf("second update: %v objects, %v creatures, want 0 and 20", len(packed.Objects), len(packed.Creatures))
+	}
+}
+
+// Objects added or removed after a chunk was sent go out again, as they do plain
+func TestPackedObjectChanges(t *testing.T) {
+	w := newTestWorld(t)
+	_, conn := addViewer(w, XYf32{X: 0, Y: 0}, true)
+	first := w.addObject(XYf32{X: 30, Y: 10}, IID{Section: 3, Num: 1, Sprite: 2})
+	serializeOnce()
+
+	objects := func() []protocol.ObjectRecord {
+		t.Helper()
+		msg, err := protocol.DecodePackedWorldUpdate(conn.sent[len(conn.sent)-1][1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg.Objects
+	}
+	if got := objects(); len(got) != 1 {
+		t.Fatalf("first update: %v objects, want 1", len(got))
+	}
+
+	w.addObject(XYf32{X: 60, Y: 10}, IID{Section: 3, Num: 2, Sprite: 0})
+	serializeOnce()
+	if got := objects(); len(got) != 2 {
+		t.Fatalf("after adding: %v objects, want 2", len(got))
+	}
+
+	removeWorldObject(w.area, first.Pos, first.ID)
+	serializeOnce()
+	if got := objects(); len(got) != 1 || got[0].Num != 2 {
+		t.Errorf("after removing: %+v, want the second object", got)
+	}
+}
+
+func TestHealthPercent(t *testing.T) {
+	tests := []struct {
+		health, maxHealth int16
+		want              int16
+	}{
+		{100, 100, 100},
+		{50, 200, 25},
+		{1, 300, 0},
+		{-44, 100, 0},
+		{150, 100, 100},
+		{10, 0, 0},
+	}
+
+	for _, tc := range tests {
+		player := &playerData{health: tc.health, maxHealth: tc.maxHealth}
+		if got := healthPercent(player); got != tc.want {
+			t.Errorf("%v/%v: got %v, want %v", tc.health, tc.maxHealth, got, tc.want)
+		}
+	}
+}
+
+// Viewers sharing chunks all get the whole chunk, run with -race
+func TestSharedChunkUpdates(t *testing.T) {
+	w := newTestWorld(t)
+	w.step(1)
+	w.addObject(XYf32{X: 30, Y: 10}, IID{Section: 3, Num: 1, Sprite: 2})
+	w.addCreature(XYf32{X: 60, Y: 10}, CRE_IDLE)
+
+	var packedConns, plainConns []*fakeConn
+	for i := 0; i < 4; i++ {
+		_, conn := addViewer(w, XYf32{X: float32(i), Y: 0}, true)
+		packedConns = append(packedConns, conn)
+		_, conn = addViewer(w, XYf32{X: float32(i), Y: 0}, false)
+		plainConns = append(plainConns, conn)
+	}
+	serializeOnce()
+
+	for i, conn := range packedConns {
+		msg, err := protocol.DecodePackedWorldUpdate(conn.sent[len(conn.sent)-1][1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msg.Players) != 8 || len(msg.Objects) != 1 || len(msg.Creatures) != 1 {
+			t.Errorf("packed viewer %v: %v/%v/%v records, want 8/1/1", i, len(msg.Players), len(msg.Objects), len(msg.Creatures))
+		}
+	}
+	for i, conn := range plainConns {
+		msg, err := protocol.DecodeWorldUpdate(conn.sent[len(conn.sent)-1][1:], protocol.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msg.Players) != 8 || len(msg.Objects) != 1 || len(msg.Creatures) != 1 {
+			t.Errorf("plain viewer %v: %v/%v/%v records, want 8/1/1", i, len(msg.Players), len(msg.Objects), len(msg.Creatures))
+		}
+	}
+}
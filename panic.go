@@ -4,40 +4,191 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	hdFileName = "heapDump.dat"
-	pLogName   = "panic.log"
+	crashDir   = "crash"
+	hdFileName = "heapDump"
 	version    = "0.0.21"
 	buildInfo  = "dev"
 )
 
+var (
+	crashTimes    []time.Time
+	crashedPlayer []*playerData
+	crashLock     sync.Mutex
+
+	crashLabelClean = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+)
+
+// Recover, write a crash report and keep going
 func reportPanic(format string, args ...interface{}) {
 	if r := recover(); r != nil {
+		writeCrashReport(fmt.Sprintf(format, args...), r)
+	}
+}
+
+// Recover from a panic caused by one player or creature, and get it out of the game
+func recoverEntity(player *playerData, label string) {
+	if r := recover(); r != nil {
+		if player != nil && player.creatureData != nil {
+			label = fmt.Sprintf("%v creature %v", label, player.creatureData.id.UID)
+		} else if player != nil {
+			label = fmt.Sprintf("%v player %v", label, player.id)
+		}
+		writeCrashReport(label, r)
+		isolateEntity(player)
+	}
+}
+
+// Queue an entity for removal, done at the start of the next tick
+func isolateEntity(player *playerData) {
+	if player == nil {
+		return
+	}
+
+	crashLock.Lock()
+	crashedPlayer = append(crashedPlayer, player)
+	crashLock.Unlock()
+}
+
+// Remove entities that caused panics, processLock must be held
+func processIsolated() {
+	crashLock.Lock()
+	isolated := crashedPlayer
+	crashedPlayer = []*playerData{}
+	crashLock.Unlock()
+
+	for _, player := range isolated {
+		if player.creatureData != nil {
+			pendingDefeats = append(pendingDefeats, player)
+		} else {
+			removePlayer(player, "server error")
+		}
+	}
+	if len(isolated) > 0 {
+		processDefeats()
+	}
+}
+
+// Write a timestamped report, trim old ones and count towards the crash limit
+func writeCrashReport(label string, r interface{}) {
+	now := time.Now()
+	file, line := panicLocation()
+	stack := string(debug.Stack())
+
+	logError(SUB_GENERAL, "Panic: %v: %v (%v:%v)", label, r, file, line)
+
+	os.MkdirAll(crashDir, 0755)
+	baseName := fmt.Sprintf("%v/crash-%v-%v", crashDir, now.Format("2006-01-02T15-04-05.000"),
+		strings.Trim(crashLabelClean.ReplaceAllString(label, "_"), "_"))
+
+	buf := fmt.Sprintf(
+		"(GAME CRASH)\nBUILD:v%v-%v\nTime: %v\nTick: %v\nLabel:%v File: %v Line: %v\nError:%v\n\nStack Trace:\n%v\n",
+		version, buildInfo, now.Format(time.RFC3339Nano), gameTick, label, file, line, r, stack)
 
-		doLog(false, "Writing '%v' file.", hdFileName)
-		f, err := os.Create(hdFileName)
+	err := os.WriteFile(baseName+".txt", []byte(buf), 0660)
+	if err != nil {
+		logError(SUB_GENERAL, "Failed to write crash report: %v", err)
+	} else {
+		logInfo(SUB_GENERAL, "wrote %v.txt", baseName)
+	}
+
+	if config.Load().CrashHeapDump {
+		f, err := os.Create(baseName + "-" + hdFileName + ".dat")
 		if err == nil {
 			debug.WriteHeapDump(f.Fd())
 			f.Close()
-			doLog(true, "wrote heapDump")
+			logInfo(SUB_GENERAL, "wrote heapDump")
 		} else {
-			doLog(false, "Failed to write '%v' file.", hdFileName)
+			logError(SUB_GENERAL, "Failed to write '%v' file.", hdFileName)
 		}
+	}
 
-		_, filename, line, _ := runtime.Caller(4)
-		input := fmt.Sprintf(format, args...)
-		buf := fmt.Sprintf(
-			"(GAME CRASH)\nBUILD:v%v-%v\nLabel:%v File: %v Line: %v\nError:%v\n\nStack Trace:\n%v\n",
-			version, buildInfo, input, filepath.Base(filename), line, r, string(debug.Stack()))
+	trimCrashReports()
+	countCrash(now)
+}
+
+// File and line that panicked, the first frame below runtime's panic handling
+func panicLocation() (string, int) {
+	pcs := make([]uintptr, 32)
+	num := runtime.Callers(1, pcs)
+	frames := runtime.CallersFrames(pcs[:num])
+
+	foundPanic := false
+	for {
+		frame, more := frames.Next()
+		if foundPanic && !strings.HasPrefix(frame.Function, "runtime.") {
+			return filepath.Base(frame.File), frame.Line
+		}
+		if frame.Function == "runtime.gopanic" {
+			foundPanic = true
+		}
+		if !more {
+			break
+		}
+	}
+	return "unknown", 0
+}
+
+// Only keep the newest reports, each with its heap dump if there is one
+func trimCrashReports() {
+	items, err := os.ReadDir(crashDir)
+	if err != nil {
+		return
+	}
 
-		os.WriteFile(pLogName, []byte(buf), 0660)
-		doLog(true, "wrote %v", pLogName)
+	files := make(map[string][]string) //By report name, without the extension
+	for _, item := range items {
+		if item.IsDir() {
+			continue
+		}
+		name := item.Name()
+		base := strings.TrimSuffix(strings.TrimSuffix(name, "-"+hdFileName+".dat"), ".txt")
+		files[base] = append(files[base], name)
+	}
+	keep := config.Load().CrashKeep
+	if len(files) <= keep {
+		return
+	}
+
+	//Timestamps in the names sort oldest first
+	bases := make([]string, 0, len(files))
+	for base := range files {
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+	for _, base := range bases[:len(bases)-keep] {
+		for _, name := range files[base] {
+			os.Remove(crashDir + "/" + name)
+		}
+	}
+}
+
+// Too many panics too quickly, something is broken. Shut down safely.
+func countCrash(now time.Time) {
+	crashLock.Lock()
+	defer crashLock.Unlock()
+
+	cfg := config.Load()
+	window := time.Duration(cfg.CrashWindowSeconds) * time.Second
+	var recent []time.Time
+	for _, t := range crashTimes {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	crashTimes = append(recent, now)
 
-		buf = fmt.Sprintf("Warning: Server panic (recovered: %v).", input)
-		send_chat(buf)
+	if len(crashTimes) >= cfg.CrashLimit {
+		logError(SUB_GENERAL, "%v panics in %v, shutting down.", len(crashTimes), window)
+		go startShutdown(time.Duration(cfg.ShutdownSeconds)*time.Second, "server error")
 	}
 }
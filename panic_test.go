@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"testing"
+)
+
+// Reports and their heap dumps are kept or removed together
+func TestTrimCrashReports(t *testing.T) {
+	oldConfig := config.Load()
+	config.Store(defaultConfig())
+	config.Load().CrashKeep = 2
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	t.Cleanup(func() {
+		config.Store(oldConfig)
+		os.Chdir(wd)
+	})
+
+	os.MkdirAll(crashDir, 0755)
+	for _, name := range []string{
+		"crash-2026-01-01T00-00-00.000-a.txt", "crash-2026-01-01T00-00-00.000-a-heapDump.dat",
+		"crash-2026-01-02T00-00-00.000-b.txt", "crash-2026-01-02T00-00-00.000-b-heapDump.dat",
+		"crash-2026-01-03T00-00-00.000-c.txt",
+		"crash-2026-01-04T00-00-00.000-d.txt", "crash-2026-01-04T00-00-00.000-d-heapDump.dat",
+	} {
+		os.WriteFile(crashDir+"/"+name, nil, 0644)
+	}
+
+	trimCrashReports()
+
+	items, _ := os.ReadDir(crashDir)
+	var got []string
+	for _, item := range items {
+		got = append(got, item.Name())
+	}
+	sort.Strings(got)
+	want := []string{"crash-2026-01-03T00-00-00.000-c.txt",
+		"crash-2026-01-04T00-00-00.000-d-heapDump.dat", "crash-2026-01-04T00-00-00.000-d.txt"}
+	if len(got) != len(want) {
+		t.Fatalf("kept %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("kept %q, want %q", got, want)
+			break
+		}
+	}
+}
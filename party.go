@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"goMMOServ/protocol"
+)
+
+const (
+	maxPartySize     = 8
+	partyUpdateTicks = 8   //~1 second
+	partyShareRange  = 768 //Distance members get kill credit within
+)
+
+type partyData struct {
+	id      uint32
+	leader  *playerData
+	members []*playerData
+}
+
+var partyTopID uint32
+
+// Invite a player, the party is made when they accept
+func inviteParty(player, target *playerData) {
+	if target == player {
+		writeToPlayer(player, CMD_Command, []byte("You can't invite yourself."))
+		return
+	}
+	if target.party != nil {
+		writeToPlayer(player, CMD_Command, []byte("They are already in a party."))
+		return
+	}
+	if player.party != nil && player.party.leader != player {
+		writeToPlayer(player, CMD_Command, []byte("Only the party leader can invite."))
+		return
+	}
+	if player.party != nil && len(player.party.members) >= maxPartySize {
+		writeToPlayer(player, CMD_Command, []byte("Your party is full."))
+		return
+	}
+
+	target.partyInvite = player
+	writeToPlayer(player, CMD_Command, []byte(fmt.Sprintf("Invited %v to the party.", target.name)))
+	writeToPlayer(target, CMD_Command,
+		[]byte(fmt.Sprintf("%v invited you to a party. (/party accept or /party decline)", player.name)))
+}
+
+// Join the party we were invited to, making it if the inviter has none yet
+func acceptParty(player *playerData) {
+	inviter := player.partyInvite
+	player.partyInvite = nil
+
+	if inviter == nil || !inviter.VALID || inviter == player ||
+		(inviter.party != nil && inviter.party.leader != inviter) {
+		writeToPlayer(player, CMD_Command, []byte("No party invite."))
+		return
+	}
+	if inviter.party != nil && len(inviter.party.members) >= maxPartySize {
+		writeToPlayer(player, CMD_Command, []byte("That party is full."))
+		return
+	}
+
+	if inviter.party == nil {
+		partyTopID++
+		inviter.party = &partyData{id: partyTopID, leader: inviter, members: []*playerData{inviter}}
+	}
+	party := inviter.party
+
+	leaveParty(player)
+	party.members = append(party.members, player)
+	player.party = party
+
+	partyChat(party, fmt.Sprintf("%v joined the party.", player.name))
+	sendPartyUpdate(party)
+}
+
+// Leave our party, passing leadership on or disbanding if needed
+func leaveParty(player *playerData) {
+	party := player.party
+	if party == nil {
+		return
+	}
+	player.party = nil
+
+	for i, member := range party.members {
+		if member == player {
+			party.members = append(party.members[:i], party.members[i+1:]...)
+			break
+		}
+	}
+
+	//Let the client clear the party frames
+	writeToPlayer(player, CMD_PartyUpdate, (&protocol.PartyUpdate{}).Encode())
+
+	if len(party.members) < 2 {
+		for _, member := range party.members {
+			member.party = nil
+			writeToPlayer(member, CMD_Command, []byte("Your party has disbanded."))
+			writeToPlayer(member, CMD_PartyUpdate, (&protocol.PartyUpdate{}).Encode())
+		}
+		party.members = []*playerData{}
+		return
+	}
+
+	if party.leader == player {
+		party.leader = party.members[0]
+	}
+	partyChat(party, fmt.Sprintf("%v left the party, %v is leader.", player.name, party.leader.name))
+	sendPartyUpdate(party)
+}
+
+// Remove a member, leader only
+func kickParty(player, target *playerData) {
+	if player.party == nil || player.party.leader != player {
+		writeToPlayer(player, CMD_Command, []byte("You are not a party leader."))
+		return
+	}
+	if target.party != player.party || target == player {
+		writeToPlayer(player, CMD_Command, []byte("They are not in your party."))
+		return
+	}
+
+	writeToPlayer(target, CMD_Command, []byte("You were removed from the party."))
+	leaveParty(target)
+}
+
+// Send a chat message to everyone in a party
+func partyChat(party *partyData, msg string) {
+	for _, member := range party.members {
+		writeToPlayer(member, CMD_Chat, []byte(msg))
+	}
+}
+
+// Check if two players are in the same party
+func samePartyOf(a, b *playerData) bool {
+	return a.party != nil && a.party == b.party
+}
+
+// Members health and position, regardless of view range
+func sendPartyUpdate(party *partyData) {
+	defer reportPanic("sendPartyUpdate")
+
+	if party == nil || len(party.members) == 0 {
+		return
+	}
+
+	msg := &protocol.PartyUpdate{Leader: party.leader.id}
+	for _, member := range party.members {
+		msg.Members = append(msg.Members, protocol.PartyMember{ID: member.id, Area: member.area.ID,
+			X: uint32(xyCenter - int(member.pos.X)), Y: uint32(xyCenter - int(member.pos.Y)),
+			Health: member.health, Effects: uint8(member.effects)})
+	}
+	buf := msg.Encode()
+
+	for _, member := range party.members {
+		writeToPlayer(member, CMD_PartyUpdate, buf)
+	}
+}
+
+// Sync party frames for every party with an online member
+func sendAllPartyUpdates() {
+	sent := make(map[*partyData]bool)
+
+	for _, player := range playerList {
+		if player.party == nil || sent[player.party] {
+			continue
+		}
+		sent[player.party] = true
+		sendPartyUpdate(player.party)
+	}
+}
+
+// Heal party members first, most injured first
+func sortHealTargets(player *playerData) {
+	sort.SliceStable(player.targets, func(i, j int) bool {
+		a := player.targets[i].target
+		b := player.targets[j].target
+
+		aParty := samePartyOf(player, a)
+		bParty := samePartyOf(player, b)
+		if aParty != bParty {
+			return aParty
+		}
+		return a.health < b.health
+	})
+}
+
+// Split a creature's XP between everyone who attacked it, and their nearby party members
+func creditKill(creature *playerData) {
+	if creature.creatureData == nil {
+		return
+	}
+
+	var recipients []*playerData
+	added := make(map[*playerData]bool)
+
+	for _, attacker := range creature.creatureData.attackers {
+		if !attacker.VALID {
+			continue
+		}
+
+		members := []*playerData{attacker}
+		if attacker.party != nil {
+			members = attacker.party.members
+		}
+		for _, member := range members {
+			if added[member] || member.area != creature.area ||
+				distanceFloat(member.pos, creature.pos) > partyShareRange {
+				continue
+			}
+			added[member] = true
+			recipients = append(recipients, member)
+		}
+	}
+	creature.creatureData.attackers = nil
+
+	if len(recipients) == 0 {
+		return
+	}
+
+	share := creatureXP[creature.creatureData.id.Num] / uint32(len(recipients))
+	if share < 1 {
+		share = 1
+	}
+	for _, player := range recipients {
+		player.kills++
+		awardXP(player, share)
+	}
+}
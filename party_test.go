@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+// The party is only made once an invite is accepted
+func TestPartyInvite(t *testing.T) {
+	w := newTestWorld(t)
+	leader := w.addPlayer(XYf32{X: 0, Y: 0})
+	leader.name = "Leader"
+	first := w.addPlayer(XYf32{X: 0, Y: 0})
+	first.name = "First"
+	second := w.addPlayer(XYf32{X: 0, Y: 0})
+	second.name = "Second"
+
+	runAs(leader, false, "/party invite First")
+	runAs(first, false, "/party decline")
+	if leader.party != nil || first.party != nil {
+		t.Fatalf("declined invite left a party behind")
+	}
+
+	runAs(leader, false, "/party invite First")
+	runAs(leader, false, "/party invite Second")
+	if leader.party != nil {
+		t.Fatalf("party made before anyone accepted")
+	}
+	runAs(first, false, "/party accept")
+	runAs(second, false, "/party accept")
+
+	party := leader.party
+	if party == nil || party.leader != leader || len(party.members) != 3 ||
+		first.party != party || second.party != party {
+		t.Fatalf("after accepting: %+v", party)
+	}
+
+	//The inviter left, the invite is gone with them
+	other := w.addPlayer(XYf32{X: 0, Y: 0})
+	other.name = "Other"
+	runAs(first, false, "/party leave")
+	runAs(first, false, "/party invite Other")
+	removePlayer(first, "test")
+	runAs(other, false, "/party accept")
+	if other.party != nil {
+		t.Errorf("joined a party through an invite from a player who left")
+	}
+}
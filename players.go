@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	playerVersion = 3
+	playerDir     = "players"
+
+	minPasswordLength = 6
+	maxPasswordLength = 72 //In bytes, bcrypt ignores the rest
+
+	maxLoginFails = 5                //Wrong passwords before an address or account has to wait
+	loginFailWait = 10 * time.Minute //Fails are forgotten this long after the last one
+)
+
+var (
+	errNoSave        = errors.New("No save for that account.")
+	errNoPassword    = errors.New("That save has no password, ask an admin to set one.")
+	errWrongPassword = errors.New("Wrong password.")
+	errShortPassword = fmt.Errorf("Passwords need at least %v characters.", minPasswordLength)
+	errLongPassword  = fmt.Errorf("Passwords can't be over %v bytes.", maxPasswordLength)
+)
+
+type loginFails struct {
+	count int
+	last  time.Time
+}
+
+var (
+	loginFailList = map[string]*loginFails{} //By address and by account, see loginFailKeys
+	loginFailLock sync.Mutex
+
+	passwordJobs sync.WaitGroup //Hashes running off processLock
+)
+
+type playerSave struct {
+	Version uint16
+	Name    string //Account name, the file is named after it
+
+	//bcrypt. Version 1 and 2 saves have none, and can't be loaded until an admin sets one.
+	PassHash []byte `json:",omitempty"`
+
+	Display     string       `json:",omitempty"` //Version 1 saves only have Name
+	LastRename  time.Time    `json:",omitempty"`
+	NameHistory []nameChange `json:",omitempty"`
+
+	Level     uint8
+	XP        uint32
+	Kills     uint32
+	HasBind   bool
+	BindArea  uint16
+	BindPos   XY
+	Inventory []*inventorySave `json:",omitempty"`
+}
+
+type inventorySave struct {
+	ID    IID
+	Count uint32
+}
+
+// File names are hex, so any name is safe on disk
+func playerFilePath(name string) string {
+	return fmt.Sprintf("%v/%v/%x%v", dataDir, playerDir, strings.ToLower(name), suffix)
+}
+
+// Write a named player's progress to disk
+func savePlayer(player *playerData) {
+	defer reportPanic("savePlayer")
+
+	if player == nil || player.creatureData != nil || player.account == "" {
+		return
+	}
+
+	sdat := playerSave{Version: playerVersion, Name: player.account, Display: player.name,
+		PassHash: player.passHash, LastRename: player.lastRename, NameHistory: player.nameHistory,
+		Level: player.level, XP: player.xp, Kills: player.kills}
+	if player.bindArea != nil {
+		sdat.HasBind = true
+		sdat.BindArea = player.bindArea.ID
+		sdat.BindPos = player.bindPos
+	}
+	for id, count := range player.inventory {
+		sdat.Inventory = append(sdat.Inventory, &inventorySave{ID: id, Count: count})
+	}
+
+	if writePlayerSave(&sdat) {
+		addSavedName(player.account, player.name)
+	}
+}
+
+func writePlayerSave(sdat *playerSave) bool {
+	outbuf := new(bytes.Buffer)
+	enc := json.NewEncoder(outbuf)
+	enc.SetIndent("", "\t")
+
+	err := enc.Encode(sdat)
+	if err != nil {
+		logError(SUB_SAVE, "savePlayer: enc.Encode %v", err.Error())
+		return false
+	}
+
+	os.MkdirAll(dataDir+"/"+playerDir, 0755)
+	err = os.WriteFile(playerFilePath(sdat.Name), outbuf.Bytes(), 0644)
+	if err != nil {
+		logError(SUB_SAVE, "savePlayer: WriteFile %v", err.Error())
+		return false
+	}
+	return true
+}
+
+// Save everyone online
+func saveAllPlayers() {
+	for _, player := range playerList {
+		savePlayer(player)
+	}
+}
+
+// Read a saved player, false if there is none
+func readPlayerSave(account string) (*playerSave, bool) {
+	data, err := os.ReadFile(playerFilePath(account))
+	if err != nil {
+		return nil, false
+	}
+
+	var sdat playerSave
+	decoder := json.NewDecoder(bytes.NewBuffer(data))
+	err = decoder.Decode(&sdat)
+	if err != nil {
+		logError(SUB_SAVE, "Unable to decode json: %v", playerFilePath(account))
+		return nil, false
+	}
+	if sdat.Version < 1 || sdat.Version > playerVersion {
+		logError(SUB_SAVE, "Incompatable player version: %v", playerFilePath(account))
+		return nil, false
+	}
+
+	//Before display names, the account name was shown
+	if sdat.Display == "" {
+		sdat.Display = sdat.Name
+	}
+	return &sdat, true
+}
+
+// Password rules that don't need the hash, checked before any slow work
+func validPassword(password string) error {
+	if len([]rune(password)) < minPasswordLength {
+		return errShortPassword
+	}
+	if len(password) > maxPasswordLength {
+		return errLongPassword
+	}
+	return nil
+}
+
+// Slow on purpose, anything a player can trigger goes through passwordWork
+func hashPassword(password string) ([]byte, error) {
+	if err := validPassword(password); err != nil {
+		return nil, err
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// Slow on purpose, anything a player can trigger goes through passwordWork
+func checkPassword(hash []byte, password string) error {
+	if len(hash) == 0 {
+		return errNoPassword
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return errWrongPassword
+	}
+	return nil
+}
+
+// Hashing runs off processLock, so a guess can't stall the tick. done gets
+// the result with processLock held again, unless the player left meanwhile.
+// One at a time per player, false if one is still running. processLock must be held.
+func passwordWork(player *playerData, work func() error, done func(error)) bool {
+	if player.passwordBusy {
+		return false
+	}
+	player.passwordBusy = true
+	passwordJobs.Add(1)
+
+	go func() {
+		defer passwordJobs.Done()
+		defer reportPanic("passwordWork")
+
+		err := work()
+
+		processLock.Lock()
+		defer processLock.Unlock()
+		player.passwordBusy = false
+		if player.VALID {
+			done(err)
+		}
+	}()
+	return true
+}
+
+func loginFailKeys(addr, account string) []string {
+	return []string{"ip " + addr, "account " + nameKey(account)}
+}
+
+// How long before this address can try a password for this account, 0 if now
+func loginWait(addr, account string) time.Duration {
+	loginFailLock.Lock()
+	defer loginFailLock.Unlock()
+
+	var wait time.Duration
+	for _, key := range loginFailKeys(addr, account) {
+		if fails := loginFailList[key]; fails != nil && fails.count >= maxLoginFails {
+			wait = max(wait, time.Until(fails.last.Add(loginFailWait)))
+		}
+	}
+	return max(wait, 0)
+}
+
+// Count a wrong password against both the address and the account, so
+// neither reconnecting nor moving on to another account gets more guesses
+func addLoginFail(addr, account string) {
+	loginFailLock.Lock()
+	defer loginFailLock.Unlock()
+
+	now := time.Now()
+	for key, fails := range loginFailList {
+		if now.Sub(fails.last) > loginFailWait {
+			delete(loginFailList, key)
+		}
+	}
+	for _, key := range loginFailKeys(addr, account) {
+		fails := loginFailList[key]
+		if fails == nil {
+			fails = &loginFails{}
+			loginFailList[key] = fails
+		}
+		fails.count++
+		fails.last = now
+	}
+}
+
+// After the right password, only the account is forgiven. Logging in to
+// one account must not buy an address more guesses at another.
+func clearLoginFails(account string) {
+	loginFailLock.Lock()
+	defer loginFailLock.Unlock()
+	delete(loginFailList, "account "+nameKey(account))
+}
+
+// Set the password of an offline save, for saves from before passwords or a
+// forgotten one
+func resetPassword(account, password string) error {
+	sdat, ok := readPlayerSave(account)
+	if !ok {
+		return errNoSave
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	sdat.Version = playerVersion
+	sdat.PassHash = hash
+	if !writePlayerSave(sdat) {
+		return errors.New("Unable to write the save.")
+	}
+	return nil
+}
+
+// Read a save and check its password, safe off processLock
+func openPlayerSave(account, password string) (*playerSave, error) {
+	sdat, ok := readPlayerSave(account)
+	if !ok {
+		return nil, errNoSave
+	}
+	if err := checkPassword(sdat.PassHash, password); err != nil {
+		return nil, err
+	}
+	return sdat, nil
+}
+
+// Put a player's saved progress on them. processLock must be held.
+func applyPlayerSave(player *playerData, sdat *playerSave) {
+	player.account = sdat.Name
+	player.passHash = sdat.PassHash
+	player.name = sdat.Display
+	player.lastRename = sdat.LastRename
+	player.nameHistory = sdat.NameHistory
+	player.xp = sdat.XP
+	player.kills = sdat.Kills
+	setLevel(player, sdat.Level)
+
+	player.bindArea = nil
+	if sdat.HasBind {
+		player.bindArea = getArea(sdat.BindArea)
+		player.bindPos = sdat.BindPos
+	}
+
+	player.inventory = make(map[IID]uint32)
+	for _, item := range sdat.Inventory {
+		player.inventory[item.ID] = item.Count
+	}
+}
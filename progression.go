@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const (
+	levelFile        = "levels.json"
+	defaultMaxHealth = 100
+)
+
+type levelData struct {
+	Level     uint8
+	XP        uint32 //Total XP needed to reach this level
+	MaxHealth int16
+}
+
+// Used if data/levels.json is missing or invalid
+var levelTable = []levelData{
+	{Level: 1, XP: 0, MaxHealth: 100},
+	{Level: 2, XP: 100, MaxHealth: 110},
+	{Level: 3, XP: 250, MaxHealth: 120},
+	{Level: 4, XP: 500, MaxHealth: 135},
+	{Level: 5, XP: 900, MaxHealth: 150},
+	{Level: 6, XP: 1500, MaxHealth: 165},
+	{Level: 7, XP: 2400, MaxHealth: 180},
+	{Level: 8, XP: 3600, MaxHealth: 200},
+	{Level: 9, XP: 5200, MaxHealth: 220},
+	{Level: 10, XP: 7500, MaxHealth: 250},
+}
+
+// XP for defeating section 7 creatures, by Num
+var creatureXP = map[uint8]uint32{
+	0: 20, //Zombie
+}
+
+// Load level thresholds from the data dir
+func loadLevels() {
+	filePath := fmt.Sprintf("%v/%v", dataDir, levelFile)
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		logInfo(SUB_GENERAL, "No %v, using default level table.", filePath)
+		return
+	}
+
+	var levels []levelData
+	decoder := json.NewDecoder(bytes.NewBuffer(data))
+	err = decoder.Decode(&levels)
+	if err != nil {
+		logError(SUB_GENERAL, "Unable to decode json: %v", filePath)
+		return
+	}
+
+	if len(levels) == 0 || levels[0].XP != 0 {
+		logError(SUB_GENERAL, "Invalid level table, first level must need 0 XP: %v", filePath)
+		return
+	}
+	for l := range levels {
+		if levels[l].MaxHealth < 1 {
+			logError(SUB_GENERAL, "Invalid level table, level %v has no health: %v", levels[l].Level, filePath)
+			return
+		}
+		if l > 0 && levels[l].XP <= levels[l-1].XP {
+			logError(SUB_GENERAL, "Invalid level table, XP must increase: %v", filePath)
+			return
+		}
+		levels[l].Level = uint8(l + 1)
+	}
+
+	levelTable = levels
+	logInfo(SUB_GENERAL, "Loaded %v levels.", len(levels))
+}
+
+// Level for an amount of XP
+func levelForXP(xp uint32) uint8 {
+	level := levelTable[0].Level
+	for _, l := range levelTable {
+		if xp < l.XP {
+			break
+		}
+		level = l.Level
+	}
+	return level
+}
+
+// Apply stats for a level
+func setLevel(player *playerData, level uint8) {
+	if level < 1 {
+		level = 1
+	} else if int(level) > len(levelTable) {
+		level = uint8(len(levelTable))
+	}
+
+	player.level = level
+	player.maxHealth = levelTable[level-1].MaxHealth
+	if player.health > player.maxHealth {
+		player.health = player.maxHealth
+	}
+}
+
+// Give XP, announcing any level ups
+func awardXP(player *playerData, amount uint32) {
+	if player.creatureData != nil || amount == 0 {
+		return
+	}
+
+	player.xp += amount
+	newLevel := levelForXP(player.xp)
+
+	if newLevel > player.level {
+		setLevel(player, newLevel)
+		player.health = player.maxHealth
+		send_chat(fmt.Sprintf("%v reached level %v!", player.name, player.level))
+		sendPlayernames(player, true)
+		savePlayer(player)
+	}
+}
+
+// Remember who damaged a creature, for XP
+func addAttacker(creature, player *playerData) {
+	if creature.creatureData == nil || player.creatureData != nil {
+		return
+	}
+
+	for _, attacker := range creature.creatureData.attackers {
+		if attacker == player {
+			return
+		}
+	}
+	creature.creatureData.attackers = append(creature.creatureData.attackers, player)
+}
@@ -0,0 +1,144 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrVarUint = errors.New("protocol: variable-length number too long")
+
+// Reads bits most significant first, the order BitWriter writes them
+type BitReader struct {
+	reader io.ByteReader
+	byte   byte
+	offset byte
+}
+
+func NewBitReader(r io.ByteReader) *BitReader {
+	return &BitReader{r, 0, 0}
+}
+
+func (r *BitReader) ReadBit() (bool, error) {
+	if r.offset == 8 {
+		r.offset = 0
+	}
+	if r.offset == 0 {
+		var err error
+		if r.byte, err = r.reader.ReadByte(); err != nil {
+			return false, err
+		}
+	}
+	bit := (r.byte & (0x80 >> r.offset)) != 0
+	r.offset++
+	return bit, nil
+}
+
+func (r *BitReader) ReadInt(nbits int) (int, error) {
+	var result int
+	for i := nbits - 1; i >= 0; i-- {
+		bit, err := r.ReadBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit {
+			result |= 1 << uint(i)
+		}
+	}
+	tmp := int(result)
+	return tmp, nil
+}
+
+func (r *BitReader) ReadBits(nbits int) (byte, error) {
+	var result int
+	for i := nbits - 1; i >= 0; i-- {
+		bit, err := r.ReadBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit {
+			result |= 1 << uint(i)
+		}
+	}
+	tmp := byte(result)
+	return tmp, nil
+}
+
+// Groups of 7 bits, lowest first, each after a bit saying if another follows
+func (r *BitReader) ReadVarUint() (uint32, error) {
+	var result uint64
+	for shift := 0; shift < 35; shift += 7 {
+		more, err := r.ReadBit()
+		if err != nil {
+			return 0, err
+		}
+		group, err := r.ReadInt(7)
+		if err != nil {
+			return 0, err
+		}
+		result |= uint64(group) << shift
+		if !more {
+			if result > 0xFFFFFFFF {
+				return 0, ErrVarUint
+			}
+			return uint32(result), nil
+		}
+	}
+	return 0, ErrVarUint
+}
+
+// Skip the rest of the current byte
+func (r *BitReader) Align() {
+	r.offset = 0
+}
+
+// Appends bits most significant first, the last byte is padded with zeros
+type BitWriter struct {
+	out    []byte
+	offset byte //Bits used in the last byte, 8 when a new one is needed
+}
+
+func NewBitWriter(out []byte) *BitWriter {
+	return &BitWriter{out, 8}
+}
+
+func (w *BitWriter) WriteBit(bit bool) {
+	if w.offset == 8 {
+		w.out = append(w.out, 0)
+		w.offset = 0
+	}
+	if bit {
+		w.out[len(w.out)-1] |= 0x80 >> w.offset
+	}
+	w.offset++
+}
+
+// The low nbits of value
+func (w *BitWriter) WriteInt(value int, nbits int) {
+	for i := nbits - 1; i >= 0; i-- {
+		w.WriteBit(value&(1<<uint(i)) != 0)
+	}
+}
+
+func (w *BitWriter) WriteBits(value byte, nbits int) {
+	w.WriteInt(int(value), nbits)
+}
+
+// 8 bits under 128, 16 under 16384, up to 40 bits
+func (w *BitWriter) WriteVarUint(value uint32) {
+	for value >= 0x80 {
+		w.WriteBit(true)
+		w.WriteInt(int(value&0x7F), 7)
+		value >>= 7
+	}
+	w.WriteBit(false)
+	w.WriteInt(int(value), 7)
+}
+
+// Start the next write on a new byte
+func (w *BitWriter) Align() {
+	w.offset = 8
+}
+
+func (w *BitWriter) Bytes() []byte {
+	return w.out
+}
@@ -0,0 +1,153 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBitRoundTrip(t *testing.T) {
+	type field struct {
+		value int
+		nbits int
+	}
+	tests := []struct {
+		name   string
+		fields []field
+		want   []byte
+	}{
+		{"one byte", []field{{1, 1}, {0, 1}, {0x3F, 6}}, []byte{0xBF}},
+		{"padded", []field{{5, 3}}, []byte{0xA0}},
+		{"across bytes", []field{{0x7F, 7}, {0x7F, 7}, {7, 3}}, []byte{0xFF, 0xFF, 0x80}},
+		{"wide", []field{{0x12345678, 32}}, []byte{0x12, 0x34, 0x56, 0x78}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := NewBitWriter(nil)
+			for _, f := range tc.fields {
+				w.WriteInt(f.value, f.nbits)
+			}
+			if !bytes.Equal(w.Bytes(), tc.want) {
+				t.Fatalf("wrote %x, want %x", w.Bytes(), tc.want)
+			}
+
+			r := NewBitReader(bytes.NewReader(w.Bytes()))
+			for i, f := range tc.fields {
+				got, err := r.ReadInt(f.nbits)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != f.value {
+					t.Errorf("field %v: read %v, want %v", i, got, f.value)
+				}
+			}
+		})
+	}
+}
+
+func TestVarUint(t *testing.T) {
+	tests := []struct {
+		value uint32
+		bytes int
+	}{
+		{0, 1},
+		{127, 1},
+		{128, 2},
+		{16383, 2},
+		{16384, 3},
+		{0xFFFFFFFF, 5},
+	}
+
+	for _, tc := range tests {
+		w := NewBitWriter(nil)
+		w.WriteBit(true) //Not byte aligned
+		w.WriteVarUint(tc.value)
+		w.WriteBit(true)
+		if got := len(w.Bytes()); got != tc.bytes+1 {
+			t.Errorf("%v: %v bytes, want %v", tc.value, got, tc.bytes+1)
+		}
+
+		r := NewBitReader(bytes.NewReader(w.Bytes()))
+		r.ReadBit()
+		got, err := r.ReadVarUint()
+		if err != nil || got != tc.value {
+			t.Errorf("%v: read %v, %v", tc.value, got, err)
+		}
+		if last, _ := r.ReadBit(); !last {
+			t.Errorf("%v: read past the end of the number", tc.value)
+		}
+	}
+
+	//Six groups can't be a uint32
+	w := NewBitWriter(nil)
+	for i := 0; i < 6; i++ {
+		w.WriteInt(0xFF, 8)
+	}
+	if _, err := NewBitReader(bytes.NewReader(w.Bytes())).ReadVarUint(); err != ErrVarUint {
+		t.Errorf("too long: err = %v, want %v", err, ErrVarUint)
+	}
+}
+
+func TestAlign(t *testing.T) {
+	w := NewBitWriter(nil)
+	w.WriteInt(1, 1)
+	w.Align()
+	w.WriteInt(0xAB, 8)
+	w.Align()
+	w.WriteInt(1, 2)
+	if want := []byte{0x80, 0xAB, 0x40}; !bytes.Equal(w.Bytes(), want) {
+		t.Fatalf("wrote %x, want %x", w.Bytes(), want)
+	}
+
+	r := NewBitReader(bytes.NewReader(w.Bytes()))
+	r.ReadBit()
+	r.Align()
+	if got, _ := r.ReadInt(8); got != 0xAB {
+		t.Errorf("after align: read %x, want ab", got)
+	}
+	r.Align()
+	if got, _ := r.ReadInt(2); got != 1 {
+		t.Errorf("aligned on a byte boundary: read %v, want 1", got)
+	}
+}
+
+// Packed positions are exact inside the chunk, whatever chunk they are in
+func TestPackedPositions(t *testing.T) {
+	self := SelfState{X: 2147483648, Y: 2147483648, Dir: 8}
+	msg := &PackedWorldUpdate{Self: self}
+	for dx := -6; dx < 6; dx++ {
+		for _, off := range []int{0, 1, 64, 127} {
+			x := uint32(int(self.X) + dx*ChunkSize + off)
+			msg.Players = append(msg.Players, PlayerRecord{ID: uint32(len(msg.Players)), X: x, Y: self.Y - 1, Dir: 8})
+		}
+	}
+
+	decoded, err := DecodePackedWorldUpdate(msg.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Players) != len(msg.Players) {
+		t.Fatalf("got %v players, want %v", len(decoded.Players), len(msg.Players))
+	}
+	for i, rec := range decoded.Players {
+		if rec != msg.Players[i] {
+			t.Errorf("got %+v, want %+v", rec, msg.Players[i])
+		}
+	}
+}
+
+func TestPackedSize(t *testing.T) {
+	msg := &WorldUpdate{Self: SelfState{X: 2147483648, Y: 2147483648, Dir: 8}}
+	for i := 0; i < 20; i++ {
+		msg.Players = append(msg.Players, PlayerRecord{ID: uint32(i + 1), X: 2147483648 + uint32(i*5),
+			Y: 2147483648 + uint32(i*3), Dir: uint8(i % 9), Health: 100})
+		msg.Creatures = append(msg.Creatures, CreatureRecord{UID: uint32(i + 1000), Section: 1,
+			X: 2147483500 + uint32(i*7), Y: 2147483700, Dir: 8, Health: 80})
+	}
+
+	plain := len(msg.Encode(Version))
+	packed := len((*PackedWorldUpdate)(msg).Encode())
+	if packed*2 > plain {
+		t.Errorf("packed %vb, plain %vb, want under half", packed, plain)
+	}
+}
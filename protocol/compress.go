@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/adler32"
+	"io"
+	"sync"
+)
+
+// Largest dictionary zlib can use
+const MaxDictSize = 32 * 1024
+
+var ErrDictID = errors.New("protocol: dictionary does not match its ID")
+
+// The ID zlib puts in the header of data compressed with this dictionary
+func DictID(dict []byte) uint32 {
+	return adler32.Checksum(dict)
+}
+
+// Lower levels skip matching on very small inputs, and most world updates are small
+const dictLevel = 7
+
+// zlib with a preset dictionary, as used by CMD_WorldUpdateComp.
+// A nil dictionary is plain zlib.
+func CompressDict(data, dict []byte) []byte {
+	return NewCompressor(dict).Compress(data)
+}
+
+// Reuses zlib writers for one dictionary, making one costs far more than a
+// small message does to compress. Safe for concurrent use.
+type Compressor struct {
+	dict []byte
+	pool sync.Pool
+}
+
+func NewCompressor(dict []byte) *Compressor {
+	return &Compressor{dict: dict}
+}
+
+func (c *Compressor) Dict() []byte {
+	return c.dict
+}
+
+func (c *Compressor) Compress(data []byte) []byte {
+	var b bytes.Buffer
+	w, _ := c.pool.Get().(*zlib.Writer)
+	if w == nil {
+		w, _ = zlib.NewWriterLevelDict(&b, dictLevel, c.dict)
+	} else {
+		w.Reset(&b)
+	}
+
+	w.Write(data)
+	w.Close()
+	c.pool.Put(w)
+	return b.Bytes()
+}
+
+func DecompressDict(data, dict []byte) ([]byte, error) {
+	z, err := zlib.NewReaderDict(bytes.NewReader(data), dict)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+
+	return io.ReadAll(z)
+}
+
+// CMD_Dictionary, server to client. Sent right after the CMD_Init reply to
+// clients with CAP_COMPRESS_ZLIB, if the server has a dictionary.
+type Dictionary struct {
+	ID   uint32 //DictID of Data
+	Data []byte
+}
+
+// The dictionary itself is zlib compressed
+func (m *Dictionary) Encode() []byte {
+	out := binary.LittleEndian.AppendUint32(nil, m.ID)
+	return append(out, Compress(m.Data)...)
+}
+
+func DecodeDictionary(data []byte) (Dictionary, error) {
+	r := &reader{data: data}
+	m := Dictionary{ID: r.uint32()}
+	if r.err != nil {
+		return m, r.err
+	}
+
+	var err error
+	m.Data, err = Decompress(r.data)
+	if err != nil {
+		return m, err
+	}
+	if DictID(m.Data) != m.ID {
+		return m, ErrDictID
+	}
+	return m, nil
+}
@@ -0,0 +1,122 @@
+/*
+Package protocol is the goMMO wire format, shared by the server, the WASM
+client and any other tools that need to talk to or decode the game.
+
+Every websocket message is one binary frame: a CMD byte followed by that
+command's payload. Numbers are little-endian. Positions on the wire are
+uint32 world coordinates, the center of the world is 2147483648.
+
+Native clients and bots can use plain TCP instead, if the server enables it.
+Each message is then prefixed with its length as a uint32, the bytes after
+it are the same as a websocket frame. There are no close frames over TCP.
+
+Client to server:
+
+	CMD_Init            Version uint16, MinVersion uint16, Caps uint32
+	                    (version 20 and older: Version uint16 only)
+	CMD_Move            Seq uint16, Dir uint8 (0-7 S,SW,W,NW,N,NE,E,SE, 8 stop)
+	                    (before version 22: Dir uint8 only)
+	CMD_Chat            UTF-8 text, 256 bytes max
+	CMD_Command         UTF-8 text, "/name value"
+	CMD_PlayerMode      Mode uint8 (0 passive, 1 attack, 2 heal)
+	CMD_EditPlaceItem   Section, Num, Sprite uint8, X, Y uint32
+	CMD_EditDeleteItem  Section, Num, Sprite uint8, X, Y uint32
+	CMD_EditSetZone     Mode uint8, MinX, MinY, MaxX, MaxY uint32
+	CMD_EditDeleteZone  X, Y uint32
+	CMD_Pong            ID uint32, from the CMD_Ping being answered (from version 23)
+	CMD_Resume          Version uint16, MinVersion uint16, Caps uint32, Token [16]byte
+	                    (from version 24)
+
+Server to client:
+
+	CMD_Init            Result uint8, Version uint16, Caps uint32, Reason UTF-8 text
+	                    (to version 20 clients: empty, the version was rejected)
+	CMD_Login           ID uint32, Area uint16
+	CMD_WorldUpdate     self state (11 bytes, from version 22)
+	                    NumPlayers uint8, NumPlayers * player record (16 bytes)
+	                    NumObjects uint8, NumObjects * object record (11 bytes)
+	                    NumCreatures uint8, NumCreatures * creature record (18 bytes)
+	CMD_Chat            UTF-8 text
+	CMD_Command         UTF-8 text, reply to a command
+	CMD_PlayerNamesComp zlib compressed:
+	                    NumNames uint32, NumNames * (ID uint32, NameLen uint8,
+	                    NameLen bytes of UTF-8, Level uint8)
+	                    (before version 27: NameLen uint16, NameLen * rune int32)
+	CMD_PartyUpdate     NumMembers uint8, if not zero: Leader uint32,
+	                    NumMembers * member record (17 bytes)
+	CMD_Ping            ID uint32 (from version 23)
+	CMD_Session         Token [16]byte, GraceSeconds uint16 (from version 24)
+	CMD_WorldUpdateComp zlib compressed CMD_WorldUpdate, with the dictionary if
+	                    the zlib header says so (from version 25)
+	CMD_Dictionary      ID uint32, zlib compressed dictionary (from version 25)
+	CMD_ChatFrom        ID uint32, Channel uint8 (0 say, 1 party), UTF-8 text
+	                    (from version 28, older clients get it as CMD_Chat)
+	CMD_WorldUpdate     packed, to clients with CAP_PACKED_RECORDS (from version 26):
+	                    self state, NumChunks uint16, NumChunks * chunk
+
+Records:
+
+	self      Ack uint16, X, Y uint32, Dir uint8
+	player    ID uint32, X, Y uint32, Dir uint8, Health int16, Effects uint8
+	object    Section, Num, Sprite uint8, X, Y uint32
+	creature  UID uint32, Section, Num uint8, X, Y uint32, Dir uint8,
+	          Health int16, Effects uint8
+	member    ID uint32, Area uint16, X, Y uint32, Health int16, Effects uint8
+
+Packed chunks start with DX, DY int8, the chunk's offset from the one holding
+the self position. Three bit-packed lists follow, players, objects and
+creatures. Each is a count and its records, padded with zero bits to a whole
+byte. Bits are written most significant first.
+
+	count     var
+	player    ID var, X, Y 7 bits, dir, Health 7 bits, Effects 8 bits
+	object    Section, Num, Sprite 8 bits, X, Y 7 bits
+	creature  UID var, Section, Num 8 bits, X, Y 7 bits, dir, Health 7 bits,
+	          Effects 8 bits
+
+A var is groups of 7 bits, lowest first, each after a bit that is set if
+another group follows. X and Y are from the chunk's corner, chunks are 128
+units square and chunk N starts at N*128. A dir is one bit, set if moving,
+then the direction in 3 bits. Health is a percent of max health, 0 while
+injured.
+
+The handshake picks the newest version both sides speak, and the capability
+flags both sides set. Refused clients are also sent a websocket close frame
+with the reason, which older clients can show.
+
+Moves are buffered on the server and applied one per tick, in order. The
+self state echoes the Seq of the last move applied along with the resulting
+position, so clients can drop acknowledged inputs and replay the rest on top
+of it.
+
+Clients answer each CMD_Ping with a CMD_Pong as soon as it arrives. The
+server uses the round trip time to judge hits from where the attacker saw
+their target, so a slow answer only hurts the client sending it.
+
+After CMD_Login the server sends a session token. If the connection drops,
+the character stays in the world for GraceSeconds. A new connection can send
+CMD_Resume with the token in place of CMD_Init to take the character back,
+the server then answers as it would CMD_Init, with CMD_Login and a new token.
+An unknown or expired token joins as a new character, which the client can
+tell from the ID in CMD_Login.
+
+Clients that set CAP_COMPRESS_ZLIB may be sent CMD_WorldUpdateComp in place
+of CMD_WorldUpdate. If the server has a dictionary it is sent right after the
+CMD_Init reply, the ID is the zlib DICTID of the dictionary. Clients that set CAP_COMPRESS_DEFLATE
+should offer websocket permessage-deflate, which the server uses for some
+messages. Small messages are always sent uncompressed.
+
+Player chat comes as CMD_ChatFrom with the sender's ID, clients show the name
+they were sent for that ID in CMD_PlayerNamesComp. A name change is sent as a
+new CMD_PlayerNamesComp entry, so a player can't pose as someone else by
+renaming between messages.
+
+Objects are only sent the first time a client sees a chunk, or after the
+chunk changes. CMD_Play and CMD_WorldData are reserved.
+
+Any change to these layouts needs Version bumped. testdata/vN holds a golden
+file for each message whose layout was added or changed in version N, and
+every supported version is checked against the newest file at or before it,
+so an unversioned change fails the tests.
+*/
+package protocol
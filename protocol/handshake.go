@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Optional features, agreed on in the handshake
+type CAP uint32
+
+const (
+	CAP_COMPRESS_ZLIB    CAP = 1 << iota //zlib compressed messages
+	CAP_COMPRESS_DEFLATE                 //websocket permessage-deflate
+	CAP_DELTA_UPDATES                    //World updates only contain changes
+	CAP_EXTENDED_RECORDS                 //Larger record formats
+	CAP_PACKED_RECORDS                   //Bit-packed world updates
+)
+
+var CapNames = map[CAP]string{
+	CAP_COMPRESS_ZLIB:    "zlib",
+	CAP_COMPRESS_DEFLATE: "deflate",
+	CAP_DELTA_UPDATES:    "delta",
+	CAP_EXTENDED_RECORDS: "extended",
+	CAP_PACKED_RECORDS:   "packed",
+}
+
+// Handshake result
+type INIT uint8
+
+const (
+	INIT_OK INIT = iota
+	INIT_TOO_OLD
+	INIT_TOO_NEW
+	INIT_REFUSED //Server side reasons, full, banned or shutting down
+)
+
+// CMD_Init, client to server. Version 20 and older clients only send Version.
+type Init struct {
+	Version    uint16 //Newest the client speaks
+	MinVersion uint16 //Oldest the client speaks
+	Caps       CAP    //Features the client supports
+	Legacy     bool   //Version only, no range or caps
+}
+
+func (m *Init) Encode() []byte {
+	out := binary.LittleEndian.AppendUint16(nil, m.Version)
+	if m.Legacy {
+		return out
+	}
+	out = binary.LittleEndian.AppendUint16(out, m.MinVersion)
+	return binary.LittleEndian.AppendUint32(out, uint32(m.Caps))
+}
+
+func DecodeInit(data []byte) (Init, error) {
+	r := &reader{data: data}
+	m := Init{Version: r.uint16()}
+
+	if len(data) == 2 {
+		m.MinVersion = m.Version
+		m.Legacy = true
+		return m, r.finish()
+	}
+	m.MinVersion = r.uint16()
+	m.Caps = CAP(r.uint32())
+	return m, r.finish()
+}
+
+// CMD_Init, server to client. Legacy clients get an empty CMD_Init when refused instead.
+type InitReply struct {
+	Result  INIT
+	Version uint16 //Version used from here on
+	Caps    CAP    //Features both sides support
+	Reason  string //Shown to the player if refused
+}
+
+func (m *InitReply) Encode() []byte {
+	out := []byte{uint8(m.Result)}
+	out = binary.LittleEndian.AppendUint16(out, m.Version)
+	out = binary.LittleEndian.AppendUint32(out, uint32(m.Caps))
+	return append(out, m.Reason...)
+}
+
+func DecodeInitReply(data []byte) (InitReply, error) {
+	r := &reader{data: data}
+	m := InitReply{Result: INIT(r.uint8()), Version: r.uint16(), Caps: CAP(r.uint32())}
+	if r.err != nil {
+		return m, r.err
+	}
+	m.Reason = string(r.data)
+	return m, nil
+}
+
+// Pick the newest version both sides speak, and the features both support
+func Negotiate(init Init, minVersion, maxVersion uint16, caps CAP) InitReply {
+	clientMin := init.MinVersion
+	if clientMin > init.Version {
+		clientMin = init.Version
+	}
+
+	if init.Version < minVersion {
+		return InitReply{Result: INIT_TOO_OLD, Reason: fmt.Sprintf(
+			"Your game client is out of date (version %v, the server needs %v-%v). Refresh the page to update.",
+			init.Version, minVersion, maxVersion)}
+	}
+	if clientMin > maxVersion {
+		return InitReply{Result: INIT_TOO_NEW, Reason: fmt.Sprintf(
+			"Your game client is newer than the server (version %v, the server supports %v-%v). Try again in a few minutes.",
+			clientMin, minVersion, maxVersion)}
+	}
+
+	version := init.Version
+	if version > maxVersion {
+		version = maxVersion
+	}
+	return InitReply{Result: INIT_OK, Version: version, Caps: init.Caps & caps}
+}
+
+// Readable list of capability flags, for logs
+func (c CAP) String() string {
+	out := ""
+	for bit := CAP(1); bit != 0; bit <<= 1 {
+		if c&bit == 0 {
+			continue
+		}
+		name := CapNames[bit]
+		if name == "" {
+			name = fmt.Sprintf("0x%x", uint32(bit))
+		}
+		if out != "" {
+			out += ","
+		}
+		out += name
+	}
+	if out == "" {
+		return "none"
+	}
+	return out
+}
@@ -0,0 +1,443 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"unicode/utf8"
+)
+
+const (
+	PlayerRecordSize   = 16
+	ObjectRecordSize   = 11
+	CreatureRecordSize = 18
+	MemberRecordSize   = 17
+	SelfStateSize      = 11
+)
+
+// CMD_Login, server to client
+type Login struct {
+	ID   uint32
+	Area uint16
+}
+
+func (m *Login) Encode() []byte {
+	out := binary.LittleEndian.AppendUint32(nil, m.ID)
+	return binary.LittleEndian.AppendUint16(out, m.Area)
+}
+
+func DecodeLogin(data []byte) (Login, error) {
+	r := &reader{data: data}
+	m := Login{ID: r.uint32(), Area: r.uint16()}
+	return m, r.finish()
+}
+
+// CMD_Move, client to server. Seq is echoed back in the world update once applied.
+type Move struct {
+	Seq uint16 //Not sent before VersionInputSeq
+	Dir uint8
+}
+
+func (m *Move) Encode(version uint16) []byte {
+	var out []byte
+	if version >= VersionInputSeq {
+		out = binary.LittleEndian.AppendUint16(out, m.Seq)
+	}
+	return append(out, m.Dir)
+}
+
+func DecodeMove(data []byte, version uint16) (Move, error) {
+	r := &reader{data: data}
+	var m Move
+	if version >= VersionInputSeq {
+		m.Seq = r.uint16()
+	}
+	m.Dir = r.uint8()
+	return m, r.finish()
+}
+
+// CMD_PlayerMode, client to server
+type PlayerMode struct {
+	Mode uint8
+}
+
+func (m *PlayerMode) Encode() []byte {
+	return []byte{m.Mode}
+}
+
+func DecodePlayerMode(data []byte) (PlayerMode, error) {
+	r := &reader{data: data}
+	m := PlayerMode{Mode: r.uint8()}
+	return m, r.finish()
+}
+
+// CMD_Ping from the server, and CMD_Pong echoing the same ID back
+type Ping struct {
+	ID uint32
+}
+
+func (m *Ping) Encode() []byte {
+	return binary.LittleEndian.AppendUint32(nil, m.ID)
+}
+
+func DecodePing(data []byte) (Ping, error) {
+	r := &reader{data: data}
+	m := Ping{ID: r.uint32()}
+	return m, r.finish()
+}
+
+// CMD_EditPlaceItem and CMD_EditDeleteItem, client to server
+type EditItem struct {
+	Section uint8
+	Num     uint8
+	Sprite  uint8
+	X       uint32
+	Y       uint32
+}
+
+func (m *EditItem) Encode() []byte {
+	out := []byte{m.Section, m.Num, m.Sprite}
+	out = binary.LittleEndian.AppendUint32(out, m.X)
+	return binary.LittleEndian.AppendUint32(out, m.Y)
+}
+
+func DecodeEditItem(data []byte) (EditItem, error) {
+	r := &reader{data: data}
+	m := EditItem{Section: r.uint8(), Num: r.uint8(), Sprite: r.uint8(), X: r.uint32(), Y: r.uint32()}
+	return m, r.finish()
+}
+
+// CMD_EditSetZone, client to server
+type EditSetZone struct {
+	Mode uint8
+	MinX uint32
+	MinY uint32
+	MaxX uint32
+	MaxY uint32
+}
+
+func (m *EditSetZone) Encode() []byte {
+	out := []byte{m.Mode}
+	out = binary.LittleEndian.AppendUint32(out, m.MinX)
+	out = binary.LittleEndian.AppendUint32(out, m.MinY)
+	out = binary.LittleEndian.AppendUint32(out, m.MaxX)
+	return binary.LittleEndian.AppendUint32(out, m.MaxY)
+}
+
+func DecodeEditSetZone(data []byte) (EditSetZone, error) {
+	r := &reader{data: data}
+	m := EditSetZone{Mode: r.uint8(), MinX: r.uint32(), MinY: r.uint32(), MaxX: r.uint32(), MaxY: r.uint32()}
+	return m, r.finish()
+}
+
+// CMD_EditDeleteZone, client to server
+type EditDeleteZone struct {
+	X uint32
+	Y uint32
+}
+
+func (m *EditDeleteZone) Encode() []byte {
+	out := binary.LittleEndian.AppendUint32(nil, m.X)
+	return binary.LittleEndian.AppendUint32(out, m.Y)
+}
+
+func DecodeEditDeleteZone(data []byte) (EditDeleteZone, error) {
+	r := &reader{data: data}
+	m := EditDeleteZone{X: r.uint32(), Y: r.uint32()}
+	return m, r.finish()
+}
+
+/* WORLD UPDATE */
+
+// The receiving player's own authoritative state, for reconciling predicted movement
+type SelfState struct {
+	Ack uint16 //Last CMD_Move Seq applied
+	X   uint32
+	Y   uint32
+	Dir uint8 //Direction we are moving, 8 when stopped
+}
+
+type PlayerRecord struct {
+	ID      uint32
+	X       uint32
+	Y       uint32
+	Dir     uint8
+	Health  int16
+	Effects uint8
+}
+
+type ObjectRecord struct {
+	Section uint8
+	Num     uint8
+	Sprite  uint8
+	X       uint32
+	Y       uint32
+}
+
+type CreatureRecord struct {
+	UID     uint32
+	Section uint8
+	Num     uint8
+	X       uint32
+	Y       uint32
+	Dir     uint8
+	Health  int16
+	Effects uint8
+}
+
+func AppendPlayerRecord(out []byte, rec *PlayerRecord) []byte {
+	out = binary.LittleEndian.AppendUint32(out, rec.ID)
+	out = binary.LittleEndian.AppendUint32(out, rec.X)
+	out = binary.LittleEndian.AppendUint32(out, rec.Y)
+	out = append(out, rec.Dir)
+	out = binary.LittleEndian.AppendUint16(out, uint16(rec.Health))
+	return append(out, rec.Effects)
+}
+
+func AppendObjectRecord(out []byte, rec *ObjectRecord) []byte {
+	out = append(out, rec.Section, rec.Num, rec.Sprite)
+	out = binary.LittleEndian.AppendUint32(out, rec.X)
+	return binary.LittleEndian.AppendUint32(out, rec.Y)
+}
+
+func AppendCreatureRecord(out []byte, rec *CreatureRecord) []byte {
+	out = binary.LittleEndian.AppendUint32(out, rec.UID)
+	out = append(out, rec.Section, rec.Num)
+	out = binary.LittleEndian.AppendUint32(out, rec.X)
+	out = binary.LittleEndian.AppendUint32(out, rec.Y)
+	out = append(out, rec.Dir)
+	out = binary.LittleEndian.AppendUint16(out, uint16(rec.Health))
+	return append(out, rec.Effects)
+}
+
+// CMD_WorldUpdate, server to client
+type WorldUpdate struct {
+	Self      SelfState //Not sent before VersionInputSeq
+	Players   []PlayerRecord
+	Objects   []ObjectRecord
+	Creatures []CreatureRecord
+}
+
+func (m *WorldUpdate) Encode(version uint16) []byte {
+	var players, objects, creatures []byte
+	for i := range m.Players {
+		players = AppendPlayerRecord(players, &m.Players[i])
+	}
+	for i := range m.Objects {
+		objects = AppendObjectRecord(objects, &m.Objects[i])
+	}
+	for i := range m.Creatures {
+		creatures = AppendCreatureRecord(creatures, &m.Creatures[i])
+	}
+	return JoinWorldUpdate(version, &m.Self, uint8(len(m.Players)), players,
+		uint8(len(m.Objects)), objects, uint8(len(m.Creatures)), creatures)
+}
+
+// Build a world update from already encoded records, the server caches these per chunk
+func JoinWorldUpdate(version uint16, self *SelfState, numPlayers uint8, players []byte,
+	numObjects uint8, objects []byte, numCreatures uint8, creatures []byte) []byte {
+	out := make([]byte, 0, SelfStateSize+3+len(players)+len(objects)+len(creatures))
+	if version >= VersionInputSeq {
+		out = binary.LittleEndian.AppendUint16(out, self.Ack)
+		out = binary.LittleEndian.AppendUint32(out, self.X)
+		out = binary.LittleEndian.AppendUint32(out, self.Y)
+		out = append(out, self.Dir)
+	}
+	out = append(out, numPlayers)
+	out = append(out, players...)
+	out = append(out, numObjects)
+	out = append(out, objects...)
+	out = append(out, numCreatures)
+	return append(out, creatures...)
+}
+
+func DecodeWorldUpdate(data []byte, version uint16) (WorldUpdate, error) {
+	r := &reader{data: data}
+	var m WorldUpdate
+
+	if version >= VersionInputSeq {
+		m.Self = SelfState{Ack: r.uint16(), X: r.uint32(), Y: r.uint32(), Dir: r.uint8()}
+	}
+
+	num := int(r.uint8())
+	for i := 0; i < num && r.err == nil; i++ {
+		m.Players = append(m.Players, PlayerRecord{ID: r.uint32(), X: r.uint32(), Y: r.uint32(),
+			Dir: r.uint8(), Health: r.int16(), Effects: r.uint8()})
+	}
+	num = int(r.uint8())
+	for i := 0; i < num && r.err == nil; i++ {
+		m.Objects = append(m.Objects, ObjectRecord{Section: r.uint8(), Num: r.uint8(), Sprite: r.uint8(),
+			X: r.uint32(), Y: r.uint32()})
+	}
+	num = int(r.uint8())
+	for i := 0; i < num && r.err == nil; i++ {
+		m.Creatures = append(m.Creatures, CreatureRecord{UID: r.uint32(), Section: r.uint8(), Num: r.uint8(),
+			X: r.uint32(), Y: r.uint32(), Dir: r.uint8(), Health: r.int16(), Effects: r.uint8()})
+	}
+	return m, r.finish()
+}
+
+/* CHAT */
+
+// Where a chat message was said
+type CHAT uint8
+
+const (
+	CHAT_SAY CHAT = iota
+	CHAT_PARTY
+)
+
+// CMD_ChatFrom, server to client. A player's chat, the client shows the name
+// it has for ID, so nobody can pass their text off as someone else's.
+type ChatFrom struct {
+	ID      uint32
+	Channel CHAT
+	Text    string
+}
+
+func (m *ChatFrom) Encode() []byte {
+	out := binary.LittleEndian.AppendUint32(nil, m.ID)
+	out = append(out, uint8(m.Channel))
+	return append(out, m.Text...)
+}
+
+func DecodeChatFrom(data []byte) (ChatFrom, error) {
+	r := &reader{data: data}
+	m := ChatFrom{ID: r.uint32(), Channel: CHAT(r.uint8())}
+	if r.err != nil {
+		return m, r.err
+	}
+	m.Text = string(r.data)
+	return m, nil
+}
+
+/* PLAYER NAMES */
+
+type PlayerName struct {
+	ID    uint32
+	Name  string
+	Level uint8
+}
+
+// CMD_PlayerNamesComp, server to client. Encode and decode are the uncompressed body.
+type PlayerNames struct {
+	Names []PlayerName
+}
+
+// Longest name in bytes that fits the length prefix
+const MaxNameBytes = 255
+
+func (m *PlayerNames) Encode(version uint16) []byte {
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(m.Names)))
+	for _, name := range m.Names {
+		out = binary.LittleEndian.AppendUint32(out, name.ID)
+		if version >= VersionNames {
+			text := truncateUTF8(name.Name, MaxNameBytes)
+			out = append(out, uint8(len(text)))
+			out = append(out, text...)
+		} else {
+			runes := []rune(name.Name)
+			out = binary.LittleEndian.AppendUint16(out, uint16(len(runes)))
+			for _, r := range runes {
+				out = binary.LittleEndian.AppendUint32(out, uint32(r))
+			}
+		}
+		out = append(out, name.Level)
+	}
+	return out
+}
+
+// Cut on a rune boundary, so a long name still decodes
+func truncateUTF8(text string, size int) string {
+	if len(text) <= size {
+		return text
+	}
+	for size > 0 && !utf8.RuneStart(text[size]) {
+		size--
+	}
+	return text[:size]
+}
+
+// Compressed, ready to send
+func (m *PlayerNames) EncodeComp(version uint16) []byte {
+	return Compress(m.Encode(version))
+}
+
+func DecodePlayerNames(data []byte, version uint16) (PlayerNames, error) {
+	r := &reader{data: data}
+	var m PlayerNames
+
+	num := r.uint32()
+	for i := uint32(0); i < num && r.err == nil; i++ {
+		name := PlayerName{ID: r.uint32()}
+		if version >= VersionNames {
+			name.Name = string(r.take(int(r.uint8())))
+		} else {
+			runes := make([]rune, r.uint16())
+			for x := range runes {
+				runes[x] = rune(r.uint32())
+			}
+			name.Name = string(runes)
+		}
+		name.Level = r.uint8()
+		m.Names = append(m.Names, name)
+	}
+	return m, r.finish()
+}
+
+func DecodePlayerNamesComp(data []byte, version uint16) (PlayerNames, error) {
+	body, err := Decompress(data)
+	if err != nil {
+		return PlayerNames{}, err
+	}
+	return DecodePlayerNames(body, version)
+}
+
+/* PARTY */
+
+type PartyMember struct {
+	ID      uint32
+	Area    uint16
+	X       uint32
+	Y       uint32
+	Health  int16
+	Effects uint8
+}
+
+// CMD_PartyUpdate, server to client. No members means we left the party.
+type PartyUpdate struct {
+	Leader  uint32
+	Members []PartyMember
+}
+
+func (m *PartyUpdate) Encode() []byte {
+	if len(m.Members) == 0 {
+		return []byte{0}
+	}
+
+	out := []byte{uint8(len(m.Members))}
+	out = binary.LittleEndian.AppendUint32(out, m.Leader)
+	for _, member := range m.Members {
+		out = binary.LittleEndian.AppendUint32(out, member.ID)
+		out = binary.LittleEndian.AppendUint16(out, member.Area)
+		out = binary.LittleEndian.AppendUint32(out, member.X)
+		out = binary.LittleEndian.AppendUint32(out, member.Y)
+		out = binary.LittleEndian.AppendUint16(out, uint16(member.Health))
+		out = append(out, member.Effects)
+	}
+	return out
+}
+
+func DecodePartyUpdate(data []byte) (PartyUpdate, error) {
+	r := &reader{data: data}
+	var m PartyUpdate
+
+	num := int(r.uint8())
+	if num == 0 {
+		return m, r.finish()
+	}
+	m.Leader = r.uint32()
+	for i := 0; i < num && r.err == nil; i++ {
+		m.Members = append(m.Members, PartyMember{ID: r.uint32(), Area: r.uint16(),
+			X: r.uint32(), Y: r.uint32(), Health: r.int16(), Effects: r.uint8()})
+	}
+	return m, r.finish()
+}
@@ -0,0 +1,252 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Bit-packed world updates, for clients with CAP_PACKED_RECORDS. Records are
+// grouped by chunk and positioned from the chunk's corner, so a position is
+// 14 bits instead of 64. Each chunk's records are packed on their own, the
+// server caches them per chunk the same as the plain records.
+const (
+	ChunkSize = 128 //World units per chunk side
+
+	chunkBits  = 7 //Position in a chunk
+	dirBits    = 3
+	healthBits = 7 //Percent of max health, 0 while injured
+	maxPacked  = 1<<healthBits - 1
+)
+
+// Empty record list, a zero count
+var emptySegment = []byte{0}
+
+func chunkOffset(pos, chunk uint32) int {
+	if pos < chunk*ChunkSize {
+		return 0
+	}
+	return min(int(pos-chunk*ChunkSize), ChunkSize-1)
+}
+
+// Stopped is one bit, moving is one bit and the direction
+func writeDir(w *BitWriter, dir uint8) {
+	w.WriteBit(dir < 8)
+	if dir < 8 {
+		w.WriteBits(dir, dirBits)
+	}
+}
+
+func readDir(r *BitReader) (uint8, error) {
+	moving, err := r.ReadBit()
+	if err != nil || !moving {
+		return 8, err
+	}
+	return r.ReadBits(dirBits)
+}
+
+func writeHealth(w *BitWriter, health int16) {
+	w.WriteInt(int(min(max(health, 0), maxPacked)), healthBits)
+}
+
+// Players in chunk cx, cy. Health should already be a percent.
+func PackPlayers(cx, cy uint32, recs []PlayerRecord) []byte {
+	if len(recs) == 0 {
+		return emptySegment
+	}
+	w := NewBitWriter(nil)
+	w.WriteVarUint(uint32(len(recs)))
+	for _, rec := range recs {
+		w.WriteVarUint(rec.ID)
+		w.WriteInt(chunkOffset(rec.X, cx), chunkBits)
+		w.WriteInt(chunkOffset(rec.Y, cy), chunkBits)
+		writeDir(w, rec.Dir)
+		writeHealth(w, rec.Health)
+		w.WriteBits(rec.Effects, 8)
+	}
+	return w.Bytes()
+}
+
+func PackObjects(cx, cy uint32, recs []ObjectRecord) []byte {
+	if len(recs) == 0 {
+		return emptySegment
+	}
+	w := NewBitWriter(nil)
+	w.WriteVarUint(uint32(len(recs)))
+	for _, rec := range recs {
+		w.WriteBits(rec.Section, 8)
+		w.WriteBits(rec.Num, 8)
+		w.WriteBits(rec.Sprite, 8)
+		w.WriteInt(chunkOffset(rec.X, cx), chunkBits)
+		w.WriteInt(chunkOffset(rec.Y, cy), chunkBits)
+	}
+	return w.Bytes()
+}
+
+// Creatures in chunk cx, cy. Health should already be a percent.
+func PackCreatures(cx, cy uint32, recs []CreatureRecord) []byte {
+	if len(recs) == 0 {
+		return emptySegment
+	}
+	w := NewBitWriter(nil)
+	w.WriteVarUint(uint32(len(recs)))
+	for _, rec := range recs {
+		w.WriteVarUint(rec.UID)
+		w.WriteBits(rec.Section, 8)
+		w.WriteBits(rec.Num, 8)
+		w.WriteInt(chunkOffset(rec.X, cx), chunkBits)
+		w.WriteInt(chunkOffset(rec.Y, cy), chunkBits)
+		writeDir(w, rec.Dir)
+		writeHealth(w, rec.Health)
+		w.WriteBits(rec.Effects, 8)
+	}
+	return w.Bytes()
+}
+
+// One chunk of a packed update. dx, dy is the chunk's offset from the chunk
+// holding the self position, nil record lists are sent as empty.
+func AppendPackedChunk(out []byte, dx, dy int8, players, objects, creatures []byte) []byte {
+	out = append(out, uint8(dx), uint8(dy))
+	for _, seg := range [][]byte{players, objects, creatures} {
+		if seg == nil {
+			seg = emptySegment
+		}
+		out = append(out, seg...)
+	}
+	return out
+}
+
+// Build a packed update from chunks made with AppendPackedChunk
+func JoinPackedUpdate(self *SelfState, numChunks uint16, chunks []byte) []byte {
+	out := make([]byte, 0, SelfStateSize+2+len(chunks))
+	out = binary.LittleEndian.AppendUint16(out, self.Ack)
+	out = binary.LittleEndian.AppendUint32(out, self.X)
+	out = binary.LittleEndian.AppendUint32(out, self.Y)
+	out = append(out, self.Dir)
+	out = binary.LittleEndian.AppendUint16(out, numChunks)
+	return append(out, chunks...)
+}
+
+// CMD_WorldUpdate for clients with CAP_PACKED_RECORDS. Positions are whole
+// world coordinates and Health is a percent.
+type PackedWorldUpdate WorldUpdate
+
+type chunkRecords struct {
+	cx, cy    uint32
+	players   []PlayerRecord
+	objects   []ObjectRecord
+	creatures []CreatureRecord
+}
+
+// Records are regrouped by chunk, in the order each chunk first appears
+func (m *PackedWorldUpdate) Encode() []byte {
+	chunks := []*chunkRecords{}
+	find := func(x, y uint32) *chunkRecords {
+		cx, cy := x/ChunkSize, y/ChunkSize
+		for _, c := range chunks {
+			if c.cx == cx && c.cy == cy {
+				return c
+			}
+		}
+		c := &chunkRecords{cx: cx, cy: cy}
+		chunks = append(chunks, c)
+		return c
+	}
+	for _, rec := range m.Players {
+		c := find(rec.X, rec.Y)
+		c.players = append(c.players, rec)
+	}
+	for _, rec := range m.Objects {
+		c := find(rec.X, rec.Y)
+		c.objects = append(c.objects, rec)
+	}
+	for _, rec := range m.Creatures {
+		c := find(rec.X, rec.Y)
+		c.creatures = append(c.creatures, rec)
+	}
+
+	ox, oy := m.Self.X/ChunkSize, m.Self.Y/ChunkSize
+	var out []byte
+	for _, c := range chunks {
+		out = AppendPackedChunk(out, int8(c.cx-ox), int8(c.cy-oy), PackPlayers(c.cx, c.cy, c.players),
+			PackObjects(c.cx, c.cy, c.objects), PackCreatures(c.cx, c.cy, c.creatures))
+	}
+	return JoinPackedUpdate(&m.Self, uint16(len(chunks)), out)
+}
+
+func DecodePackedWorldUpdate(data []byte) (PackedWorldUpdate, error) {
+	r := &reader{data: data}
+	var m PackedWorldUpdate
+
+	m.Self = SelfState{Ack: r.uint16(), X: r.uint32(), Y: r.uint32(), Dir: r.uint8()}
+	numChunks := int(r.uint16())
+	if r.err != nil {
+		return m, r.err
+	}
+
+	rest := bytes.NewReader(r.data)
+	bits := NewBitReader(rest)
+	ox, oy := m.Self.X/ChunkSize, m.Self.Y/ChunkSize
+	for i := 0; i < numChunks; i++ {
+		if err := decodePackedChunk(bits, &m, ox, oy); err != nil {
+			if err == io.EOF {
+				err = ErrShort
+			}
+			return m, err
+		}
+	}
+	if rest.Len() > 0 {
+		return m, ErrTrailing
+	}
+	return m, nil
+}
+
+// Reads until the first error, the caller turns io.EOF into ErrShort
+func decodePackedChunk(r *BitReader, m *PackedWorldUpdate, ox, oy uint32) error {
+	var err error
+	next := func(nbits int) int {
+		var v int
+		if err == nil {
+			v, err = r.ReadInt(nbits)
+		}
+		return v
+	}
+	varUint := func() uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.ReadVarUint()
+		}
+		return v
+	}
+	dir := func() uint8 {
+		var v uint8
+		if err == nil {
+			v, err = readDir(r)
+		}
+		return v
+	}
+
+	cx, cy := ox+uint32(int8(next(8))), oy+uint32(int8(next(8)))
+	x := func() uint32 { return cx*ChunkSize + uint32(next(chunkBits)) }
+	y := func() uint32 { return cy*ChunkSize + uint32(next(chunkBits)) }
+
+	num := int(varUint())
+	for i := 0; i < num && err == nil; i++ {
+		m.Players = append(m.Players, PlayerRecord{ID: varUint(), X: x(), Y: y(), Dir: dir(),
+			Health: int16(next(healthBits)), Effects: uint8(next(8))})
+	}
+	r.Align()
+	num = int(varUint())
+	for i := 0; i < num && err == nil; i++ {
+		m.Objects = append(m.Objects, ObjectRecord{Section: uint8(next(8)), Num: uint8(next(8)),
+			Sprite: uint8(next(8)), X: x(), Y: y()})
+	}
+	r.Align()
+	num = int(varUint())
+	for i := 0; i < num && err == nil; i++ {
+		m.Creatures = append(m.Creatures, CreatureRecord{UID: varUint(), Section: uint8(next(8)), Num: uint8(next(8)),
+			X: x(), Y: y(), Dir: dir(), Health: int16(next(healthBits)), Effects: uint8(next(8))})
+	}
+	r.Align()
+	return err
+}
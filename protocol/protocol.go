@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Versions the server speaks, older clients are refused with a reason
+const (
+	Version    uint16 = 28
+	MinVersion uint16 = 20
+)
+
+// First version with each layout change
+const (
+	VersionInputSeq uint16 = 22 //Move sequence numbers, self state in world updates
+	VersionPing     uint16 = 23 //CMD_Ping and CMD_Pong
+	VersionResume   uint16 = 24 //CMD_Session and CMD_Resume
+	VersionCompress uint16 = 25 //CMD_WorldUpdateComp and CMD_Dictionary
+	VersionPacked   uint16 = 26 //Bit-packed world updates
+	VersionNames    uint16 = 27 //UTF-8 names in CMD_PlayerNamesComp
+	VersionChatFrom uint16 = 28 //CMD_ChatFrom
+)
+
+// Network commands
+type CMD uint8
+
+const (
+	CMD_Init CMD = iota
+	CMD_Login
+	CMD_Play
+	CMD_Move
+	CMD_WorldUpdate
+	CMD_Chat
+	CMD_Command
+	CMD_PlayerMode
+
+	CMD_WorldData
+	CMD_PlayerNamesComp
+	CMD_EditPlaceItem
+	CMD_EditDeleteItem
+	CMD_EditSetZone
+	CMD_EditDeleteZone
+	CMD_PartyUpdate
+	CMD_Ping
+	CMD_Pong
+	CMD_Session
+	CMD_Resume
+	CMD_WorldUpdateComp
+	CMD_Dictionary
+	CMD_ChatFrom
+)
+
+// Used for debug messages and metrics
+var CmdNames = map[CMD]string{
+	CMD_Init:            "CMD_Init",
+	CMD_Login:           "CMD_Login",
+	CMD_Play:            "CMD_Play",
+	CMD_Move:            "CMD_Move",
+	CMD_WorldUpdate:     "CMD_WorldUpdate",
+	CMD_Chat:            "CMD_Chat",
+	CMD_Command:         "CMD_Command",
+	CMD_PlayerMode:      "CMD_PlayerMode",
+	CMD_WorldData:       "CMD_WorldData",
+	CMD_PlayerNamesComp: "CMD_PlayerNamesComp",
+	CMD_EditPlaceItem:   "CMD_EditPlaceItem",
+	CMD_EditDeleteItem:  "CMD_EditDeleteItem",
+	CMD_EditSetZone:     "CMD_EditSetZone",
+	CMD_EditDeleteZone:  "CMD_EditDeleteZone",
+	CMD_PartyUpdate:     "CMD_PartyUpdate",
+	CMD_Ping:            "CMD_Ping",
+	CMD_Pong:            "CMD_Pong",
+	CMD_Session:         "CMD_Session",
+	CMD_Resume:          "CMD_Resume",
+	CMD_WorldUpdateComp: "CMD_WorldUpdateComp",
+	CMD_Dictionary:      "CMD_Dictionary",
+	CMD_ChatFrom:        "CMD_ChatFrom",
+}
+
+var (
+	ErrShort    = errors.New("protocol: message too short")
+	ErrTrailing = errors.New("protocol: unexpected data after message")
+)
+
+// Reads little-endian values, the first short read sets err and the rest return zero
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = ErrShort
+		r.data = nil
+		return nil
+	}
+	out := r.data[:n]
+	r.data = r.data[n:]
+	return out
+}
+
+func (r *reader) uint8() uint8 {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) int16() int16 {
+	return int16(r.uint16())
+}
+
+// Error for the whole message, leftover bytes mean the layout is wrong
+func (r *reader) finish() error {
+	if r.err == nil && len(r.data) > 0 {
+		return ErrTrailing
+	}
+	return r.err
+}
+
+// zlib, as used by CMD_PlayerNamesComp
+func Compress(data []byte) []byte {
+	var b bytes.Buffer
+	w, _ := zlib.NewWriterLevel(&b, zlib.BestSpeed)
+	w.Write(data)
+	w.Close()
+	return b.Bytes()
+}
+
+func Decompress(data []byte) ([]byte, error) {
+	z, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+
+	return io.ReadAll(z)
+}
@@ -0,0 +1,404 @@
+package protocol
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+type message interface {
+	Encode() []byte
+}
+
+// Messages that changed layout between versions
+type versionedMessage interface {
+	Encode(version uint16) []byte
+}
+
+func encodeMsg(msg any, version uint16) []byte {
+	if m, ok := msg.(versionedMessage); ok {
+		return m.Encode(version)
+	}
+	return msg.(message).Encode()
+}
+
+// One example of every message. Golden files hold the exact bytes sent, so the
+// client and other tools can check their codecs against the same files. There
+// is a file for each version in layouts, the first is when the message was added.
+var goldenTests = []struct {
+	name      string
+	layouts   []uint16
+	msg       any
+	decode    func(data []byte, version uint16) (any, error)
+	openEnded bool //Ends in text, or old layouts are accepted, so extra bytes aren't an error
+}{
+	{name: "init", layouts: []uint16{21}, msg: &Init{Version: Version, MinVersion: MinVersion, Caps: CAP_COMPRESS_ZLIB | CAP_DELTA_UPDATES},
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodeInit(b); return &m, err }},
+	{name: "init_legacy", layouts: []uint16{20}, msg: &Init{Version: 20, MinVersion: 20, Legacy: true}, openEnded: true,
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodeInit(b); return &m, err }},
+	{name: "init_reply", layouts: []uint16{21}, msg: &InitReply{Result: INIT_OK, Version: Version, Caps: CAP_COMPRESS_ZLIB}, openEnded: true,
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodeInitReply(b); return &m, err }},
+	{name: "init_reply_refused", layouts: []uint16{21}, msg: &InitReply{Result: INIT_TOO_OLD, Reason: "Too old"}, openEnded: true,
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodeInitReply(b); return &m, err }},
+	{name: "login", layouts: []uint16{20}, msg: &Login{ID: 1234, Area: 2},
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodeLogin(b); return &m, err }},
+	{name: "move", layouts: []uint16{20, VersionInputSeq}, msg: &Move{Seq: 65535, Dir: 5},
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodeMove(b, v); return &m, err }},
+	{name: "ping", layouts: []uint16{VersionPing}, msg: &Ping{ID: 0xdeadbeef},
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodePing(b); return &m, err }},
+	{name: "session", layouts: []uint16{VersionResume}, msg: &Session{Token: SessionToken{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}, GraceSeconds: 60},
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodeSession(b); return &m, err }},
+	{name: "resume", layouts: []uint16{VersionResume}, msg: &Resume{Init: Init{Version: Version, MinVersion: MinVersion, Caps: CAP_COMPRESS_ZLIB},
+		Token: SessionToken{0xff, 0xfe, 0xfd, 0xfc, 0xfb, 0xfa, 0xf9, 0xf8, 0xf7, 0xf6, 0xf5, 0xf4, 0xf3, 0xf2, 0xf1, 0xf0}},
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodeResume(b); return &m, err }},
+	{name: "chat_from", layouts: []uint16{VersionChatFrom}, msg: &ChatFrom{ID: 42, Channel: CHAT_PARTY, Text: "Hallo, 世界"}, openEnded: true,
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodeChatFrom(b); return &m, err }},
+	{name: "player_mode", layouts: []uint16{20}, msg: &PlayerMode{Mode: 2},
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodePlayerMode(b); return &m, err }},
+	{name: "edit_item", layouts: []uint16{20}, msg: &EditItem{Section: 3, Num: 7, Sprite: 1, X: 2147483600, Y: 2147483700},
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodeEditItem(b); return &m, err }},
+	{name: "edit_set_zone", layouts: []uint16{20}, msg: &EditSetZone{Mode: 1, MinX: 2147483000, MinY: 2147483100, MaxX: 2147484000, MaxY: 2147484100},
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodeEditSetZone(b); return &m, err }},
+	{name: "edit_delete_zone", layouts: []uint16{20}, msg: &EditDeleteZone{X: 2147483648, Y: 2147483649},
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodeEditDeleteZone(b); return &m, err }},
+	{name: "world_update", layouts: []uint16{20, VersionInputSeq}, msg: &WorldUpdate{
+		Self: SelfState{Ack: 513, X: 2147483648, Y: 2147483632, Dir: 4},
+		Players: []PlayerRecord{
+			{ID: 1, X: 2147483648, Y: 2147483632, Dir: 4, Health: 100, Effects: 0},
+			{ID: 2, X: 2147483700, Y: 2147483600, Dir: 8, Health: -44, Effects: 16},
+		},
+		Objects: []ObjectRecord{
+			{Section: 3, Num: 1, Sprite: 2, X: 2147483000, Y: 2147484000},
+		},
+		Creatures: []CreatureRecord{
+			{UID: 77, Section: 1, Num: 0, X: 2147483650, Y: 2147483660, Dir: 6, Health: 52, Effects: 8},
+		},
+	}, decode: func(b []byte, v uint16) (any, error) { m, err := DecodeWorldUpdate(b, v); return &m, err }},
+	{name: "world_update_packed", layouts: []uint16{VersionPacked}, msg: &PackedWorldUpdate{
+		Self: SelfState{Ack: 513, X: 2147483648, Y: 2147483632, Dir: 4},
+		Players: []PlayerRecord{
+			{ID: 1, X: 2147483648, Y: 2147483632, Dir: 4, Health: 100, Effects: 0},
+			{ID: 300, X: 2147483700, Y: 2147483600, Dir: 8, Health: 0, Effects: 16},
+		},
+		Objects: []ObjectRecord{
+			{Section: 3, Num: 1, Sprite: 2, X: 2147483000, Y: 2147484000},
+		},
+		Creatures: []CreatureRecord{
+			{UID: 77, Section: 1, Num: 0, X: 2147483650, Y: 2147483660, Dir: 6, Health: 52, Effects: 8},
+		},
+	}, decode: func(b []byte, v uint16) (any, error) { m, err := DecodePackedWorldUpdate(b); return &m, err }},
+	{name: "world_update_packed_empty", layouts: []uint16{VersionPacked}, msg: &PackedWorldUpdate{},
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodePackedWorldUpdate(b); return &m, err }},
+	{name: "world_update_empty", layouts: []uint16{20, VersionInputSeq}, msg: &WorldUpdate{},
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodeWorldUpdate(b, v); return &m, err }},
+	{name: "player_names", layouts: []uint16{20, VersionNames}, msg: &PlayerNames{Names: []PlayerName{
+		{ID: 1, Name: "Player-1", Level: 1},
+		{ID: 9, Name: "Zoë", Level: 10},
+		{ID: 12, Name: "김민준", Level: 3},
+	}}, decode: func(b []byte, v uint16) (any, error) { m, err := DecodePlayerNames(b, v); return &m, err }},
+	{name: "party_update", layouts: []uint16{20}, msg: &PartyUpdate{Leader: 3, Members: []PartyMember{
+		{ID: 3, Area: 0, X: 2147483648, Y: 2147483648, Health: 100, Effects: 0},
+		{ID: 4, Area: 1, X: 2147483000, Y: 2147484000, Health: -10, Effects: 16},
+	}}, decode: func(b []byte, v uint16) (any, error) { m, err := DecodePartyUpdate(b); return &m, err }},
+	{name: "party_update_left", layouts: []uint16{20}, msg: &PartyUpdate{},
+		decode: func(b []byte, v uint16) (any, error) { m, err := DecodePartyUpdate(b); return &m, err }},
+}
+
+// The version whose golden file has a message's layout at this version, 0 if
+// the message is newer
+func goldenLayout(layouts []uint16, version uint16) uint16 {
+	layout := uint16(0)
+	for _, v := range layouts {
+		if v <= version {
+			layout = v
+		}
+	}
+	return layout
+}
+
+func goldenPath(name string, layout uint16) string {
+	return filepath.Join("testdata", fmt.Sprintf("v%v", layout), name+".golden")
+}
+
+// Read the golden file for a message as sent at this version
+func readGolden(t *testing.T, name string, version uint16) []byte {
+	t.Helper()
+	for _, tc := range goldenTests {
+		if tc.name != name {
+			continue
+		}
+		data, err := os.ReadFile(goldenPath(name, goldenLayout(tc.layouts, version)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	t.Fatalf("no golden test %v", name)
+	return nil
+}
+
+// Every message at every supported version. A version that isn't in layouts
+// has to encode the same as the layout before it.
+func TestGolden(t *testing.T) {
+	for version := MinVersion; version <= Version; version++ {
+		for _, tc := range goldenTests {
+			layout := goldenLayout(tc.layouts, version)
+			if layout == 0 {
+				continue
+			}
+			t.Run(fmt.Sprintf("v%v/%v", version, tc.name), func(t *testing.T) {
+				encoded := encodeMsg(tc.msg, version)
+				path := goldenPath(tc.name, layout)
+
+				if *update && version == layout {
+					os.MkdirAll(filepath.Dir(path), 0755)
+					if err := os.WriteFile(path, encoded, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				golden, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("%v, run with -update to create it", err)
+				}
+				if !bytes.Equal(encoded, golden) {
+					t.Fatalf("encoding differs from %v, a layout change needs a version bump and a layouts entry\ngot  %x\nwant %x",
+						path, encoded, golden)
+				}
+
+				//Older layouts don't have every field, those decode as zero
+				decoded, err := tc.decode(golden, version)
+				if err != nil {
+					t.Fatalf("decode: %v", err)
+				}
+				if again := encodeMsg(decoded, version); !bytes.Equal(again, golden) {
+					t.Errorf("round trip mismatch\ngot  %x\nwant %x", again, golden)
+				}
+				if version == Version && !reflect.DeepEqual(decoded, tc.msg) {
+					t.Errorf("round trip mismatch\ngot  %+v\nwant %+v", decoded, tc.msg)
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, tc := range goldenTests {
+		if tc.openEnded {
+			continue
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			encoded := encodeMsg(tc.msg, Version)
+
+			if len(encoded) > 0 {
+				if _, err := tc.decode(encoded[:len(encoded)-1], Version); err != ErrShort {
+					t.Errorf("truncated: err = %v, want %v", err, ErrShort)
+				}
+			}
+			if _, err := tc.decode(append(encoded, 0), Version); err != ErrTrailing {
+				t.Errorf("trailing byte: err = %v, want %v", err, ErrTrailing)
+			}
+		})
+	}
+}
+
+func TestRecordSizes(t *testing.T) {
+	tests := []struct {
+		name string
+		got  int
+		want int
+	}{
+		{"player", len(AppendPlayerRecord(nil, &PlayerRecord{})), PlayerRecordSize},
+		{"object", len(AppendObjectRecord(nil, &ObjectRecord{})), ObjectRecordSize},
+		{"creature", len(AppendCreatureRecord(nil, &CreatureRecord{})), CreatureRecordSize},
+		{"member", len((&PartyUpdate{Members: []PartyMember{{}}}).Encode()) - 5, MemberRecordSize},
+		{"self", len((&WorldUpdate{}).Encode(Version)) - 3, SelfStateSize},
+	}
+
+	for _, tc := range tests {
+		if tc.got != tc.want {
+			t.Errorf("%v record is %v bytes, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+func TestPlayerNamesComp(t *testing.T) {
+	msg := &PlayerNames{Names: []PlayerName{{ID: 5, Name: "Someone", Level: 3}}}
+
+	decoded, err := DecodePlayerNamesComp(msg.EncodeComp(Version), Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, msg) {
+		t.Errorf("got %+v, want %+v", decoded, msg)
+	}
+}
+
+// Clients before VersionNames get names as one int32 per rune
+func TestDecodeRuneNames(t *testing.T) {
+	version := VersionNames - 1
+	data := readGolden(t, "player_names", version)
+
+	msg, err := DecodePlayerNames(data, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Names) != 3 || msg.Names[1].Name != "Zoë" || msg.Names[2].Name != "김민준" {
+		t.Errorf("got %+v", msg)
+	}
+	if !bytes.Equal(msg.Encode(version), data) {
+		t.Errorf("encoded %x, want %x", msg.Encode(version), data)
+	}
+
+	//Same names, a quarter of the bytes or less for ASCII
+	if size := len(msg.Encode(Version)); size >= len(data) {
+		t.Errorf("UTF-8 names %vb, runes %vb", size, len(data))
+	}
+}
+
+// Names over MaxNameBytes are cut between runes
+func TestLongName(t *testing.T) {
+	msg := &PlayerNames{Names: []PlayerName{{ID: 1, Name: strings.Repeat("é", 200)}}}
+
+	decoded, err := DecodePlayerNames(msg.Encode(Version), Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := decoded.Names[0].Name
+	if len(name) != 254 || !utf8.ValidString(name) {
+		t.Errorf("got %vb, valid %v", len(name), utf8.ValidString(name))
+	}
+}
+
+// Older clients still send the version 20 handshake
+func TestDecodeLegacyInit(t *testing.T) {
+	data := readGolden(t, "init_legacy", 20)
+
+	msg, err := DecodeInit(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Init{Version: 20, MinVersion: 20, Legacy: true}
+	if msg != want {
+		t.Errorf("got %+v, want %+v", msg, want)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	const serverCaps = CAP_COMPRESS_ZLIB | CAP_DELTA_UPDATES
+
+	tests := []struct {
+		name        string
+		init        Init
+		wantResult  INIT
+		wantVersion uint16
+		wantCaps    CAP
+	}{
+		{"same version", Init{Version: 21, MinVersion: 21, Caps: CAP_COMPRESS_ZLIB}, INIT_OK, 21, CAP_COMPRESS_ZLIB},
+		{"legacy client", Init{Version: 20, MinVersion: 20, Legacy: true}, INIT_OK, 20, 0},
+		{"newer client falls back", Init{Version: 25, MinVersion: 19, Caps: CAP_EXTENDED_RECORDS | CAP_DELTA_UPDATES},
+			INIT_OK, 21, CAP_DELTA_UPDATES},
+		{"too old", Init{Version: 19, MinVersion: 19, Legacy: true}, INIT_TOO_OLD, 0, 0},
+		{"too new", Init{Version: 30, MinVersion: 22}, INIT_TOO_NEW, 0, 0},
+		{"backwards range", Init{Version: 21, MinVersion: 40}, INIT_OK, 21, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reply := Negotiate(tc.init, 20, 21, serverCaps)
+
+			if reply.Result != tc.wantResult || reply.Version != tc.wantVersion || reply.Caps != tc.wantCaps {
+				t.Errorf("got %v v%v caps %v, want %v v%v caps %v",
+					reply.Result, reply.Version, reply.Caps, tc.wantResult, tc.wantVersion, tc.wantCaps)
+			}
+			if (reply.Result == INIT_OK) != (reply.Reason == "") {
+				t.Errorf("reason %q for result %v", reply.Reason, reply.Result)
+			}
+		})
+	}
+}
+
+// Clients before VersionInputSeq still get the old move and world update layouts
+func TestDecodeBeforeInputSeq(t *testing.T) {
+	version := VersionInputSeq - 1
+
+	data := readGolden(t, "move", version)
+	move, err := DecodeMove(data, version)
+	if err != nil || move != (Move{Dir: 5}) {
+		t.Errorf("move: got %+v, %v", move, err)
+	}
+	if !bytes.Equal(move.Encode(version), data) {
+		t.Errorf("move: encoded %x, want %x", move.Encode(version), data)
+	}
+
+	data = readGolden(t, "world_update", version)
+	update, err := DecodeWorldUpdate(data, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(update.Players) != 2 || len(update.Objects) != 1 || len(update.Creatures) != 1 {
+		t.Errorf("world update: got %+v", update)
+	}
+	if !bytes.Equal(update.Encode(version), data) {
+		t.Errorf("world update: encoded %x, want %x", update.Encode(version), data)
+	}
+}
+
+func TestCompressDict(t *testing.T) {
+	update := &WorldUpdate{Players: []PlayerRecord{{ID: 1, X: 2147483648, Y: 2147483632, Dir: 4, Health: 100}}}
+	data := update.Encode(Version)
+	dict := bytes.Repeat(data, 4)
+
+	tests := []struct {
+		name string
+		dict []byte
+	}{
+		{"plain", nil},
+		{"dictionary", dict},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := DecompressDict(CompressDict(data, tc.dict), tc.dict)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Errorf("got %x, want %x", out, data)
+			}
+		})
+	}
+
+	if _, err := DecompressDict(CompressDict(data, dict), nil); err == nil {
+		t.Errorf("decompressed without the dictionary")
+	}
+	if len(CompressDict(data, dict)) >= len(CompressDict(data, nil)) {
+		t.Errorf("dictionary didn't help")
+	}
+}
+
+func TestDictionary(t *testing.T) {
+	dict := []byte("some common bytes")
+	msg := &Dictionary{ID: DictID(dict), Data: dict}
+
+	decoded, err := DecodeDictionary(msg.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, msg) {
+		t.Errorf("got %+v, want %+v", decoded, msg)
+	}
+
+	msg.ID++
+	if _, err := DecodeDictionary(msg.Encode()); err != ErrDictID {
+		t.Errorf("wrong ID: err = %v, want %v", err, ErrDictID)
+	}
+}
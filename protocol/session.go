@@ -0,0 +1,47 @@
+package protocol
+
+import "encoding/binary"
+
+// Issued at login, sent back in CMD_Resume to pick the same character up again
+type SessionToken [16]byte
+
+// CMD_Session, server to client. Sent after CMD_Login and after every resume,
+// the old token stops working once a new one is sent.
+type Session struct {
+	Token        SessionToken
+	GraceSeconds uint16 //How long the character waits after a disconnect
+}
+
+func (m *Session) Encode() []byte {
+	out := append([]byte{}, m.Token[:]...)
+	return binary.LittleEndian.AppendUint16(out, m.GraceSeconds)
+}
+
+func DecodeSession(data []byte) (Session, error) {
+	r := &reader{data: data}
+	var m Session
+	copy(m.Token[:], r.take(len(m.Token)))
+	m.GraceSeconds = r.uint16()
+	return m, r.finish()
+}
+
+// CMD_Resume, client to server. Sent instead of CMD_Init on a new connection,
+// with the same handshake fields followed by the last token received.
+type Resume struct {
+	Init  Init
+	Token SessionToken
+}
+
+func (m *Resume) Encode() []byte {
+	init := m.Init
+	init.Legacy = false
+	return append(init.Encode(), m.Token[:]...)
+}
+
+func DecodeResume(data []byte) (Resume, error) {
+	r := &reader{data: data}
+	var m Resume
+	m.Init = Init{Version: r.uint16(), MinVersion: r.uint16(), Caps: CAP(r.uint32())}
+	copy(m.Token[:], r.take(len(m.Token)))
+	return m, r.finish()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+var zoneNames = map[ZONE]string{
+	ZONE_FLAGGED: "flagged",
+	ZONE_SAFE:    "safe",
+	ZONE_PVP:     "pvp",
+	ZONE_DUEL:    "duel",
+}
+
+// PvP rules at a position, the last zone added wins if they overlap
+func getZone(area *areaData, pos XYf32) ZONE {
+	if area == nil {
+		return ZONE_SAFE
+	}
+
+	intPos := floorXY(&pos)
+	for z := len(area.Zones) - 1; z >= 0; z-- {
+		if PosWithinRect(intPos, area.Zones[z].Rect, 0) {
+			return area.Zones[z].Mode
+		}
+	}
+	return area.PVP
+}
+
+// Check if player is allowed to damage target
+func canAttack(player, target *playerData) bool {
+	//Creatures fight anything
+	if player.creatureData != nil || target.creatureData != nil {
+		return true
+	}
+
+	pZone := getZone(player.area, player.pos)
+	tZone := getZone(target.area, target.pos)
+
+	if pZone == ZONE_SAFE || tZone == ZONE_SAFE {
+		return false
+	}
+	if player.duelTarget == target && target.duelTarget == player {
+		return true
+	}
+	if pZone == ZONE_DUEL || tZone == ZONE_DUEL {
+		return false
+	}
+	if pZone == ZONE_PVP && tZone == ZONE_PVP {
+		return true
+	}
+	return player.pvpFlag && target.pvpFlag
+}
+
+// Ask another player for a duel
+func requestDuel(player, target *playerData) {
+	if target == player {
+		writeToPlayer(player, CMD_Command, []byte("You can't duel yourself."))
+		return
+	}
+	if target.duelTarget != nil {
+		writeToPlayer(player, CMD_Command, []byte("They are already in a duel."))
+		return
+	}
+
+	target.duelRequest = player
+	writeToPlayer(player, CMD_Command, []byte(fmt.Sprintf("Duel request sent to %v.", target.name)))
+	writeToPlayer(target, CMD_Command,
+		[]byte(fmt.Sprintf("%v challenges you to a duel! (/duel accept or /duel decline)", player.name)))
+}
+
+// Accept a pending duel request
+func acceptDuel(player *playerData) {
+	challenger := player.duelRequest
+	player.duelRequest = nil
+
+	if challenger == nil || !challenger.VALID {
+		writeToPlayer(player, CMD_Command, []byte("No duel request."))
+		return
+	}
+	if challenger.duelTarget != nil {
+		writeToPlayer(player, CMD_Command, []byte("They are already in a duel."))
+		return
+	}
+
+	endDuel(player, false)
+	logInfo(SUB_COMBAT, "Duel: %v vs %v", challenger.name, player.name)
+	player.duelTarget = challenger
+	challenger.duelTarget = player
+	send_chat(fmt.Sprintf("%v and %v are dueling!", challenger.name, player.name))
+}
+
+// End a player's duel, optionally announcing them as the loser
+func endDuel(player *playerData, lost bool) {
+	opponent := player.duelTarget
+	if opponent == nil {
+		return
+	}
+
+	player.duelTarget = nil
+	if opponent.duelTarget == player {
+		opponent.duelTarget = nil
+	}
+
+	if lost {
+		send_chat(fmt.Sprintf("%v lost the duel against %v.", player.name, opponent.name))
+	}
+}
+
+// Add a PvP zone from the world editor
+func addZone(area *areaData, mode ZONE, rect image.Rectangle) {
+	if area == nil {
+		return
+	}
+	area.Zones = append(area.Zones, &pvpZone{Mode: mode, Rect: rect.Canon()})
+	area.dirty = true
+}
+
+// Remove all zones covering a position
+func removeZones(area *areaData, pos XY) {
+	if area == nil {
+		return
+	}
+
+	var zones []*pvpZone
+	for _, zone := range area.Zones {
+		if PosWithinRect(pos, zone.Rect, 0) {
+			continue
+		}
+		zones = append(zones, zone)
+	}
+	area.Zones = zones
+	area.dirty = true
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"goMMOServ/protocol"
+)
+
+const sessionCheckTicks = 8 //~1 second
+
+// Players by session token, processLock must be held
+var sessionList = map[protocol.SessionToken]*playerData{}
+
+// Give the player a new token, the old one stops working
+func issueSession(player *playerData) {
+	grace := config.Load().ResumeGraceSeconds
+	if player.protoVersion < protocol.VersionResume || grace == 0 {
+		return
+	}
+
+	endSession(player)
+	if _, err := rand.Read(player.session[:]); err != nil {
+		logError(SUB_NET, "issueSession: %v", err)
+		player.session = protocol.SessionToken{}
+		return
+	}
+	sessionList[player.session] = player
+
+	msg := &protocol.Session{Token: player.session, GraceSeconds: uint16(grace)}
+	writeToPlayer(player, CMD_Session, msg.Encode())
+}
+
+func endSession(player *playerData) {
+	if player.session == (protocol.SessionToken{}) {
+		return
+	}
+	delete(sessionList, player.session)
+	player.session = protocol.SessionToken{}
+}
+
+// Connection dropped, keep the character in the world for ResumeGraceSeconds.
+// Players without a session are removed straight away.
+func disconnectPlayer(player *playerData, reason string) {
+	defer reportPanic("disconnectPlayer")
+
+	grace := config.Load().ResumeGraceSeconds
+	if player.session == (protocol.SessionToken{}) || grace == 0 || shuttingDown.Load() {
+		removePlayer(player, reason)
+		return
+	}
+	if player.conn == nil {
+		return
+	}
+
+	player.conn.Close()
+	if numConnections.Load() > 0 {
+		numConnections.Add(-1)
+	}
+	player.conn = nil
+	player.disconnectedAt = time.Now()
+
+	//Stand still until they come back
+	player.moveDir = DIR_NONE
+	player.inputs = nil
+	player.pingSent = time.Time{}
+
+	logInfo(SUB_NET, "%v (%v) disconnected: %v, holding for %vs", player.name, player.id, reason, grace)
+}
+
+// Remove players that didn't come back in time. processLock must be held.
+func expireSessions() {
+	grace := time.Duration(config.Load().ResumeGraceSeconds) * time.Second
+
+	expired := []*playerData{}
+	for _, player := range playerList {
+		if !player.disconnectedAt.IsZero() && time.Since(player.disconnectedAt) >= grace {
+			expired = append(expired, player)
+		}
+	}
+	for _, player := range expired {
+		removePlayer(player, "connection lost")
+	}
+}
+
+func cmd_resume(player *playerData, data []byte) {
+	defer reportPanic("cmd_resume")
+
+	//Already in the game
+	if player.protoVersion != 0 {
+		return
+	}
+
+	msg, err := protocol.DecodeResume(data)
+	if err != nil {
+		logInfo(SUB_NET, "Invalid resume: %v", err)
+		refuseClient(player, false, &protocol.InitReply{Result: protocol.INIT_REFUSED, Reason: "Invalid handshake."})
+		return
+	}
+	if !handshake(player, msg.Init) {
+		return
+	}
+
+	old := sessionList[msg.Token]
+	if old == nil || !old.VALID || msg.Token == (protocol.SessionToken{}) {
+		logInfo(SUB_NET, "ID: %v, unknown or expired session, joining as new", player.id)
+		joinWorld(player)
+		sendPlayernames(player, false)
+		return
+	}
+
+	resumeSession(player, old)
+
+	login := &protocol.Login{ID: old.id, Area: old.area.ID}
+	writeToPlayer(old, CMD_Login, login.Encode())
+	issueSession(old)
+	sendPlayernames(old, false)
+	writeToPlayer(old, CMD_Chat, []byte("Reconnected."))
+}
+
+// Move this connection onto an existing character, and drop the placeholder
+// player made when it connected. The old connection is closed if still open.
+func resumeSession(player, old *playerData) {
+	if old.conn != nil {
+		old.conn.Close()
+		if numConnections.Load() > 0 {
+			numConnections.Add(-1)
+		}
+	}
+
+	gone := "connected"
+	if !old.disconnectedAt.IsZero() {
+		gone = fmt.Sprintf("gone %v", time.Since(old.disconnectedAt).Round(time.Second))
+	}
+	logInfo(SUB_NET, "%v (%v) resumed from %v, %v", old.name, old.id, player.addr, gone)
+
+	old.conn = player.conn
+	old.addr = player.addr
+	old.protoVersion = player.protoVersion
+	old.caps = player.caps
+	old.compressor = player.compressor //Set up in the handshake, for these caps and dictionary
+	old.disconnectedAt = time.Time{}
+
+	//New client, nothing it had carries over
+	old.visCache = make(map[XY]*visCacheData)
+	old.numVis = 0
+	old.inputs = nil
+	old.inputSeq = 0
+	old.pingSent = time.Time{}
+
+	player.conn = nil
+	player.resumed = old
+	deletePlayer(player)
+}
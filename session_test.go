@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"goMMOServ/protocol"
+
+	"github.com/remeh/sizedwaitgroup"
+)
+
+// Player that finished the handshake and has a session
+func (w *testWorld) addSessionPlayer(pos XYf32) *playerData {
+	player := w.addPlayer(pos)
+	player.protoVersion = protocol.VersionResume
+	issueSession(player)
+	if sessionList[player.session] != player {
+		w.t.Fatalf("no session issued")
+	}
+	return player
+}
+
+func TestResumeSession(t *testing.T) {
+	w := newTestWorld(t)
+	old := w.addSessionPlayer(XYf32{X: 100, Y: 50})
+	old.disconnectedAt = time.Now().Add(-10 * time.Second)
+	old.visCache[XY{X: 1, Y: 1}] = &visCacheData{}
+	old.numVis = 1
+	old.inputSeq = 40
+	token := old.session
+
+	placeholder := w.addPlayer(XYf32{X: 0, Y: 0})
+	placeholder.protoVersion = protocol.VersionResume
+	placeholder.addr = "10.0.0.2"
+
+	resumeSession(placeholder, old)
+	issueSession(old)
+
+	if placeholder.resumed != old || placeholder.VALID || numPlayers != 1 {
+		t.Errorf("placeholder not dropped: resumed %v valid %v players %v", placeholder.resumed != nil, placeholder.VALID, numPlayers)
+	}
+	if !old.disconnectedAt.IsZero() || old.addr != "10.0.0.2" || old.pos != (XYf32{X: 100, Y: 50}) {
+		t.Errorf("old player not reattached: %+v", old)
+	}
+	if len(old.visCache) != 0 || old.numVis != 0 || old.inputSeq != 0 {
+		t.Errorf("client state carried over: vis %v, seq %v", len(old.visCache), old.inputSeq)
+	}
+	if sessionList[token] != nil || sessionList[old.session] != old {
+		t.Errorf("token not replaced")
+	}
+}
+
+// The new connection's caps decide compression, not the old one's
+func TestResumeCompression(t *testing.T) {
+	trained := protocol.NewCompressor([]byte("trained dictionary"))
+	tests := []struct {
+		name    string
+		oldCaps protocol.CAP
+		oldComp *protocol.Compressor
+		caps    protocol.CAP
+		want    *protocol.Compressor
+	}{
+		{"zlib dropped", protocol.CAP_COMPRESS_ZLIB, plainCompressor, 0, nil},
+		{"zlib added", 0, nil, protocol.CAP_COMPRESS_ZLIB, plainCompressor},
+		{"new dictionary", protocol.CAP_COMPRESS_ZLIB, plainCompressor, protocol.CAP_COMPRESS_ZLIB, trained},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newTestWorld(t)
+			old := w.addSessionPlayer(XYf32{X: 0, Y: 0})
+			old.protoVersion = protocol.Version
+			old.caps, old.compressor = tc.oldCaps, tc.oldComp
+
+			oldDict := dictCompressor
+			t.Cleanup(func() { dictCompressor = oldDict })
+			dictCompressor = nil
+			if tc.want == trained {
+				dictCompressor = trained
+			}
+
+			placeholder := w.addPlayer(XYf32{X: 0, Y: 0})
+			placeholder.conn = &fakeConn{}
+			placeholder.protoVersion = protocol.Version
+			placeholder.caps = tc.caps
+			setupCompression(placeholder)
+
+			resumeSession(placeholder, old)
+			if old.caps != tc.caps || old.compressor != tc.want {
+				t.Errorf("caps %v, compressor %p, want %v and %p", old.caps, old.compressor, tc.caps, tc.want)
+			}
+		})
+	}
+}
+
+func TestExpireSessions(t *testing.T) {
+	w := newTestWorld(t)
+	grace := time.Duration(config.Load().ResumeGraceSeconds) * time.Second
+
+	expired := w.addSessionPlayer(XYf32{X: 0, Y: 0})
+	expired.disconnectedAt = time.Now().Add(-grace - time.Second)
+	waiting := w.addSessionPlayer(XYf32{X: 200, Y: 0})
+	waiting.disconnectedAt = time.Now().Add(-grace / 2)
+	connected := w.addSessionPlayer(XYf32{X: 400, Y: 0})
+
+	expireSessions()
+
+	if expired.VALID || len(sessionList) != 2 {
+		t.Errorf("expired player still here: valid %v, %v sessions", expired.VALID, len(sessionList))
+	}
+	if !waiting.VALID || !connected.VALID {
+		t.Errorf("removed early: waiting %v connected %v", waiting.VALID, connected.VALID)
+	}
+}
+
+// Records what was sent. No lock, only one goroutine may write to a connection.
+type recordTransport struct {
+	sent   []CMD
+	broken bool
+}
+
+func (r *recordTransport) Send(data []byte) error {
+	if r.broken {
+		return errors.New("broken pipe")
+	}
+	r.sent = append(r.sent, CMD(data[0]))
+	return nil
+}
+func (r *recordTransport) Receive() ([]byte, error) { return nil, io.EOF }
+func (r *recordTransport) SendClose(int, string)    {}
+func (r *recordTransport) Close() error             { return nil }
+func (r *recordTransport) RemoteAddr() string       { return "10.0.0.1:1" }
+func (r *recordTransport) has(cmd CMD) bool         { return slices.Contains(r.sent, cmd) }
+
+// A failed world update drops the player after serializing, not from the
+// serialize goroutines while they write to everyone else. Run with -race.
+func TestSerializeSendFailure(t *testing.T) {
+	w := newTestWorld(t)
+	live := w.addPlayer(XYf32{X: 0, Y: 0})
+	liveConn := &recordTransport{}
+	live.conn = liveConn
+	gone := w.addPlayer(XYf32{X: 1, Y: 0})
+	gone.conn = &recordTransport{broken: true}
+	held := w.addSessionPlayer(XYf32{X: 2, Y: 0})
+	held.conn = &recordTransport{broken: true}
+
+	wg := sizedwaitgroup.New(4)
+	processLock.Lock()
+	serializeTick(&wg)
+	processLock.Unlock()
+
+	if gone.VALID || gone.sendFailed {
+		t.Errorf("player without a session not removed")
+	}
+	if !held.VALID || held.conn != nil || held.disconnectedAt.IsZero() || held.sendFailed {
+		t.Errorf("player with a session not held: valid %v, conn %v", held.VALID, held.conn)
+	}
+	if !liveConn.has(CMD_WorldUpdate) || !liveConn.has(CMD_Chat) {
+		t.Errorf("live player got %v, want a world update and the leave message", liveConn.sent)
+	}
+}
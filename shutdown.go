@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	shuttingDown   atomic.Bool
+	shutdownCancel chan struct{}
+	shutdownDone   = make(chan struct{})
+	shutdownLock   sync.Mutex
+
+	//Set in main, so we can stop accepting connections
+	httpsServer *http.Server
+)
+
+// Warn players, then save and stop. Only one shutdown can be pending.
+func startShutdown(delay time.Duration, reason string) bool {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+
+	if shutdownCancel != nil || shuttingDown.Load() {
+		return false
+	}
+	cancel := make(chan struct{})
+	shutdownCancel = cancel
+
+	logInfo(SUB_GENERAL, "Shutdown in %v: %v", delay, reason)
+
+	go func() {
+		defer reportPanic("startShutdown")
+
+		remaining := delay.Round(time.Second)
+		for remaining > 0 {
+			if shutdownAnnounce(remaining) {
+				processLock.Lock()
+				send_chat(fmt.Sprintf("[Server] Restarting in %v (%v)", remaining, reason))
+				processLock.Unlock()
+			}
+
+			select {
+			case <-cancel:
+				return
+			case <-time.After(time.Second):
+			}
+			remaining -= time.Second
+		}
+
+		finishShutdown(reason)
+	}()
+	return true
+}
+
+// Stop a pending shutdown, processLock must be held
+func cancelShutdown() bool {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+
+	if shutdownCancel == nil || shuttingDown.Load() {
+		return false
+	}
+	close(shutdownCancel)
+	shutdownCancel = nil
+
+	logInfo(SUB_GENERAL, "Shutdown cancelled.")
+	send_chat("[Server] Restart cancelled.")
+	return true
+}
+
+// Announce every minute, then at 30, 10 and the last 5 seconds
+func shutdownAnnounce(remaining time.Duration) bool {
+	secs := int(remaining.Seconds())
+
+	if secs%60 == 0 || secs == 30 || secs == 10 || secs <= 5 {
+		return true
+	}
+	return false
+}
+
+// Stop accepting players, save everything and disconnect everyone
+func finishShutdown(reason string) {
+	if shuttingDown.Swap(true) {
+		return
+	}
+	logInfo(SUB_GENERAL, "Shutting down: %v", reason)
+
+	//Stop accepting connections
+	stopTCPListener()
+	if httpsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		httpsServer.Shutdown(ctx)
+		cancel()
+	}
+
+	//Save
+	for _, area := range areaList {
+		if area != nil {
+			area.dirty = true
+		}
+	}
+	saveWorld()
+
+	processLock.Lock()
+	saveAllPlayers()
+
+	//Disconnect with a reason the client can show
+	for _, player := range playerList {
+		if player.conn == nil {
+			continue
+		}
+		sendClose(player, closeServiceRestart, reason)
+		killConnection(player, true)
+	}
+	processLock.Unlock()
+
+	logInfo(SUB_GENERAL, "Shutdown complete.")
+	close(shutdownDone)
+}
+
+// SIGTERM or SIGINT starts a shutdown, a second one skips the countdown
+func shutdownSignalDaemon() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		defer reportPanic("shutdownSignalDaemon")
+
+		for sig := range sigs {
+			delay := time.Duration(config.Load().ShutdownSeconds) * time.Second
+			if !startShutdown(delay, "server shutdown") {
+				logInfo(SUB_GENERAL, "Got %v again, shutting down now.", sig)
+				go finishShutdown("server shutdown")
+			}
+		}
+	}()
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"image"
 	"sync"
+	"time"
 
-	"github.com/gorilla/websocket"
+	"goMMOServ/protocol"
 )
 
 type IID struct {
@@ -16,14 +18,30 @@ type IID struct {
 type worldObject struct {
 	ID  IID
 	Pos XY
+
+	//Temporary objects (loot drops), not saved
+	owner       *playerData
+	ownerTick   uint64
+	despawnTick uint64
 }
 
 type playerData struct {
-	conn         *websocket.Conn
+	conn         transport
+	addr         string
 	creatureData *creatureData
 
-	name   string
-	health int16
+	//Agreed in the handshake, zero until then
+	protoVersion uint16
+	caps         protocol.CAP
+	compressor   *protocol.Compressor //nil if the client can't take zlib
+
+	name      string //Display name, what other players see
+	account   string //The save this player is on, "" until they pick one. Never changes once set.
+	passHash  []byte //Kept with the save, a save is only loaded with its password
+	health    int16
+	maxHealth int16
+	level     uint8
+	xp        uint32
 
 	id            uint32
 	pos           XYf32
@@ -32,6 +50,25 @@ type playerData struct {
 	lastDirUpdate uint64
 	mode          PMode
 
+	inputs   []moveInput //Buffered moves, one applied per tick
+	inputSeq uint16      //Seq of the last move applied, echoed to the client
+	cheat    cheatData
+
+	passwordBusy bool //A password is being hashed for this player, see passwordWork
+	sendFailed   bool //A world update couldn't be sent, the tick drops them after serializing
+
+	pingID   uint32
+	pingSent time.Time     //Zero when no ping is waiting on an answer
+	rtt      time.Duration //Smoothed round trip, zero until the first pong
+	history  [posHistory]posRecord
+
+	session        protocol.SessionToken
+	disconnectedAt time.Time   //Zero while connected
+	resumed        *playerData //Set on the placeholder when a connection resumes a session
+
+	lastRename  time.Time
+	nameHistory []nameChange
+
 	visCache map[XY]*visCacheData
 	numVis   int
 
@@ -39,6 +76,19 @@ type playerData struct {
 	targets    []*targetingData
 	numTargets int
 
+	downedTick uint64
+	bindArea   *areaData
+	bindPos    XY
+
+	pvpFlag     bool
+	duelTarget  *playerData
+	duelRequest *playerData
+
+	party       *partyData
+	partyInvite *playerData //Who invited us, their party is made when we accept
+	kills       uint32
+	inventory   map[IID]uint32
+
 	area  *areaData
 	VALID bool
 }
@@ -75,15 +125,26 @@ type areaData struct {
 	Name   string
 	ID     uint16
 	Chunks map[XY]*chunkData
+	PVP    ZONE
+	Zones  []*pvpZone
 	dirty  bool
 
 	areaLock sync.RWMutex
 }
 
+type pvpZone struct {
+	Mode ZONE
+	Rect image.Rectangle
+}
+
 type creatureData struct {
-	id     IID
-	mode   CRE
-	target *playerData
+	id        IID
+	mode      CRE
+	target    *playerData
+	attackers []*playerData
+
+	home     XYf32 //Respawns here
+	defeated bool  //Set on the killing blow, removed after the tick
 }
 
 type chunkData struct {
@@ -101,4 +162,12 @@ type chunkData struct {
 	hasOcache     bool
 	creatureCache []byte
 	cCacheTick    uint64
+
+	//Bit-packed records, for clients with CAP_PACKED_RECORDS
+	packedPlayers   []byte
+	ppCacheTick     uint64
+	packedObjects   []byte
+	hasPackedOcache bool
+	packedCreatures []byte
+	pcCacheTick     uint64
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A client connection. Messages are whole: a CMD byte followed by its payload.
+// Only one goroutine may Receive and one may Send at a time.
+type transport interface {
+	Send(data []byte) error
+	Receive() ([]byte, error)
+	SendClose(code int, reason string) //Reason the client can show, before Close
+	Close() error
+	RemoteAddr() string
+}
+
+// Transports that can compress a message themselves, websocket permessage-deflate
+type deflater interface {
+	CanDeflate() bool //Negotiated with the client
+	SendDeflate(data []byte) error
+}
+
+// Close codes, the same numbers as websocket close frames
+const (
+	closePolicyViolation = websocket.ClosePolicyViolation
+	closeServiceRestart  = websocket.CloseServiceRestart
+)
+
+// Browser clients, one binary frame per message
+type wsTransport struct {
+	conn    *websocket.Conn
+	deflate bool
+}
+
+// Compression is off unless asked for per message
+func newWSTransport(conn *websocket.Conn, deflate bool) *wsTransport {
+	conn.SetReadLimit(int64(config.Load().MaxNetRead))
+	conn.EnableWriteCompression(false)
+	return &wsTransport{conn: conn, deflate: deflate}
+}
+
+func (t *wsTransport) Send(data []byte) error {
+	return t.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (t *wsTransport) CanDeflate() bool {
+	return t.deflate
+}
+
+func (t *wsTransport) SendDeflate(data []byte) error {
+	t.conn.EnableWriteCompression(true)
+	defer t.conn.EnableWriteCompression(false)
+
+	return t.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (t *wsTransport) Receive() ([]byte, error) {
+	_, data, err := t.conn.ReadMessage()
+	return data, err
+}
+
+func (t *wsTransport) SendClose(code int, reason string) {
+	//Control frames are limited to 125 bytes
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	closeMsg := websocket.FormatCloseMessage(code, reason)
+	t.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+}
+
+func (t *wsTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *wsTransport) RemoteAddr() string {
+	return t.conn.RemoteAddr().String()
+}
+
+// Native clients and bots. Each message is a uint32 little-endian length
+// followed by that many bytes, the same bytes as a websocket frame.
+type tcpTransport struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+const tcpHeaderSize = 4
+
+func newTCPTransport(conn net.Conn) *tcpTransport {
+	return &tcpTransport{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Header and payload go out in one write, so frames are never split
+func (t *tcpTransport) Send(data []byte) error {
+	frame := make([]byte, tcpHeaderSize, tcpHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(frame, uint32(len(data)))
+	_, err := t.conn.Write(append(frame, data...))
+	return err
+}
+
+func (t *tcpTransport) Receive() ([]byte, error) {
+	var header [tcpHeaderSize]byte
+	if _, err := io.ReadFull(t.reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(header[:])
+	if size > uint32(config.Load().MaxNetRead) {
+		return nil, fmt.Errorf("message too large: %vb", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(t.reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// No close frames, the refusal or kick message sent before is all they get
+func (t *tcpTransport) SendClose(code int, reason string) {
+}
+
+func (t *tcpTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *tcpTransport) RemoteAddr() string {
+	return t.conn.RemoteAddr().String()
+}
+
+var (
+	tcpListener     net.Listener
+	tcpListenerLock sync.Mutex
+)
+
+// Accept native clients on TCPAddr, closed by stopTCPListener
+func startTCPListener(addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		logError(SUB_NET, "TCP listener: %v", err)
+		return
+	}
+	tcpListenerLock.Lock()
+	tcpListener = listener
+	tcpListenerLock.Unlock()
+	logInfo(SUB_NET, "TCP clients on %v", addr)
+
+	go func() {
+		defer reportPanic("startTCPListener")
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !shuttingDown.Load() {
+					logError(SUB_NET, "TCP accept: %v", err)
+				}
+				return
+			}
+			if shuttingDown.Load() {
+				conn.Close()
+				continue
+			}
+			go handleConnection(newTCPTransport(conn))
+		}
+	}()
+}
+
+func stopTCPListener() {
+	tcpListenerLock.Lock()
+	defer tcpListenerLock.Unlock()
+
+	if tcpListener != nil {
+		tcpListener.Close()
+		tcpListener = nil
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"goMMOServ/protocol"
+)
+
+func TestTCPTransportFraming(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	a, b := newTCPTransport(client), newTCPTransport(server)
+
+	messages := [][]byte{{byte(CMD_Chat), 'h', 'i'}, {byte(CMD_Init)}, bytes.Repeat([]byte{7}, 5000)}
+	go func() {
+		for _, msg := range messages {
+			a.Send(msg)
+		}
+	}()
+
+	for i, want := range messages {
+		got, err := b.Receive()
+		if err != nil {
+			t.Fatalf("message %v: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("message %v: got %vb, want %vb", i, len(got), len(want))
+		}
+	}
+}
+
+func TestTCPTransportTooLarge(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go newTCPTransport(client).Send(make([]byte, config.Load().MaxNetRead+1))
+	if _, err := newTCPTransport(server).Receive(); err == nil {
+		t.Errorf("oversized message accepted")
+	}
+}
+
+// A native client can join through the same path as a browser
+func TestTCPJoin(t *testing.T) {
+	w := newTestWorld(t)
+	oldConfig := config.Load()
+	t.Cleanup(func() { config.Store(oldConfig) })
+	config.Store(defaultConfig())
+	config.Load().ResumeGraceSeconds = 0
+
+	client, server := net.Pipe()
+	conn := newTCPTransport(client)
+	go handleConnection(newTCPTransport(server))
+
+	init := &protocol.Init{Version: protocol.Version, MinVersion: protocol.MinVersion}
+	conn.Send(append([]byte{byte(CMD_Init)}, init.Encode()...))
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	var login protocol.Login
+	for login.ID == 0 {
+		data, err := conn.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if CMD(data[0]) == CMD_Login {
+			login, _ = protocol.DecodeLogin(data[1:])
+		}
+	}
+
+	//Keep reading, the server holds processLock while it writes
+	go func() {
+		for {
+			if _, err := conn.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+
+	processLock.RLock()
+	player := findPlayerByID(login.ID)
+	processLock.RUnlock()
+	if player == nil || player.area != w.area {
+		t.Fatalf("player %v not in the world", login.ID)
+	}
+	client.Close()
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		processLock.RLock()
+		gone := !player.VALID
+		processLock.RUnlock()
+		if gone {
+			return
+		}
+	}
+	t.Errorf("player not removed after the connection closed")
+}
@@ -6,6 +6,7 @@ import (
 	"image"
 	"io"
 	"math"
+	"strings"
 	"sync"
 )
 
@@ -57,7 +58,7 @@ func floorXY(input *XYf32) XY {
 }
 
 func floatXY(input *XY) XYf32 {
-	return XYf32{X: float32(xyCenter + int(input.X)), Y: float32(xyCenter + int(input.Y))}
+	return XYf32{X: float32(xyCenter - int(input.X)), Y: float32(xyCenter - int(input.Y))}
 }
 
 func distanceFloat(a, b XYf32) float64 {
@@ -94,7 +95,7 @@ func UncompressZip(data []byte) []byte {
 
 	z, err := zlib.NewReader(b)
 	if err != nil {
-		doLog(true, err.Error())
+		logError(SUB_GENERAL, "%v", err)
 		return nil
 	}
 	defer z.Close()
@@ -113,7 +114,7 @@ func CompressZip(data []byte) []byte {
 	var b bytes.Buffer
 	w, err := zlib.NewWriterLevel(&b, zlib.BestSpeed)
 	if err != nil {
-		doLog(true, err.Error())
+		logError(SUB_GENERAL, "%v", err)
 		return nil
 	}
 	w.Write(data)
@@ -155,6 +156,51 @@ func PosWithinRect(pos XY, rect image.Rectangle, pad uint32) bool {
 	return false
 }
 
+// Find an online player by display or account name, lookalikes match
+func findPlayerByName(name string) *playerData {
+	key := nameKey(name)
+	if key == "" {
+		return nil
+	}
+	for _, player := range playerList {
+		if nameKey(player.name) == key || (player.account != "" && nameKey(player.account) == key) {
+			return player
+		}
+	}
+	return nil
+}
+
+// Find an online player named by the first words of args, the longest name
+// wins. Returns the player and the words after their name.
+func findPlayerInArgs(args []string) (*playerData, []string) {
+	for n := len(args); n > 0; n-- {
+		if player := findPlayerByName(strings.Join(args[:n], " ")); player != nil {
+			return player, args[n:]
+		}
+	}
+	return nil, nil
+}
+
+// Find an online player by ID
+func findPlayerByID(id uint32) *playerData {
+	for _, player := range playerList {
+		if player.id == id {
+			return player
+		}
+	}
+	return nil
+}
+
+// Find a loaded area by ID
+func getArea(id uint16) *areaData {
+	for _, area := range areaList {
+		if area != nil && area.ID == id {
+			return area
+		}
+	}
+	return nil
+}
+
 func justEnteredVis(player *playerData, pos XY) bool {
 	for v, vis := range player.visCache {
 		if vis.pos == pos {
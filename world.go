@@ -13,21 +13,22 @@ type saveData struct {
 	Version uint16
 	Name    string
 	ID      uint16
+	PVP     ZONE
+	Zones   []*pvpZone `json:",omitempty"`
 	Objects []*worldObject
 }
 
 const (
-	areaVersion      = 1
-	dataDir          = "data"
-	areaDir          = "areas"
-	suffix           = ".json"
-	worldSaveSeconds = 5
+	areaVersion = 1
+	dataDir     = "data"
+	areaDir     = "areas"
+	suffix      = ".json"
 )
 
 func autoSaveWorld() {
 
 	for {
-		time.Sleep(time.Second * worldSaveSeconds)
+		time.Sleep(time.Second * time.Duration(config.Load().WorldSaveSeconds))
 		saveWorld()
 	}
 }
@@ -38,6 +39,9 @@ func saveWorld() {
 	processLock.Lock()
 	defer processLock.Unlock()
 
+	saveStart := time.Now()
+	defer func() { saveHistogram.observe(time.Since(saveStart)) }()
+
 	for a, area := range areaList {
 
 		if !area.dirty {
@@ -45,10 +49,18 @@ func saveWorld() {
 		}
 
 		for _, chunk := range area.Chunks {
-			sdat.Objects = append(sdat.Objects, chunk.WorldObjects...)
+			for _, obj := range chunk.WorldObjects {
+				//Skip loot drops
+				if obj.despawnTick != 0 {
+					continue
+				}
+				sdat.Objects = append(sdat.Objects, obj)
+			}
 		}
 
 		sdat.Version = areaVersion
+		sdat.PVP = area.PVP
+		sdat.Zones = area.Zones
 
 		outbuf := new(bytes.Buffer)
 		enc := json.NewEncoder(outbuf)
@@ -58,7 +70,7 @@ func saveWorld() {
 
 		err := enc.Encode(sdat)
 		if err != nil {
-			doLog(true, "WriteSector: enc.Encode %v", err.Error())
+			logError(SUB_SAVE, "WriteSector: enc.Encode %v", err.Error())
 			return
 		}
 		areaList[a].dirty = false
@@ -67,19 +79,19 @@ func saveWorld() {
 		_, err = os.Create(filePath)
 
 		if err != nil {
-			doLog(true, "WriteSector: os.Create %v", err.Error())
+			logError(SUB_SAVE, "WriteSector: os.Create %v", err.Error())
 			return
 		}
 
 		err = os.WriteFile(filePath, outbuf.Bytes(), 0644)
 
 		if err != nil {
-			doLog(true, "WriteSector: WriteFile %v", err.Error())
+			logError(SUB_SAVE, "WriteSector: WriteFile %v", err.Error())
 			return
 		}
 
 		area.dirty = false
-		doLog(false, "Autosave: %v", area.Name)
+		logDebug(SUB_SAVE, "Autosave: %v", area.Name)
 	}
 }
 
@@ -87,10 +99,10 @@ func loadWorld() {
 	processLock.Lock()
 	defer processLock.Unlock()
 
-	doLog(true, "Loading areas...")
+	logInfo(SUB_SAVE, "Loading areas...")
 	items, err := os.ReadDir(dataDir + "/" + areaDir)
 	if err != nil {
-		doLog(true, "Unable to read data dir.")
+		logWarn(SUB_SAVE, "Unable to read data dir.")
 		return
 	}
 
@@ -112,14 +124,14 @@ func loadWorld() {
 
 		data, err := os.ReadFile(dataDir + "/" + areaDir + "/" + fileName)
 		if err != nil {
-			doLog(true, "Unable to read file: %v", fileName)
+			logWarn(SUB_SAVE, "Unable to read file: %v", fileName)
 			continue
 		} else {
-			doLog(true, "Reading %v", fileName)
+			logDebug(SUB_SAVE, "Reading %v", fileName)
 		}
 
 		if data == nil {
-			doLog(true, "File contains no data: %v", fileName)
+			logWarn(SUB_SAVE, "File contains no data: %v", fileName)
 			continue
 		}
 
@@ -129,17 +141,18 @@ func loadWorld() {
 
 		err = decoder.Decode(&sdat)
 		if err != nil {
-			doLog(true, "Unable to decode json: %v", fileName)
+			logError(SUB_SAVE, "Unable to decode json: %v", fileName)
 			continue
 		}
 
 		if sdat.Version != areaVersion {
-			doLog(true, "Incompatable area version: %v", fileName)
+			logError(SUB_SAVE, "Incompatable area version: %v", fileName)
 			continue
 		}
 
 		//Put data into an area
-		newArea := &areaData{Version: areaVersion, Name: areaName, ID: sdat.ID}
+		newArea := &areaData{Version: areaVersion, Name: areaName, ID: sdat.ID,
+			PVP: sdat.PVP, Zones: sdat.Zones}
 		newArea.Chunks = make(map[XY]*chunkData)
 
 		numObj := 0
@@ -148,7 +161,7 @@ func loadWorld() {
 			numObj++
 		}
 
-		doLog(true, "Loaded %v objects, %v files in dir.", numObj, fileFound)
+		logInfo(SUB_SAVE, "Loaded %v objects, %v files in dir.", numObj, fileFound)
 
 		areaList[newArea.ID] = newArea
 	}